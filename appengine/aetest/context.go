@@ -41,7 +41,20 @@ An example test file:
 	}
 
 The environment variable APPENGINE_DEV_APPSERVER specifies the location of the
-dev_appserver.py executable to use. If unset, the system PATH is consulted.
+dev_appserver.py executable to use, unless Options.SDKRoot is set. If neither
+is set, the system PATH is consulted.
+The environment variable APPENGINE_PYTHON likewise specifies the Python
+interpreter to run it with, unless Options.Python is set.
+
+So that an interrupted test run does not leave dev_appserver.py processes
+behind, on Unix systems the test process handles SIGINT and SIGTERM with
+os/signal while any instance is open: on either signal, it kills the
+processes of the instances that are still open and removes their temporary
+app directories. It then stops handling the signal and raises it again, so
+the test process is terminated as it would have been without aetest, or the
+signal is delivered to any handler the test has registered for it. On
+Windows and Plan 9, where an interrupt already reaches dev_appserver.py,
+signals are not handled.
 */
 package aetest
 
@@ -55,6 +68,7 @@ import (
 	"time"
 
 	"appengine"
+	"appengine/datastore"
 	"appengine/user"
 	"appengine_internal"
 	"github.com/golang/protobuf/proto"
@@ -105,7 +119,8 @@ type context struct {
 
 func (c *context) AppID() string               { return c.instance.appID() }
 func (c *context) Request() interface{}        { return c.req }
-func (c *context) FullyQualifiedAppID() string { return "dev~" + c.instance.appID() }
+func (c *context) FullyQualifiedAppID() string { return c.instance.fullyQualifiedAppID() }
+func (c *context) ModuleName() string          { return c.instance.moduleName() }
 
 func (c *context) logf(level, format string, args ...interface{}) {
 	log.Printf(level+": "+format, args...)
@@ -195,6 +210,12 @@ func (c *context) Call(service, method string, in, out appengine_internal.ProtoM
 		out.(*basepb.StringProto).Value = proto.String("")
 		return nil
 	}
+	if handled, err := c.instance.intercept(service, method, in, out); handled {
+		return err
+	}
+	if err := c.instance.childExitError(); err != nil {
+		return err
+	}
 	data, err := proto.Marshal(in)
 	if err != nil {
 		return err
@@ -227,3 +248,46 @@ func (c *singleContext) Logout() {
 func (c *singleContext) Close() error {
 	return c.context.instance.Close()
 }
+
+// instanceOf returns the instance that c sends its API calls to, or nil if c
+// was not created by this package.
+func instanceOf(c appengine.Context) Instance {
+	switch c := c.(type) {
+	case *singleContext:
+		return c.instance
+	case *context:
+		return c.instance
+	}
+	return nil
+}
+
+// AdminURL returns the base URL of the dev_appserver admin console of the
+// instance that c sends its API calls to, as Instance.AdminURL does. It is
+// useful for inspecting the instance while debugging a test. c must have been
+// returned by NewContext, or by appengine.NewContext for a request made by
+// Instance.NewRequest; otherwise AdminURL returns "".
+func AdminURL(c appengine.Context) string {
+	if inst := instanceOf(c); inst != nil {
+		return inst.AdminURL()
+	}
+	return ""
+}
+
+// AppURL returns the base URL of the app's HTTP server of the instance that
+// c sends its API calls to, as Instance.AppURL does. Like AdminURL, it
+// returns "" if c was not created by this package.
+func AppURL(c appengine.Context) string {
+	if inst := instanceOf(c); inst != nil {
+		return inst.AppURL()
+	}
+	return ""
+}
+
+// ImportEntities stores fixture entities in the datastore of the instance
+// that c sends its API calls to, as datastore.PutMulti does, so that a test
+// can start from known data. The entities are not stored in a transaction:
+// if an error is returned, some of them may have been stored.
+func ImportEntities(c appengine.Context, keys []*datastore.Key, entities interface{}) error {
+	_, err := datastore.PutMulti(c, keys, entities)
+	return err
+}
@@ -0,0 +1,45 @@
+// Copyright 2015 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"testing"
+
+	"appengine"
+)
+
+// urlInstance is an Instance that only reports its URLs.
+type urlInstance struct {
+	Instance
+}
+
+func (urlInstance) AdminURL() string { return "http://localhost:8000" }
+func (urlInstance) AppURL() string   { return "http://localhost:8080" }
+
+// otherContext is an appengine.Context not created by this package.
+type otherContext struct {
+	appengine.Context
+}
+
+func TestURLs(t *testing.T) {
+	c := &context{instance: urlInstance{}}
+	tests := []struct {
+		desc       string
+		c          appengine.Context
+		admin, app string
+	}{
+		{"context", c, "http://localhost:8000", "http://localhost:8080"},
+		{"singleContext", &singleContext{c}, "http://localhost:8000", "http://localhost:8080"},
+		{"other context", otherContext{}, "", ""},
+	}
+	for _, tt := range tests {
+		if got := AdminURL(tt.c); got != tt.admin {
+			t.Errorf("%s: AdminURL = %q, want %q", tt.desc, got, tt.admin)
+		}
+		if got := AppURL(tt.c); got != tt.app {
+			t.Errorf("%s: AppURL = %q, want %q", tt.desc, got, tt.app)
+		}
+	}
+}
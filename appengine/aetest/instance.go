@@ -7,11 +7,17 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"appengine_internal"
@@ -23,11 +29,28 @@ type Instance interface {
 	io.Closer
 	// NewRequest returns an *http.Request associated with this instance.
 	NewRequest(method, urlStr string, body io.Reader) (*http.Request, error)
+	// AdminURL returns the base URL of the dev_appserver admin console,
+	// such as "http://localhost:8000". The datastore viewer is at
+	// AdminURL() + "/datastore". The URL is only usable until Close is called.
+	AdminURL() string
+	// AppURL returns the base URL of the app's HTTP server, such as
+	// "http://localhost:8080", whose port is Options.Port if that is set.
+	// The URL is only usable until Close is called.
+	AppURL() string
 
 	// appID returns the ID of the application.
 	appID() string
+	// fullyQualifiedAppID returns the fully qualified ID of the application.
+	fullyQualifiedAppID() string
+	// moduleName returns the name of the module the application runs as.
+	moduleName() string
 	// url returns the base URL for the API server.
 	url() string
+	// childExitError returns an error if the API server has exited.
+	childExitError() error
+	// intercept passes an API call to Options.Interceptor, if set, and
+	// reports whether it handled the call.
+	intercept(service, method string, in, out appengine_internal.ProtoMessage) (handled bool, err error)
 }
 
 // NewInstance launches a running instance of api_server.py which can be used
@@ -35,6 +58,9 @@ type Instance interface {
 // instance.
 // If opts is nil the default values are used.
 func NewInstance(opts *Options) (Instance, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
 	i := &instance{
 		opts: opts,
 	}
@@ -53,18 +79,141 @@ func newSessionID() string {
 // Options is used to specify options when creating an Instance.
 type Options struct {
 	// AppID specifies the App ID to use during tests.
-	// By default, "testapp".
+	// By default, "testapp", or the App ID part of FullyQualifiedAppID
+	// if that is set.
 	AppID string
+	// FullyQualifiedAppID specifies the App ID returned verbatim by the
+	// FullyQualifiedAppID method of Contexts, such as "s~myapp" or
+	// "s~example.com:myapp". Its App ID part must match AppID if both are
+	// set. By default, "dev~" followed by the App ID.
+	FullyQualifiedAppID string
 	// StronglyConsistentDatastore is whether the local datastore should be
 	// strongly consistent. This will diverge from production behaviour.
 	StronglyConsistentDatastore bool
+	// Python is the path of the Python interpreter used to run
+	// dev_appserver.py. By default, the APPENGINE_PYTHON environment
+	// variable is consulted, and then python2.7 and python are looked
+	// for in the system PATH.
+	Python string
+	// SDKRoot is the directory of the App Engine SDK whose dev_appserver.py
+	// is used. By default, the APPENGINE_DEV_APPSERVER environment variable
+	// is consulted, and then dev_appserver.py is looked for in the system
+	// PATH.
+	SDKRoot string
+	// Env holds extra environment variables, of the form "key=value", for
+	// the dev_appserver.py process. It otherwise inherits the environment
+	// of the test; a key set in Env takes precedence over an inherited one.
+	Env []string
+	// OnChildExit, if non-nil, is called with the result of waiting for the
+	// dev_appserver.py process if it exits before Close is called, such as
+	// when it crashes. It is called on its own goroutine. After the process
+	// has exited, API calls fail with an error saying so. OnChildExit is not
+	// called when Close stops the process.
+	OnChildExit func(error)
+	// Port is the port for the app's HTTP server, which tests and external
+	// tools can then reach at a known URL. It must be free when the Instance
+	// is started. By default, a random free port is used, which keeps
+	// concurrently running instances apart. Either way, the URL is reported
+	// by AppURL.
+	Port int
+	// Module is the name of the module that the test application runs as,
+	// which is set in its app.yaml and returned by appengine.ModuleName for
+	// the Instance's requests. By default, "default".
+	Module string
+	// Interceptor, if non-nil, is called for each API call made with a
+	// Context of the Instance, before the call is sent to dev_appserver.py,
+	// so that a test can record calls or stub out specific ones. If it
+	// returns handled as true, the call is not sent, and err, along with
+	// anything Interceptor stored in out, is its result. Otherwise, err is
+	// ignored and the call is sent as usual. It may be called concurrently
+	// if the Contexts are used concurrently.
+	Interceptor func(service, method string, in, out appengine_internal.ProtoMessage) (handled bool, err error)
 }
 
 func (o *Options) appID() string {
-	if o == nil || o.AppID == "" {
+	if o == nil {
 		return "testapp"
 	}
-	return o.AppID
+	if o.AppID != "" {
+		return o.AppID
+	}
+	if o.FullyQualifiedAppID != "" {
+		return appengine_internal.AppID(o.FullyQualifiedAppID)
+	}
+	return "testapp"
+}
+
+func (o *Options) fullyQualifiedAppID() string {
+	if o == nil || o.FullyQualifiedAppID == "" {
+		return "dev~" + o.appID()
+	}
+	return o.FullyQualifiedAppID
+}
+
+// partition returns the partition prefix of the fully qualified App ID,
+// such as "dev" or "s".
+func (o *Options) partition() string {
+	fqai := o.fullyQualifiedAppID()
+	if i := strings.Index(fqai, "~"); i != -1 {
+		return fqai[:i]
+	}
+	return ""
+}
+
+// validAppID matches an App ID, with an optional domain prefix.
+var validAppID = regexp.MustCompile(`^([a-z0-9\-.]+:)?[a-z0-9][a-z0-9\-]*$`)
+
+// validModule matches a module name.
+var validModule = regexp.MustCompile(`^[a-z0-9]([a-z0-9\-]{0,61}[a-z0-9])?$`)
+
+func (o *Options) validate() error {
+	if o == nil {
+		return nil
+	}
+	if o.AppID != "" && !validAppID.MatchString(o.AppID) {
+		return fmt.Errorf("aetest: invalid AppID %q", o.AppID)
+	}
+	if o.FullyQualifiedAppID != "" {
+		id := appengine_internal.AppID(o.FullyQualifiedAppID)
+		if !validAppID.MatchString(id) {
+			return fmt.Errorf("aetest: invalid FullyQualifiedAppID %q", o.FullyQualifiedAppID)
+		}
+		if o.AppID != "" && o.AppID != id {
+			return fmt.Errorf("aetest: FullyQualifiedAppID %q does not match AppID %q", o.FullyQualifiedAppID, o.AppID)
+		}
+	}
+	if o.Module != "" && !validModule.MatchString(o.Module) {
+		return fmt.Errorf("aetest: invalid Module %q", o.Module)
+	}
+	if o.Port < 0 || o.Port > 65535 {
+		return fmt.Errorf("aetest: invalid Port %d", o.Port)
+	}
+	return nil
+}
+
+func (o *Options) moduleName() string {
+	if o == nil || o.Module == "" {
+		return "default"
+	}
+	return o.Module
+}
+
+func (o *Options) port() int {
+	if o == nil {
+		return 0
+	}
+	return o.Port
+}
+
+// checkPortFree returns an error if port cannot be listened on locally.
+// dev_appserver.py does not report a failure to bind its app server in a
+// way that can be told apart from a slow start, so it is checked up front.
+func checkPortFree(port int) error {
+	l, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		return fmt.Errorf("aetest: Port %d is not available: %v", port, err)
+	}
+	return l.Close()
 }
 
 func (o *Options) extraAppserverFlags() []string {
@@ -72,6 +221,11 @@ func (o *Options) extraAppserverFlags() []string {
 	if o != nil && o.StronglyConsistentDatastore {
 		fs = append(fs, "--datastore_consistency_policy=consistent")
 	}
+	if o != nil && o.FullyQualifiedAppID != "" {
+		// Run the API server under the same fully qualified App ID,
+		// so that it accepts the keys created with it.
+		fs = append(fs, "--default_partition="+o.partition())
+	}
 	return fs
 }
 
@@ -86,8 +240,13 @@ type instance struct {
 	child    *exec.Cmd
 	apiURL   string // base URL of API HTTP server
 	adminURL string // base URL of admin HTTP server
+	appURL   string // base URL of app HTTP server
 	appDir   string
 	relFuncs []func() // funcs to release any associated contexts
+
+	exited  chan struct{} // closed when the child process has exited
+	exitErr error         // the result of waiting for the child; set before exited is closed
+	closing int32         // atomic; set to 1 once Close starts stopping the child
 }
 
 // url returns the base URL for the API server.
@@ -95,11 +254,31 @@ func (i *instance) url() string {
 	return i.apiURL
 }
 
+// AdminURL returns the base URL of the admin server.
+func (i *instance) AdminURL() string {
+	return i.adminURL
+}
+
+// AppURL returns the base URL of the app server.
+func (i *instance) AppURL() string {
+	return i.appURL
+}
+
 // AppID returns the ID of the application.
 func (i *instance) appID() string {
 	return i.opts.appID()
 }
 
+// fullyQualifiedAppID returns the fully qualified ID of the application.
+func (i *instance) fullyQualifiedAppID() string {
+	return i.opts.fullyQualifiedAppID()
+}
+
+// moduleName returns the name of the module the application runs as.
+func (i *instance) moduleName() string {
+	return i.opts.moduleName()
+}
+
 // NewRequest returns an *http.Request associated with this instance.
 func (i *instance) NewRequest(method, urlStr string, body io.Reader) (*http.Request, error) {
 	req, err := http.NewRequest(method, urlStr, body)
@@ -131,6 +310,7 @@ func (i *instance) Close() (err error) {
 		return nil
 	}
 	defer func() {
+		untrackChild(i.child)
 		i.child = nil
 		err1 := os.RemoveAll(i.appDir)
 		if err == nil {
@@ -138,37 +318,109 @@ func (i *instance) Close() (err error) {
 		}
 	}()
 
+	atomic.StoreInt32(&i.closing, 1)
+	select {
+	case <-i.exited:
+		// The exit was already reported to OnChildExit, if set. Processes
+		// that the child started may have outlived it.
+		if p := i.child.Process; p != nil {
+			killProcessGroup(p)
+		}
+		return nil
+	default:
+	}
 	if p := i.child.Process; p != nil {
-		errc := make(chan error, 1)
-		go func() {
-			errc <- i.child.Wait()
-		}()
-
 		// Call the quit handler on the admin server.
 		res, err := http.Get(i.adminURL + "/quit")
 		if err != nil {
-			p.Kill()
+			killProcessGroup(p)
 			return fmt.Errorf("unable to call /quit handler: %v", err)
 		}
 		res.Body.Close()
 
 		select {
 		case <-time.After(15 * time.Second):
-			p.Kill()
+			killProcessGroup(p)
 			return errors.New("timeout killing child process")
-		case err = <-errc:
-			// Do nothing.
+		case <-i.exited:
+			err = i.exitErr
 		}
 	}
 	return
 }
 
+// children holds the running dev_appserver.py processes, and the app
+// directory of each, so that they can be cleaned up if the test process is
+// interrupted by one of reapSignals before their instances are closed.
+// Processes of instances that are never closed, such as after a test panics,
+// are not tracked down. While there are any children, reapc receives the
+// signals for reapChildren.
+var (
+	childrenMu sync.Mutex
+	children   = make(map[*exec.Cmd]string)
+	reapc      chan os.Signal
+)
+
+func trackChild(cmd *exec.Cmd, appDir string) {
+	childrenMu.Lock()
+	defer childrenMu.Unlock()
+	children[cmd] = appDir
+	if reapc == nil && len(reapSignals) > 0 {
+		reapc = make(chan os.Signal, 1)
+		signal.Notify(reapc, reapSignals...)
+		go reapChildren(reapc)
+	}
+}
+
+func untrackChild(cmd *exec.Cmd) {
+	childrenMu.Lock()
+	defer childrenMu.Unlock()
+	delete(children, cmd)
+	if len(children) == 0 && reapc != nil {
+		signal.Stop(reapc)
+		close(reapc)
+		reapc = nil
+	}
+}
+
+// reapChildren kills all tracked processes and removes their app directories
+// once a signal arrives on sigc. It then stops handling the signal and raises
+// it again, so that the test process gets the signal's default behavior, or
+// that of any other handler for it. It returns if sigc is closed first.
+func reapChildren(sigc chan os.Signal) {
+	sig, ok := <-sigc
+	if !ok {
+		return
+	}
+	childrenMu.Lock()
+	signal.Stop(sigc)
+	if reapc == sigc {
+		reapc = nil
+	}
+	for cmd, appDir := range children {
+		if p := cmd.Process; p != nil {
+			killProcessGroup(p)
+		}
+		os.RemoveAll(appDir)
+		delete(children, cmd)
+	}
+	childrenMu.Unlock()
+	fmt.Fprintf(os.Stderr, "aetest: killed dev_appserver.py on %v\n", sig)
+	raise(sig)
+}
+
 func fileExists(path string) bool {
 	_, err := os.Stat(path)
 	return err == nil
 }
 
-func findPython() (path string, err error) {
+func findPython(opts *Options) (path string, err error) {
+	if opts != nil && opts.Python != "" {
+		return checkExecutable(opts.Python, "Options.Python")
+	}
+	if p := os.Getenv("APPENGINE_PYTHON"); p != "" {
+		return checkExecutable(p, "APPENGINE_PYTHON environment variable")
+	}
 	for _, name := range []string{"python2.7", "python"} {
 		path, err = exec.LookPath(name)
 		if err == nil {
@@ -178,7 +430,31 @@ func findPython() (path string, err error) {
 	return
 }
 
-func findDevAppserver() (string, error) {
+// checkExecutable returns path if it names an executable file, and an error
+// mentioning source otherwise.
+func checkExecutable(path, source string) (string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s; path %q doesn't exist", source, path)
+	}
+	if fi.IsDir() || (runtime.GOOS != "windows" && fi.Mode()&0111 == 0) {
+		return "", fmt.Errorf("invalid %s; %q is not executable", source, path)
+	}
+	return path, nil
+}
+
+func findDevAppserver(opts *Options) (string, error) {
+	if opts != nil && opts.SDKRoot != "" {
+		p := filepath.Join(opts.SDKRoot, "dev_appserver.py")
+		fi, err := os.Stat(p)
+		if err != nil {
+			return "", fmt.Errorf("invalid Options.SDKRoot; %q doesn't exist", p)
+		}
+		if !fi.Mode().IsRegular() {
+			return "", fmt.Errorf("invalid Options.SDKRoot; %q is not a file", p)
+		}
+		return p, nil
+	}
 	if p := os.Getenv("APPENGINE_DEV_APPSERVER"); p != "" {
 		if fileExists(p) {
 			return p, nil
@@ -188,8 +464,32 @@ func findDevAppserver() (string, error) {
 	return exec.LookPath("dev_appserver.py")
 }
 
+// mergeEnv returns the environment base with the variables in extra added,
+// replacing any of the same name.
+func mergeEnv(base, extra []string) []string {
+	override := make(map[string]bool)
+	for _, kv := range extra {
+		override[envKey(kv)] = true
+	}
+	env := make([]string, 0, len(base)+len(extra))
+	for _, kv := range base {
+		if !override[envKey(kv)] {
+			env = append(env, kv)
+		}
+	}
+	return append(env, extra...)
+}
+
+func envKey(kv string) string {
+	if i := strings.Index(kv, "="); i != -1 {
+		return kv[:i]
+	}
+	return kv
+}
+
 var apiServerAddrRE = regexp.MustCompile(`Starting API server at: (\S+)`)
 var adminServerAddrRE = regexp.MustCompile(`Starting admin server at: (\S+)`)
+var appServerAddrRE = regexp.MustCompile(`Starting module "[^"]*" running at: (\S+)`)
 
 func (i *instance) startChild() (err error) {
 	if PrepareDevAppserver != nil {
@@ -197,11 +497,16 @@ func (i *instance) startChild() (err error) {
 			return err
 		}
 	}
-	python, err := findPython()
+	if port := i.opts.port(); port != 0 {
+		if err := checkPortFree(port); err != nil {
+			return err
+		}
+	}
+	python, err := findPython(i.opts)
 	if err != nil {
 		return fmt.Errorf("Could not find python interpreter: %v", err)
 	}
-	devAppserver, err := findDevAppserver()
+	devAppserver, err := findDevAppserver(i.opts)
 	if err != nil {
 		return fmt.Errorf("Could not find dev_appserver.py: %v", err)
 	}
@@ -226,7 +531,7 @@ func (i *instance) startChild() (err error) {
 
 	appserverArgs := []string{
 		devAppserver,
-		"--port=0",
+		fmt.Sprintf("--port=%d", i.opts.port()),
 		"--api_port=0",
 		"--admin_port=0",
 		"--skip_sdk_update_check=true",
@@ -241,6 +546,10 @@ func (i *instance) startChild() (err error) {
 		python,
 		appserverArgs...,
 	)
+	if i.opts != nil && len(i.opts.Env) > 0 {
+		i.child.Env = mergeEnv(os.Environ(), i.opts.Env)
+	}
+	setProcessGroup(i.child)
 	i.child.Stdout = os.Stdout
 	var stderr io.Reader
 	stderr, err = i.child.StderrPipe()
@@ -251,11 +560,19 @@ func (i *instance) startChild() (err error) {
 	if err = i.child.Start(); err != nil {
 		return err
 	}
+	trackChild(i.child, i.appDir)
+	defer func() {
+		if err != nil {
+			untrackChild(i.child)
+		}
+	}()
 
-	// Wait until we have read the URLs of the API server and admin interface.
+	// Wait until we have read the URLs of the API server, admin interface
+	// and app server.
 	errc := make(chan error, 1)
 	apic := make(chan string)
 	adminc := make(chan string)
+	appc := make(chan string)
 	go func() {
 		s := bufio.NewScanner(stderr)
 		for s.Scan() {
@@ -265,34 +582,72 @@ func (i *instance) startChild() (err error) {
 			if match := adminServerAddrRE.FindSubmatch(s.Bytes()); match != nil {
 				adminc <- string(match[1])
 			}
+			if match := appServerAddrRE.FindSubmatch(s.Bytes()); match != nil {
+				appc <- string(match[1])
+			}
 		}
 		if err = s.Err(); err != nil {
 			errc <- err
 		}
 	}()
 
-	for i.apiURL == "" || i.adminURL == "" {
+	for i.apiURL == "" || i.adminURL == "" || i.appURL == "" {
 		select {
 		case i.apiURL = <-apic:
 		case i.adminURL = <-adminc:
+		case i.appURL = <-appc:
 		case <-time.After(15 * time.Second):
 			if p := i.child.Process; p != nil {
-				p.Kill()
+				killProcessGroup(p)
 			}
 			return errors.New("timeout starting child process")
 		case err := <-errc:
 			return fmt.Errorf("error reading child process stderr: %v", err)
 		}
 	}
+	i.exited = make(chan struct{})
+	go i.waitChild()
 	return nil
 }
 
+// waitChild waits for the child process to exit, and reports an unexpected
+// exit to the OnChildExit option.
+func (i *instance) waitChild() {
+	i.exitErr = i.child.Wait()
+	close(i.exited)
+	if atomic.LoadInt32(&i.closing) == 0 && i.opts != nil && i.opts.OnChildExit != nil {
+		i.opts.OnChildExit(i.exitErr)
+	}
+}
+
+// intercept passes an API call to Options.Interceptor, if set.
+func (i *instance) intercept(service, method string, in, out appengine_internal.ProtoMessage) (bool, error) {
+	if i.opts == nil || i.opts.Interceptor == nil {
+		return false, nil
+	}
+	return i.opts.Interceptor(service, method, in, out)
+}
+
+// childExitError returns an error if the child process has exited.
+func (i *instance) childExitError() error {
+	select {
+	case <-i.exited:
+		if i.exitErr != nil {
+			return fmt.Errorf("aetest: test instance has exited: %v", i.exitErr)
+		}
+		return errors.New("aetest: test instance has exited")
+	default:
+		return nil
+	}
+}
+
 func (i *instance) appYAML() string {
-	return fmt.Sprintf(appYAMLTemplate, i.opts.appID())
+	return fmt.Sprintf(appYAMLTemplate, i.opts.appID(), i.opts.moduleName())
 }
 
 const appYAMLTemplate = `
 application: %s
+module: %s
 version: 1
 runtime: go
 api_version: go1
@@ -0,0 +1,30 @@
+// Copyright 2015 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// +build windows plan9
+
+package aetest
+
+import (
+	"os"
+	"os/exec"
+)
+
+// There are no process groups on this platform, so only the
+// dev_appserver.py process itself is killed. Processes it has started
+// may be left running.
+//
+// An interrupt already reaches dev_appserver.py, as it is sent to every
+// process that shares the test process's console or note group, so no
+// signals are handled.
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+func killProcessGroup(p *os.Process) {
+	p.Kill()
+}
+
+var reapSignals []os.Signal
+
+func raise(sig os.Signal) {}
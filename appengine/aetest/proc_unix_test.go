@@ -0,0 +1,63 @@
+// Copyright 2015 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// +build !windows,!plan9
+
+package aetest
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestReapChildren(t *testing.T) {
+	// The test's own handler gets the signal that reapChildren raises again,
+	// instead of the test process being interrupted.
+	sigc := make(chan os.Signal, 2)
+	signal.Notify(sigc, syscall.SIGTERM)
+	defer signal.Stop(sigc)
+
+	appDir, err := ioutil.TempDir("", "aetest-reap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(appDir)
+	cmd := exec.Command("sleep", "60")
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	trackChild(cmd, appDir)
+
+	syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	select {
+	case <-exited:
+	case <-time.After(10 * time.Second):
+		t.Fatal("child was not killed")
+	}
+	if fileExists(appDir) {
+		t.Error("app directory was not removed")
+	}
+	for n := 0; n < 2; n++ {
+		select {
+		case <-sigc:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("got %d signals, want the original and the raised one", n)
+		}
+	}
+
+	childrenMu.Lock()
+	defer childrenMu.Unlock()
+	if len(children) != 0 || reapc != nil {
+		t.Errorf("after reaping, got %d children and reapc = %v, want none", len(children), reapc)
+	}
+}
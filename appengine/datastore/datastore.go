@@ -8,6 +8,7 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"sync"
 
 	"appengine"
 	"appengine_internal"
@@ -31,15 +32,36 @@ var (
 // unexported in the destination struct.
 // StructType is the type of the struct pointed to by the destination argument
 // passed to Get or to Iterator.Next.
+//
+// If several fields mismatch, the error describes the first of them, and
+// Mismatches returns them all.
 type ErrFieldMismatch struct {
 	StructType reflect.Type
 	FieldName  string
 	Reason     string
+
+	others []*ErrFieldMismatch // the mismatches after this one, if any
 }
 
 func (e *ErrFieldMismatch) Error() string {
-	return fmt.Sprintf("datastore: cannot load field %q into a %q: %s",
+	s := fmt.Sprintf("datastore: cannot load field %q into a %q: %s",
 		e.FieldName, e.StructType, e.Reason)
+	if len(e.others) > 0 {
+		s += fmt.Sprintf(" (and %d more)", len(e.others))
+	}
+	return s
+}
+
+// Mismatches returns every field mismatch found when loading the entity, in
+// the order the properties were loaded, starting with e itself.
+func (e *ErrFieldMismatch) Mismatches() []*ErrFieldMismatch {
+	return append([]*ErrFieldMismatch{e}, e.others...)
+}
+
+// isErrFieldMismatch returns whether err is an *ErrFieldMismatch.
+func isErrFieldMismatch(err error) bool {
+	_, ok := err.(*ErrFieldMismatch)
+	return ok
 }
 
 // protoToKey converts a Reference proto to a *Key.
@@ -130,6 +152,84 @@ func multiValid(key []*Key) error {
 	return err
 }
 
+// maxBatchSize is the largest number of keys or entities that the datastore
+// service accepts in a single Get, Put or Delete call.
+const maxBatchSize = 500
+
+// runBatches splits the range [0, n) into consecutive chunks of at most
+// maxBatchSize and calls f concurrently on each chunk's bounds. The errors
+// returned by f are merged into a single appengine.MultiError for all n
+// items, in their original order. A non-MultiError from f is reported for
+// every item in that chunk, unless every chunk failed with the same such
+// error, which is then returned as is.
+func runBatches(n int, f func(lo, hi int) error) error {
+	if n <= maxBatchSize {
+		return f(0, n)
+	}
+	errs := make([]error, (n+maxBatchSize-1)/maxBatchSize)
+	var wg sync.WaitGroup
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			lo, hi := batchBounds(i, n)
+			errs[i] = f(lo, hi)
+		}(i)
+	}
+	wg.Wait()
+
+	if sameError(errs) {
+		return errs[0]
+	}
+	multiErr, any := make(appengine.MultiError, n), false
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		any = true
+		lo, hi := batchBounds(i, n)
+		if me, ok := err.(appengine.MultiError); ok {
+			copy(multiErr[lo:hi], me)
+			continue
+		}
+		for j := lo; j < hi; j++ {
+			multiErr[j] = err
+		}
+	}
+	if any {
+		return multiErr
+	}
+	return nil
+}
+
+// sameError reports whether errs are all the same non-MultiError error: of
+// the same type and with the same message, as when every chunk's call failed
+// for the same reason.
+func sameError(errs []error) bool {
+	first := errs[0]
+	if first == nil {
+		return false
+	}
+	if _, ok := first.(appengine.MultiError); ok {
+		return false
+	}
+	for _, err := range errs[1:] {
+		if err == nil || reflect.TypeOf(err) != reflect.TypeOf(first) || err.Error() != first.Error() {
+			return false
+		}
+	}
+	return true
+}
+
+// batchBounds returns the bounds of the i'th chunk used by runBatches.
+func batchBounds(i, n int) (lo, hi int) {
+	lo, hi = i*maxBatchSize, (i+1)*maxBatchSize
+	if hi > n {
+		hi = n
+	}
+	return lo, hi
+}
+
 // It's unfortunate that the two semantically equivalent concepts pb.Reference
 // and pb.PropertyValue_ReferenceValue aren't the same type. For example, the
 // two have different protobuf field numbers.
@@ -221,14 +321,20 @@ func checkMultiArg(v reflect.Value) (m multiArgType, elemType reflect.Type) {
 // or implement PropertyLoadSaver. If there is no such entity for the key, Get
 // returns ErrNoSuchEntity.
 //
+// Get is strongly consistent: it sees every Put and Delete of k that
+// completed before it was called, including one made earlier in the same
+// request. Queries without an ancestor filter are only eventually consistent,
+// so they may not yet see such a change.
+//
 // The values of dst's unmatched struct fields are not modified, and matching
 // slice-typed fields are not reset before appending to them. In particular, it
 // is recommended to pass a pointer to a zero valued struct on each Get call.
 //
 // ErrFieldMismatch is returned when a field is to be loaded into a different
 // type than the one it was stored from, or when a field is missing or
-// unexported in the destination struct. ErrFieldMismatch is only returned if
-// dst is a struct pointer.
+// unexported in the destination struct. If there are several such fields,
+// the error's Mismatches method lists them all. ErrFieldMismatch is only
+// returned if dst is a struct pointer.
 func Get(c appengine.Context, key *Key, dst interface{}) error {
 	if dst == nil { // GetMulti catches nil interface; we need to catch nil ptr here
 		return ErrInvalidEntityType
@@ -250,6 +356,14 @@ func Get(c appengine.Context, key *Key, dst interface{}) error {
 // As a special case, PropertyList is an invalid type for dst, even though a
 // PropertyList is a slice of structs. It is treated as invalid to avoid being
 // mistakenly passed when []PropertyList was intended.
+//
+// A []PropertyList dst can hold entities of any kind, so it suits keys of
+// several kinds. The element for a key with no stored entity is set to nil,
+// and ErrNoSuchEntity is reported for it in the MultiError.
+//
+// Any number of keys may be given. More than 500 keys, the datastore's
+// per-call limit, are fetched in several concurrent calls, and any errors are
+// still reported as a single appengine.MultiError indexed like key.
 func GetMulti(c appengine.Context, key []*Key, dst interface{}) error {
 	v := reflect.ValueOf(dst)
 	multiArgType, _ := checkMultiArg(v)
@@ -265,6 +379,13 @@ func GetMulti(c appengine.Context, key []*Key, dst interface{}) error {
 	if err := multiValid(key); err != nil {
 		return err
 	}
+	return runBatches(len(key), func(lo, hi int) error {
+		return getMulti(c, key[lo:hi], v.Slice(lo, hi), multiArgType)
+	})
+}
+
+// getMulti implements GetMulti for at most maxBatchSize keys.
+func getMulti(c appengine.Context, key []*Key, v reflect.Value, multiArgType multiArgType) error {
 	req := &pb.GetRequest{
 		Key: multiKeyToProto(c.FullyQualifiedAppID(), key),
 	}
@@ -279,6 +400,9 @@ func GetMulti(c appengine.Context, key []*Key, dst interface{}) error {
 	for i, e := range res.Entity {
 		if e.Entity == nil {
 			multiErr[i] = ErrNoSuchEntity
+			if v.Type().Elem() == typeOfPropertyList {
+				v.Index(i).Set(reflect.Zero(typeOfPropertyList))
+			}
 		} else {
 			elem := v.Index(i)
 			if multiArgType == multiArgTypePropertyLoadSaver || multiArgType == multiArgTypeStruct {
@@ -299,6 +423,87 @@ func GetMulti(c appengine.Context, key []*Key, dst interface{}) error {
 	return nil
 }
 
+// GetMap is like GetMulti, but returns the loaded entities in a map keyed by
+// the encoded form of their keys, omitting any key that has no stored entity.
+// newDst is called once per key to allocate a destination, which must be a
+// valid dst for Get.
+//
+// As for Get, an ErrFieldMismatch does not prevent an entity from being
+// included. If any key fails with an error other than ErrNoSuchEntity then
+// an appengine.MultiError indexed like key is returned along with the
+// entities that were loaded.
+func GetMap(c appengine.Context, key []*Key, newDst func() interface{}) (map[string]interface{}, error) {
+	dst := make([]interface{}, len(key))
+	for i := range dst {
+		dst[i] = newDst()
+	}
+	err := GetMulti(c, key, dst)
+	me, ok := err.(appengine.MultiError)
+	if err != nil && !ok {
+		return nil, err
+	}
+	m := make(map[string]interface{}, len(key))
+	failed := false
+	for i, k := range key {
+		if ok && me[i] != nil {
+			if me[i] == ErrNoSuchEntity {
+				me[i] = nil
+				continue
+			}
+			failed = true
+			if !isErrFieldMismatch(me[i]) {
+				continue
+			}
+		}
+		m[k.Encode()] = dst[i]
+	}
+	if failed {
+		return m, me
+	}
+	return m, nil
+}
+
+// Exists reports, for each key, whether an entity is stored with that key.
+// The returned slice is indexed like key. Any number of keys may be given,
+// as with GetMulti.
+//
+// Exists is cheaper than GetMulti as it loads nothing, but the service has no
+// keys-only lookup, so the entities are still fetched.
+func Exists(c appengine.Context, key []*Key) ([]bool, error) {
+	if len(key) == 0 {
+		return nil, nil
+	}
+	if err := multiValid(key); err != nil {
+		return nil, err
+	}
+	ret := make([]bool, len(key))
+	err := runBatches(len(key), func(lo, hi int) error {
+		return exists(c, key[lo:hi], ret[lo:hi])
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// exists implements Exists for at most maxBatchSize keys.
+func exists(c appengine.Context, key []*Key, ret []bool) error {
+	req := &pb.GetRequest{
+		Key: multiKeyToProto(c.FullyQualifiedAppID(), key),
+	}
+	res := &pb.GetResponse{}
+	if err := c.Call("datastore_v3", "Get", req, res, nil); err != nil {
+		return err
+	}
+	if len(key) != len(res.Entity) {
+		return errors.New("datastore: internal error: server returned the wrong number of entities")
+	}
+	for i, e := range res.Entity {
+		ret[i] = e.Entity != nil
+	}
+	return nil
+}
+
 // Put saves the entity src into the datastore with key k. src must be a struct
 // pointer or implement PropertyLoadSaver; if a struct pointer then any
 // unexported fields of that struct will be skipped. If k is an incomplete key,
@@ -314,9 +519,46 @@ func Put(c appengine.Context, key *Key, src interface{}) (*Key, error) {
 	return k[0], nil
 }
 
+// PutIncomplete saves the entity src as a new entity of the given kind, with
+// an integer ID allocated by the datastore, and returns its complete key. It
+// is the common "insert a new entity" case of Put. kind cannot be empty, and
+// parent must either be a complete key or nil.
+//
+// The ID is allocated and the entity written in a transaction, so either the
+// entity is stored under its new key or nothing is. If c is already a
+// transaction's context, the entity is put as part of that transaction.
+func PutIncomplete(c appengine.Context, kind string, parent *Key, src interface{}) (*Key, error) {
+	if kind == "" {
+		return nil, errors.New("datastore: PutIncomplete given an empty kind")
+	}
+	if parent != nil && !parent.valid() {
+		return nil, ErrInvalidKey
+	}
+	if _, ok := c.(*transaction); ok {
+		return Put(c, NewIncompleteKey(c, kind, parent), src)
+	}
+	var key *Key
+	err := RunInTransaction(c, func(tc appengine.Context) error {
+		var err error
+		key, err = Put(tc, NewIncompleteKey(tc, kind, parent), src)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
 // PutMulti is a batch version of Put.
 //
 // src must satisfy the same conditions as the dst argument to GetMulti.
+// As with GetMulti, any number of entities may be given.
+//
+// More than 500 entities are put in several concurrent calls. Each call is
+// atomic, but the calls as a whole are not: if some of them fail, the entities
+// of the others are still saved. PutMulti then returns an appengine.MultiError
+// indexed like key, along with the keys of the entities that were saved, with
+// nil for those that were not.
 func PutMulti(c appengine.Context, key []*Key, src interface{}) ([]*Key, error) {
 	v := reflect.ValueOf(src)
 	multiArgType, _ := checkMultiArg(v)
@@ -329,10 +571,27 @@ func PutMulti(c appengine.Context, key []*Key, src interface{}) ([]*Key, error)
 	if len(key) == 0 {
 		return nil, nil
 	}
-	appID := c.FullyQualifiedAppID()
 	if err := multiValid(key); err != nil {
 		return nil, err
 	}
+	ret := make([]*Key, len(key))
+	err := runBatches(len(key), func(lo, hi int) error {
+		k, err := putMulti(c, key[lo:hi], v.Slice(lo, hi), multiArgType)
+		copy(ret[lo:hi], k)
+		return err
+	})
+	if _, ok := err.(appengine.MultiError); ok {
+		return ret, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// putMulti implements PutMulti for at most maxBatchSize entities.
+func putMulti(c appengine.Context, key []*Key, v reflect.Value, multiArgType multiArgType) ([]*Key, error) {
+	appID := c.FullyQualifiedAppID()
 	req := &pb.PutRequest{}
 	for i := range key {
 		elem := v.Index(i)
@@ -373,6 +632,8 @@ func Delete(c appengine.Context, key *Key) error {
 }
 
 // DeleteMulti is a batch version of Delete.
+// As with GetMulti, any number of keys may be given. More than 500 keys are
+// deleted in several concurrent calls, which are not atomic as a whole.
 func DeleteMulti(c appengine.Context, key []*Key) error {
 	if len(key) == 0 {
 		return nil
@@ -380,6 +641,13 @@ func DeleteMulti(c appengine.Context, key []*Key) error {
 	if err := multiValid(key); err != nil {
 		return err
 	}
+	return runBatches(len(key), func(lo, hi int) error {
+		return deleteMulti(c, key[lo:hi])
+	})
+}
+
+// deleteMulti implements DeleteMulti for at most maxBatchSize keys.
+func deleteMulti(c appengine.Context, key []*Key) error {
 	req := &pb.DeleteRequest{
 		Key: multiKeyToProto(c.FullyQualifiedAppID(), key),
 	}
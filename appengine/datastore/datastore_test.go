@@ -0,0 +1,510 @@
+// Copyright 2015 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+
+	"appengine"
+	"appengine_internal"
+	pb "appengine_internal/datastore"
+)
+
+func TestRunBatches(t *testing.T) {
+	const n = 2*maxBatchSize + 1
+	errRPC := errors.New("rpc failed")
+
+	// Every chunk failing the same way is reported as that error.
+	err := runBatches(n, func(lo, hi int) error { return errors.New("rpc failed") })
+	if _, ok := err.(appengine.MultiError); ok || err == nil || err.Error() != errRPC.Error() {
+		t.Errorf("all chunks failing: got %v, want %v", err, errRPC)
+	}
+
+	// Otherwise the failures are reported per item.
+	err = runBatches(n, func(lo, hi int) error {
+		if lo == maxBatchSize {
+			return errRPC
+		}
+		return nil
+	})
+	me, ok := err.(appengine.MultiError)
+	if !ok || len(me) != n {
+		t.Fatalf("one chunk failing: got %v, want a MultiError of length %d", err, n)
+	}
+	for i, err := range me {
+		want := error(nil)
+		if i >= maxBatchSize && i < 2*maxBatchSize {
+			want = errRPC
+		}
+		if err != want {
+			t.Errorf("one chunk failing: item %d: got %v, want %v", i, err, want)
+		}
+	}
+
+	if err := runBatches(n, func(lo, hi int) error { return nil }); err != nil {
+		t.Errorf("no chunks failing: got %v", err)
+	}
+}
+
+// memContext is an appengine.Context whose datastore_v3 calls are served from
+// entities held in memory. Writes made in a transaction are applied at once,
+// and a query's results are returned in a single batch.
+type memContext struct {
+	appengine.Context
+
+	mu       sync.Mutex
+	entities map[string]*pb.EntityProto // keyed by Key.String
+	lastID   int64
+	calls    []memCall
+}
+
+// memCall records one call made to a memContext.
+type memCall struct {
+	method string
+	in     appengine_internal.ProtoMessage
+}
+
+func newMemContext() *memContext {
+	return &memContext{entities: make(map[string]*pb.EntityProto)}
+}
+
+func (c *memContext) FullyQualifiedAppID() string { return "dev~app" }
+
+// methods returns the names of the methods called so far, in order.
+func (c *memContext) methods() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var m []string
+	for _, call := range c.calls {
+		m = append(m, call.method)
+	}
+	return m
+}
+
+func (c *memContext) Call(service, method string, in, out appengine_internal.ProtoMessage, opts *appengine_internal.CallOptions) error {
+	if service != "datastore_v3" {
+		return fmt.Errorf("unexpected %s.%s call", service, method)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls = append(c.calls, memCall{method, proto.Clone(in)})
+	switch method {
+	case "Get":
+		req, res := in.(*pb.GetRequest), out.(*pb.GetResponse)
+		for _, r := range req.Key {
+			k, err := protoToKey(r)
+			if err != nil {
+				return err
+			}
+			e := &pb.GetResponse_Entity{}
+			if x, ok := c.entities[k.String()]; ok {
+				e.Entity = proto.Clone(x).(*pb.EntityProto)
+			}
+			res.Entity = append(res.Entity, e)
+		}
+	case "Put":
+		req, res := in.(*pb.PutRequest), out.(*pb.PutResponse)
+		for _, x := range req.Entity {
+			x = proto.Clone(x).(*pb.EntityProto)
+			elems := x.Key.Path.Element
+			if last := elems[len(elems)-1]; last.Id == nil && last.Name == nil {
+				c.lastID++
+				last.Id = proto.Int64(c.lastID)
+			}
+			k, err := protoToKey(x.Key)
+			if err != nil {
+				return err
+			}
+			c.entities[k.String()] = x
+			res.Key = append(res.Key, x.Key)
+		}
+	case "Delete":
+		for _, r := range in.(*pb.DeleteRequest).Key {
+			k, err := protoToKey(r)
+			if err != nil {
+				return err
+			}
+			delete(c.entities, k.String())
+		}
+	case "RunQuery":
+		return c.runQuery(in.(*pb.Query), out.(*pb.QueryResult))
+	case "BeginTransaction":
+		out.(*pb.Transaction).Handle = proto.Uint64(uint64(len(c.calls)))
+		out.(*pb.Transaction).App = proto.String(c.FullyQualifiedAppID())
+	case "Commit", "Rollback":
+	default:
+		return fmt.Errorf("unexpected %s.%s call", service, method)
+	}
+	return nil
+}
+
+// memResult is an entity that matches a query, with its key.
+type memResult struct {
+	k *Key
+	e *pb.EntityProto
+}
+
+func (c *memContext) runQuery(req *pb.Query, res *pb.QueryResult) error {
+	var results []memResult
+	for _, e := range c.entities {
+		k, err := protoToKey(e.Key)
+		if err != nil {
+			return err
+		}
+		if k.Kind() != req.GetKind() {
+			continue
+		}
+		match := true
+		for _, f := range req.Filter {
+			ok, err := memMatch(k, e, f)
+			if err != nil {
+				return err
+			}
+			match = match && ok
+		}
+		if match {
+			results = append(results, memResult{k, e})
+		}
+	}
+	sort.Sort(memResults{results, req.Order})
+
+	// Resume after the cursor's key.
+	if pos := req.GetCompiledCursor().GetPosition(); pos.GetKey() != nil {
+		k, err := protoToKey(pos.Key)
+		if err != nil {
+			return err
+		}
+		for i, r := range results {
+			if r.k.Equal(k) {
+				results = results[i+1:]
+				break
+			}
+		}
+	}
+	skipped := int(req.GetOffset())
+	if skipped > len(results) {
+		skipped = len(results)
+	}
+	results = results[skipped:]
+	if req.Limit != nil && len(results) > int(req.GetLimit()) {
+		results = results[:req.GetLimit()]
+	}
+
+	seen := make(map[string]bool)
+	for _, r := range results {
+		e := r.e
+		if req.GetKeysOnly() {
+			e = &pb.EntityProto{Key: e.Key}
+		} else if len(req.PropertyName) > 0 {
+			e = &pb.EntityProto{Key: e.Key}
+			for _, p := range r.e.Property {
+				for _, name := range req.PropertyName {
+					if p.GetName() == name {
+						e.Property = append(e.Property, p)
+					}
+				}
+			}
+		}
+		if len(req.GroupByPropertyName) > 0 {
+			var group []interface{}
+			for _, name := range req.GroupByPropertyName {
+				group = append(group, sortValue(e, name, false))
+			}
+			if id := fmt.Sprint(group); seen[id] {
+				continue
+			} else {
+				seen[id] = true
+			}
+		}
+		res.Result = append(res.Result, proto.Clone(e).(*pb.EntityProto))
+	}
+	res.SkippedResults = proto.Int32(int32(skipped))
+	res.MoreResults = proto.Bool(false)
+	res.Cursor = &pb.Cursor{Cursor: proto.Uint64(1)}
+	if req.GetCompile() {
+		res.CompiledCursor = req.CompiledCursor
+		if len(results) > 0 {
+			res.CompiledCursor = &pb.CompiledCursor{
+				Position: &pb.CompiledCursor_Position{
+					Key:            keyToProto("", results[len(results)-1].k),
+					StartInclusive: proto.Bool(false),
+				},
+			}
+		}
+	}
+	return nil
+}
+
+// memMatch returns whether the entity e, with key k, matches the filter f.
+// A multiple-valued property matches if any of its values does.
+func memMatch(k *Key, e *pb.EntityProto, f *pb.Query_Filter) (bool, error) {
+	fp := f.Property[0]
+	want, err := propValue(fp.Value, fp.GetMeaning())
+	if err != nil {
+		return false, err
+	}
+	var got []interface{}
+	if fp.GetName() == "__key__" {
+		got = append(got, k)
+	} else {
+		for _, p := range e.Property {
+			if p.GetName() != fp.GetName() {
+				continue
+			}
+			x, err := propValue(p.Value, p.GetMeaning())
+			if err != nil {
+				return false, err
+			}
+			got = append(got, x)
+		}
+	}
+	for _, x := range got {
+		if sortTypeRank(x) != sortTypeRank(want) {
+			continue
+		}
+		cmp := compareSortValues(x, want)
+		switch f.GetOp() {
+		case pb.Query_Filter_LESS_THAN:
+			if cmp < 0 {
+				return true, nil
+			}
+		case pb.Query_Filter_LESS_THAN_OR_EQUAL:
+			if cmp <= 0 {
+				return true, nil
+			}
+		case pb.Query_Filter_GREATER_THAN:
+			if cmp > 0 {
+				return true, nil
+			}
+		case pb.Query_Filter_GREATER_THAN_OR_EQUAL:
+			if cmp >= 0 {
+				return true, nil
+			}
+		case pb.Query_Filter_EQUAL:
+			if cmp == 0 {
+				return true, nil
+			}
+		default:
+			return false, fmt.Errorf("unexpected filter operator %v", f.GetOp())
+		}
+	}
+	return false, nil
+}
+
+// memResults sorts query results by the query's sort orders and then by key.
+type memResults struct {
+	r     []memResult
+	order []*pb.Query_Order
+}
+
+func (s memResults) Len() int      { return len(s.r) }
+func (s memResults) Swap(i, j int) { s.r[i], s.r[j] = s.r[j], s.r[i] }
+
+func (s memResults) Less(i, j int) bool {
+	a, b := s.r[i], s.r[j]
+	for _, o := range s.order {
+		desc := o.GetDirection() == pb.Query_Order_DESCENDING
+		var cmp int
+		if o.GetProperty() == "__key__" {
+			cmp = compareKeys(a.k, b.k)
+		} else {
+			cmp = compareSortValues(sortValue(a.e, o.GetProperty(), desc), sortValue(b.e, o.GetProperty(), desc))
+		}
+		if desc {
+			cmp = -cmp
+		}
+		if cmp != 0 {
+			return cmp < 0
+		}
+	}
+	return compareKeys(a.k, b.k) < 0
+}
+
+func TestGetMultiPropertyList(t *testing.T) {
+	c := newMemContext()
+	gopher := NewKey(c, "Gopher", "", 1, nil)
+	burrow := NewKey(c, "Burrow", "home", 0, nil)
+	missing := NewKey(c, "Gopher", "", 2, nil)
+	if _, err := Put(c, gopher, &PropertyList{{Name: "Name", Value: "George"}}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if _, err := Put(c, burrow, &PropertyList{{Name: "Depth", Value: int64(3)}}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	dst := []PropertyList{nil, nil, {{Name: "Stale", Value: true}}}
+	err := GetMulti(c, []*Key{gopher, burrow, missing}, dst)
+	me, ok := err.(appengine.MultiError)
+	if !ok {
+		t.Fatalf("GetMulti: got %v, want a MultiError", err)
+	}
+	if me[0] != nil || me[1] != nil || me[2] != ErrNoSuchEntity {
+		t.Errorf("got errors %v, want nil, nil and ErrNoSuchEntity", me)
+	}
+	want := []PropertyList{
+		{{Name: "Name", Value: "George"}},
+		{{Name: "Depth", Value: int64(3)}},
+		nil,
+	}
+	if !reflect.DeepEqual(dst, want) {
+		t.Errorf("got %v, want %v", dst, want)
+	}
+	if m := c.methods(); len(m) != 3 || m[2] != "Get" {
+		t.Errorf("got calls %v, want both kinds fetched in a single Get", m)
+	}
+}
+
+func TestExists(t *testing.T) {
+	c := newMemContext()
+	const n = maxBatchSize + 2
+	keys := make([]*Key, n)
+	for i := range keys {
+		keys[i] = NewKey(c, "Gopher", "", int64(i+1), nil)
+	}
+	for _, i := range []int{0, maxBatchSize - 1, maxBatchSize + 1} {
+		if _, err := Put(c, keys[i], &PropertyList{{Name: "N", Value: int64(i)}}); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	c.calls = nil
+
+	got, err := Exists(c, keys)
+	if err != nil {
+		t.Fatalf("Exists: %v", err)
+	}
+	if len(got) != n {
+		t.Fatalf("got %d results, want %d", len(got), n)
+	}
+	for i, ok := range got {
+		want := i == 0 || i == maxBatchSize-1 || i == maxBatchSize+1
+		if ok != want {
+			t.Errorf("key %d: got %v, want %v", i, ok, want)
+		}
+	}
+	if m := c.methods(); !reflect.DeepEqual(m, []string{"Get", "Get"}) {
+		t.Errorf("got calls %v, want two Gets", m)
+	}
+
+	tests := []struct {
+		desc    string
+		keys    []*Key
+		want    []bool
+		wantErr bool
+	}{
+		{"no keys", nil, nil, false},
+		{"missing key", []*Key{NewKey(c, "Gopher", "", 1000, nil)}, []bool{false}, false},
+		{"nil key", []*Key{nil}, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := Exists(c, tt.keys)
+		if (err != nil) != tt.wantErr || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, %v, want %v and error = %v", tt.desc, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestPutIncomplete(t *testing.T) {
+	type Gopher struct {
+		Name string
+	}
+	c := newMemContext()
+	parent := NewKey(c, "Burrow", "home", 0, nil)
+
+	tests := []struct {
+		desc    string
+		kind    string
+		parent  *Key
+		wantErr bool
+	}{
+		{desc: "root entity", kind: "Gopher"},
+		{desc: "child entity", kind: "Gopher", parent: parent},
+		{desc: "empty kind", kind: "", wantErr: true},
+		{desc: "incomplete parent", kind: "Gopher", parent: NewIncompleteKey(c, "Burrow", nil), wantErr: true},
+	}
+	for _, tt := range tests {
+		src := &Gopher{Name: tt.desc}
+		k, err := PutIncomplete(c, tt.kind, tt.parent, src)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: got key %v, want an error", tt.desc, k)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.desc, err)
+			continue
+		}
+		if k.Incomplete() || k.Kind() != tt.kind || !k.Parent().Equal(tt.parent) {
+			t.Errorf("%s: got key %v, want a complete %s key with parent %v", tt.desc, k, tt.kind, tt.parent)
+		}
+		var dst Gopher
+		if err := Get(c, k, &dst); err != nil || dst != *src {
+			t.Errorf("%s: Get = %+v, %v, want %+v", tt.desc, dst, err, *src)
+		}
+	}
+
+	// The key is allocated and the entity written in a transaction.
+	c.calls = nil
+	if _, err := PutIncomplete(c, "Gopher", nil, &Gopher{}); err != nil {
+		t.Fatalf("PutIncomplete: %v", err)
+	}
+	if m := c.methods(); !reflect.DeepEqual(m, []string{"BeginTransaction", "Put", "Commit"}) {
+		t.Fatalf("got calls %v, want a Put in a transaction", m)
+	}
+	if put := c.calls[1].in.(*pb.PutRequest); put.Transaction == nil {
+		t.Error("the Put is not part of the transaction")
+	}
+
+	// Within a transaction, the entity is put in that transaction.
+	c.calls = nil
+	err := RunInTransaction(c, func(tc appengine.Context) error {
+		_, err := PutIncomplete(tc, "Gopher", nil, &Gopher{})
+		return err
+	}, nil)
+	if err != nil {
+		t.Fatalf("RunInTransaction: %v", err)
+	}
+	if m := c.methods(); !reflect.DeepEqual(m, []string{"BeginTransaction", "Put", "Commit"}) {
+		t.Errorf("in a transaction: got calls %v, want a single transaction", m)
+	}
+}
+
+func TestGetAfterPut(t *testing.T) {
+	type Gopher struct {
+		Name string
+		Age  int
+	}
+	c := newMemContext()
+	k := NewKey(c, "Gopher", "g", 0, nil)
+	for _, src := range []Gopher{{"George", 1}, {"George", 2}} {
+		if _, err := Put(c, k, &src); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+		var dst Gopher
+		if err := Get(c, k, &dst); err != nil || dst != src {
+			t.Errorf("Get after Put = %+v, %v, want %+v", dst, err, src)
+		}
+		dsts := make([]Gopher, 1)
+		if err := GetMulti(c, []*Key{k}, dsts); err != nil || dsts[0] != src {
+			t.Errorf("GetMulti after Put = %+v, %v, want %+v", dsts[0], err, src)
+		}
+	}
+
+	// Neither Get nor GetMulti asks for an eventually consistent read.
+	for _, call := range c.calls {
+		if req, ok := call.in.(*pb.GetRequest); ok {
+			if req.Strong != nil || req.FailoverMs != nil {
+				t.Errorf("Get request with strong = %v and failover_ms = %v, want neither set", req.Strong, req.FailoverMs)
+			}
+		}
+	}
+}
@@ -32,8 +32,17 @@ Valid value types are:
   - appengine.BlobKey,
   - appengine.GeoPoint,
   - structs whose fields are all valid value types,
+  - pointers to such structs,
   - slices of any of the above.
 
+The elements of a slice are saved, one property per element, and loaded back
+in order. A nil or empty slice is therefore saved as no properties at all,
+and loading it leaves the field as it was, which is nil in a zero struct. The
+exception is an empty, non-nil []string field named, say, "Tags", which is
+saved as a single unindexed bool property named "Tags.__empty__", so that it
+loads back as an empty slice rather than nil. Other readers of the entity,
+such as a PropertyList, see that property as it is stored.
+
 Slices of structs are valid, as are structs that contain slices. However, if
 one struct contains another, then at most one of those can be repeated. This
 disqualifies recursively defined struct types: any struct T that (directly or
@@ -92,8 +101,12 @@ get that same entity as a *myStruct, or put a *myStruct0 and get a *myStruct1.
 Conceptually, any entity is saved as a sequence of properties, and is loaded
 into the destination value on a property-by-property basis. When loading into
 a struct pointer, an entity that cannot be completely represented (such as a
-missing field) will result in an ErrFieldMismatch error but it is up to the
+missing field) will result in an ErrFieldMismatch error, whose Mismatches
+method lists every such field if there are several, but it is up to the
 caller whether this error is fatal, recoverable or ignorable.
+A struct type that implements UnknownFieldsIgnorer can instead have properties
+with no matching field skipped, which eases removing a field from a struct
+whose entities are already stored.
 
 By default, for struct pointers, all properties are potentially indexed, and
 the property name is the same as the field name (and hence must start with an
@@ -102,8 +115,19 @@ name is the property name, which must be one or more valid Go identifiers
 joined by ".", but may start with a lower case letter. An empty tag name means
 to just use the field name. A "-" tag name means that the datastore will
 ignore that field. If options is "noindex" then the field will not be indexed.
-If the options is "" then the comma may be omitted. There are no other
-recognized options.
+If options is "asstring" then the field, which must be of a signed integer type
+with a String method, is saved as the string that String returns; RegisterEnum
+registers the function that parses it back when loading. If options is
+"lower" then the field, which must be a string or a slice of strings, is also
+saved as a second property named with a "_lower" suffix, such as "Name_lower",
+that holds the lowercased value, so that it can be queried case-insensitively
+by filtering on the lowercased search term. The shadow property is indexed
+unless the field is "noindex", so it doubles the field's index cost, and it is
+ignored when loading. Other options may be registered with RegisterFieldCodec
+to transform a string or []byte field's stored bytes, for example to encrypt
+it; such a field is never indexed. Options may be combined, as in
+"noindex,asstring". If the options is "" then the comma may be omitted.
+Unrecognized options are ignored.
 
 Fields (except for []byte) are indexed by default. Strings longer than 500
 characters cannot be indexed; fields used to store long strings should be
@@ -169,6 +193,11 @@ equivalent field would instead be: FooDotZ bool `datastore:"Foo.Z"`.
 If an outer struct is tagged "noindex" then all of its implicit flattened
 fields are effectively "noindex".
 
+A pointer to a struct is flattened in the same way, and can be used for an
+optional nested struct. A nil pointer is saved as no properties at all. When
+loading, the pointed-to struct is only allocated if the entity has at least
+one of its properties, so the pointer otherwise stays nil.
+
 
 The PropertyLoadSaver Interface
 
@@ -221,6 +250,65 @@ The *PropertyList type implements PropertyLoadSaver, and can therefore hold an
 arbitrary entity's contents.
 
 
+The PropertyConverter Interface
+
+A struct field's type can customize how that one field is stored by
+implementing the PropertyConverter interface, which converts it to and from a
+single Property. This is simpler than implementing PropertyLoadSaver for the
+whole struct when only a field's encoding differs, such as an enum stored by
+name.
+
+Example code:
+
+	type Suit int
+
+	var suitNames = []string{"clubs", "diamonds", "hearts", "spades"}
+
+	func (s Suit) ToProperty() (datastore.Property, error) {
+		return datastore.Property{Value: suitNames[s]}, nil
+	}
+
+	func (s *Suit) FromProperty(p datastore.Property) error {
+		name, _ := p.Value.(string)
+		for i, n := range suitNames {
+			if n == name {
+				*s = Suit(i)
+				return nil
+			}
+		}
+		return fmt.Errorf("unknown suit %q", name)
+	}
+
+	type Card struct {
+		Suit Suit // stored as a string, such as "hearts"
+		Rank int
+	}
+
+A type from another package, such as *big.Rat, cannot implement
+PropertyConverter, but RegisterConverter can register a pair of functions
+that convert it instead:
+
+	func init() {
+		datastore.RegisterConverter(reflect.TypeOf((*big.Rat)(nil)),
+			func(v interface{}) (interface{}, error) {
+				return v.(*big.Rat).RatString(), nil
+			},
+			func(x interface{}) (interface{}, error) {
+				s, _ := x.(string)
+				r, ok := new(big.Rat).SetString(s)
+				if !ok {
+					return nil, fmt.Errorf("bad rational %q", s)
+				}
+				return r, nil
+			})
+	}
+
+The encoding chosen by a converter determines how the property is indexed:
+strings order lexicographically rather than numerically, so an exact amount
+that is filtered or sorted on is better stored as an int64 in fixed units,
+such as cents.
+
+
 Queries
 
 Queries retrieve entities based on their properties or key's ancestry. Running
@@ -228,15 +316,29 @@ a query yields an iterator of results: either keys or (key, entity) pairs.
 Queries are re-usable and it is safe to call Query.Run from concurrent
 goroutines. Iterators are not safe for concurrent use.
 
+Unlike Get, which always returns the latest version of an entity, a query
+without an ancestor filter is eventually consistent: an entity that was just
+put, even earlier in the same request, may be missing from its results or
+returned with stale property values for a short while. An ancestor query is
+strongly consistent unless EventualConsistency is used. To read back an entity
+that was just put, Get it by the key that Put returned.
+
 Queries are immutable, and are either created by calling NewQuery, or derived
 from an existing query by calling a method like Filter or Order that returns a
 new query value. A query is typically constructed by calling NewQuery followed
 by a chain of zero or more such methods. These methods are:
   - Ancestor and Filter constrain the entities returned by running a query.
+    FilterIn matches any of several values, at the cost of one query per value.
+    FilterInMemory filters the results in memory, needing no index.
+    MergeJoin asks for several equality filters to be merge-joined.
   - Order affects the order in which they are returned.
   - Project constrains the fields returned.
-  - Distinct de-duplicates projected entities.
+  - Distinct de-duplicates projected entities, and DistinctOn de-duplicates
+    them with respect to a subset of the projected fields.
   - KeysOnly makes the iterator return only keys, not (key, entity) pairs.
+  - IgnoreFields skips loading some of each entity's fields.
+  - Prefetch fetches each batch of results in the background, starting once
+    the last result of the previous batch has been returned.
   - Start, End, Offset and Limit define which sub-sequence of matching entities
     to return. Start and End take cursors, Offset and Limit take integers. Start
     and Offset affect the first result, End and Limit affect the last result.
@@ -245,6 +347,15 @@ by a chain of zero or more such methods. These methods are:
     relative to Start+Offset, not relative to End. As a special case, a
     negative limit means unlimited.
 
+All of a query's filters are sent to the datastore as a single query. Several
+equality filters on different properties, with no inequality filter or sort
+order, need no composite index: the datastore merge-joins the built-in
+single-property indexes. Calling MergeJoin on such a query asks the datastore
+to plan it that way, and makes running it fail unless it has equality filters
+on at least two properties. Adding an inequality filter or a sort order to such
+a query requires a composite index covering all of the filtered and sorted
+properties, declared in index.yaml.
+
 Example code:
 
 	type Widget struct {
@@ -246,6 +246,37 @@ func NewIncompleteKey(c appengine.Context, kind string, parent *Key) *Key {
 	return NewKey(c, kind, "", 0, parent)
 }
 
+// NewNameKey creates a new key with the given string ID, which cannot be
+// empty. It is like NewKey, except that it returns ErrInvalidKey instead of a
+// key that the datastore would reject or treat as incomplete.
+func NewNameKey(c appengine.Context, kind, stringID string, parent *Key) (*Key, error) {
+	if stringID == "" {
+		return nil, ErrInvalidKey
+	}
+	return newCompleteKey(c, kind, stringID, 0, parent)
+}
+
+// NewIDKey creates a new key with the given integer ID, which cannot be zero.
+// It is like NewKey, except that it returns ErrInvalidKey instead of a key
+// that the datastore would reject or treat as incomplete.
+func NewIDKey(c appengine.Context, kind string, intID int64, parent *Key) (*Key, error) {
+	if intID == 0 {
+		return nil, ErrInvalidKey
+	}
+	return newCompleteKey(c, kind, "", intID, parent)
+}
+
+func newCompleteKey(c appengine.Context, kind, stringID string, intID int64, parent *Key) (*Key, error) {
+	if parent != nil && !parent.valid() {
+		return nil, ErrInvalidKey
+	}
+	k := NewKey(c, kind, stringID, intID, parent)
+	if !k.valid() {
+		return nil, ErrInvalidKey
+	}
+	return k, nil
+}
+
 // NewKey creates a new key.
 // kind cannot be empty.
 // Either one or both of stringID and intID must be zero. If both are zero,
@@ -0,0 +1,61 @@
+// Copyright 2015 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package datastore
+
+import (
+	"testing"
+)
+
+func TestNewNameAndIDKey(t *testing.T) {
+	c := newMemContext()
+	parent := NewKey(c, "Parent", "p", 0, nil)
+	incomplete := NewIncompleteKey(c, "Parent", nil)
+
+	tests := []struct {
+		desc     string
+		byName   bool // whether to call NewNameKey rather than NewIDKey
+		kind     string
+		stringID string
+		intID    int64
+		parent   *Key
+		ok       bool
+	}{
+		{desc: "name", byName: true, kind: "Gopher", stringID: "george", ok: true},
+		{desc: "name with parent", byName: true, kind: "Gopher", stringID: "george", parent: parent, ok: true},
+		{desc: "empty name", byName: true, kind: "Gopher"},
+		{desc: "name with no kind", byName: true, stringID: "george"},
+		{desc: "name with incomplete parent", byName: true, kind: "Gopher", stringID: "george", parent: incomplete},
+		{desc: "ID", kind: "Gopher", intID: 7, ok: true},
+		{desc: "negative ID", kind: "Gopher", intID: -7, ok: true},
+		{desc: "ID with parent", kind: "Gopher", intID: 7, parent: parent, ok: true},
+		{desc: "zero ID", kind: "Gopher", intID: 0},
+		{desc: "ID with no kind", intID: 7},
+		{desc: "ID with incomplete parent", kind: "Gopher", intID: 7, parent: incomplete},
+	}
+	for _, tt := range tests {
+		var (
+			k   *Key
+			err error
+		)
+		if tt.byName {
+			k, err = NewNameKey(c, tt.kind, tt.stringID, tt.parent)
+		} else {
+			k, err = NewIDKey(c, tt.kind, tt.intID, tt.parent)
+		}
+		if !tt.ok {
+			if err != ErrInvalidKey || k != nil {
+				t.Errorf("%s: got %v, %v, want ErrInvalidKey", tt.desc, k, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.desc, err)
+			continue
+		}
+		if want := NewKey(c, tt.kind, tt.stringID, tt.intID, tt.parent); !k.Equal(want) || k.Incomplete() {
+			t.Errorf("%s: got %v, want the complete key %v", tt.desc, k, want)
+		}
+	}
+}
@@ -19,7 +19,10 @@ var (
 	typeOfByteSlice  = reflect.TypeOf([]byte(nil))
 	typeOfByteString = reflect.TypeOf(ByteString(nil))
 	typeOfGeoPoint   = reflect.TypeOf(appengine.GeoPoint{})
+	typeOfKey        = reflect.TypeOf(Key{})
 	typeOfTime       = reflect.TypeOf(time.Time{})
+
+	typeOfPropertyConverter = reflect.TypeOf((*PropertyConverter)(nil)).Elem()
 )
 
 // typeMismatchReason returns a string explaining why the property p could not
@@ -57,23 +60,58 @@ type propertyLoader struct {
 	m map[string]int
 }
 
-func (l *propertyLoader) load(codec *structCodec, structValue reflect.Value, p Property, requireSlice bool) string {
-	var v reflect.Value
+// noSuchStructField is the reason load gives for a property that has no
+// matching struct field.
+const noSuchStructField = "no such struct field"
+
+// hasField returns whether name, a property name relative to the struct
+// that codec describes, names a field that a property can be loaded into.
+func hasField(codec *structCodec, name string) bool {
+	for {
+		decoder, ok := codec.byName[name]
+		if !ok || decoder.shadow {
+			return false
+		}
+		if decoder.substructCodec == nil {
+			return true
+		}
+		name = name[len(codec.byIndex[decoder.index].name):]
+		codec = decoder.substructCodec
+	}
+}
+
+func (l *propertyLoader) load(codec *structCodec, structValue reflect.Value, p Property, requireSlice bool) (errStr string) {
+	var (
+		v         reflect.Value
+		asString  bool
+		transform *valueCodec
+	)
 	// Traverse a struct's struct-typed fields.
 	for name := p.Name; ; {
 		decoder, ok := codec.byName[name]
 		if !ok {
-			return "no such struct field"
+			return noSuchStructField
+		}
+		if decoder.shadow {
+			return ""
 		}
 		v = structValue.Field(decoder.index)
 		if !v.IsValid() {
-			return "no such struct field"
+			return noSuchStructField
 		}
 		if !v.CanSet() {
 			return "cannot set struct field"
 		}
+		if decoder.emptySlice {
+			if v.IsNil() {
+				v.Set(reflect.MakeSlice(v.Type(), 0, 0))
+			}
+			return ""
+		}
 
 		if decoder.substructCodec == nil {
+			asString = codec.byIndex[decoder.index].asString
+			transform = codec.byIndex[decoder.index].transform
 			break
 		}
 
@@ -88,6 +126,25 @@ func (l *propertyLoader) load(codec *structCodec, structValue reflect.Value, p P
 			}
 			structValue = v.Index(index)
 			requireSlice = false
+		} else if v.Kind() == reflect.Ptr {
+			// Allocate an optional nested struct on the first property
+			// that is loaded into one of its fields. Until then, the
+			// property is loaded into a struct that is only stored in the
+			// field if that succeeds, so that the field stays nil if the
+			// property names no field of it or cannot be loaded.
+			if !v.IsNil() {
+				structValue = v.Elem()
+			} else {
+				ptr, nv := v, reflect.New(v.Type().Elem())
+				if hasField(decoder.substructCodec, name[len(codec.byIndex[decoder.index].name):]) {
+					defer func() {
+						if errStr == "" {
+							ptr.Set(nv)
+						}
+					}()
+				}
+				structValue = nv.Elem()
+			}
 		} else {
 			structValue = v
 		}
@@ -97,13 +154,17 @@ func (l *propertyLoader) load(codec *structCodec, structValue reflect.Value, p P
 	}
 
 	var slice reflect.Value
-	if v.Kind() == reflect.Slice && v.Type().Elem().Kind() != reflect.Uint8 {
+	if _, ok := propertyConverter(v); !ok && v.Kind() == reflect.Slice && v.Type().Elem().Kind() != reflect.Uint8 {
 		slice = v
 		v = reflect.New(v.Type().Elem()).Elem()
 	} else if requireSlice {
 		return "multiple-valued property requires a slice field type"
 	}
 
+	if transform != nil {
+		return loadTransformed(v, p.Value, transform)
+	}
+
 	// Convert indexValues to a Go value with a meaning derived from the
 	// destination type.
 	pValue := p.Value
@@ -128,6 +189,30 @@ func (l *propertyLoader) load(codec *structCodec, structValue reflect.Value, p P
 		}
 	}
 
+	if asString {
+		if errStr := loadEnum(v, pValue); errStr != "" {
+			return errStr
+		}
+		if slice.IsValid() {
+			slice.Set(reflect.Append(slice, v))
+		}
+		return ""
+	}
+
+	if isNilConverterPtr(v) {
+		v.Set(reflect.New(v.Type().Elem()))
+	}
+	if pc, ok := propertyConverter(v); ok {
+		p.Value = pValue
+		if err := pc.FromProperty(p); err != nil {
+			return err.Error()
+		}
+		if slice.IsValid() {
+			slice.Set(reflect.Append(slice, v))
+		}
+		return ""
+	}
+
 	switch v.Kind() {
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
 		x, ok := pValue.(int64)
@@ -215,6 +300,52 @@ func (l *propertyLoader) load(codec *structCodec, structValue reflect.Value, p P
 	return ""
 }
 
+// loadTransformed sets the field v of a struct field with a RegisterFieldCodec
+// option from the stored bytes pValue, returning a non-empty reason on error.
+func loadTransformed(v reflect.Value, pValue interface{}, vc *valueCodec) string {
+	b, ok := pValue.([]byte)
+	if !ok && pValue != nil {
+		return fmt.Sprintf("type mismatch: %T versus []byte", pValue)
+	}
+	x, err := vc.decode(b)
+	if err != nil {
+		return err.Error()
+	}
+	if v.Kind() == reflect.String {
+		v.SetString(string(x))
+	} else {
+		v.SetBytes(x)
+	}
+	return ""
+}
+
+// loadEnum sets the field v of an "asstring" struct field from the string
+// pValue, using the parser registered for v's type. The returned error string
+// is empty on success.
+func loadEnum(v reflect.Value, pValue interface{}) string {
+	if pValue == nil {
+		v.SetInt(0)
+		return ""
+	}
+	s, ok := pValue.(string)
+	if !ok {
+		return fmt.Sprintf("type mismatch: asstring field of type %v needs a string", v.Type())
+	}
+	parse := enumParser(v.Type())
+	if parse == nil {
+		return fmt.Sprintf("no parser registered for %v; see RegisterEnum", v.Type())
+	}
+	x, err := parse(s)
+	if err != nil {
+		return fmt.Sprintf("cannot parse %q as %v: %v", s, v.Type(), err)
+	}
+	if v.OverflowInt(x) {
+		return fmt.Sprintf("value %v overflows struct field of type %v", x, v.Type())
+	}
+	v.SetInt(x)
+	return ""
+}
+
 // loadEntity loads an EntityProto into PropertyLoadSaver or struct pointer.
 func loadEntity(dst interface{}, src *pb.EntityProto) (err error) {
 	c := make(chan Property, 32)
@@ -232,24 +363,33 @@ func loadEntity(dst interface{}, src *pb.EntityProto) (err error) {
 }
 
 func (s structPLS) Load(c <-chan Property) error {
-	var fieldName, reason string
+	var mismatches []*ErrFieldMismatch
 	var l propertyLoader
+	ignoreUnknown := false
+	if u, ok := s.v.Addr().Interface().(UnknownFieldsIgnorer); ok {
+		ignoreUnknown = u.IgnoreUnknownFields()
+	}
 	for p := range c {
 		if errStr := l.load(s.codec, s.v, p, p.Multiple); errStr != "" {
+			if errStr == noSuchStructField && ignoreUnknown {
+				continue
+			}
 			// We don't return early, as we try to load as many properties as possible.
 			// It is valid to load an entity into a struct that cannot fully represent it.
 			// That case returns an error, but the caller is free to ignore it.
-			fieldName, reason = p.Name, errStr
+			mismatches = append(mismatches, &ErrFieldMismatch{
+				StructType: s.v.Type(),
+				FieldName:  p.Name,
+				Reason:     errStr,
+			})
 		}
 	}
-	if reason != "" {
-		return &ErrFieldMismatch{
-			StructType: s.v.Type(),
-			FieldName:  fieldName,
-			Reason:     reason,
-		}
+	if len(mismatches) == 0 {
+		return nil
 	}
-	return nil
+	first := mismatches[0]
+	first.others = mismatches[1:]
+	return first
 }
 
 func protoToProperties(dst chan<- Property, errc chan<- error, src *pb.EntityProto) {
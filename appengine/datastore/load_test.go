@@ -0,0 +1,176 @@
+// Copyright 2015 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package datastore
+
+import (
+	"testing"
+)
+
+// loadProps loads props into dst with LoadStruct.
+func loadProps(dst interface{}, props ...Property) error {
+	c := make(chan Property, len(props))
+	for _, p := range props {
+		c <- p
+	}
+	close(c)
+	return LoadStruct(dst, c)
+}
+
+func TestLoadFieldMismatches(t *testing.T) {
+	var dst struct {
+		A int64
+	}
+	err := loadProps(&dst,
+		Property{Name: "X", Value: int64(1)},
+		Property{Name: "A", Value: int64(2)},
+		Property{Name: "Y", Value: "y"},
+	)
+	// The error must still be an *ErrFieldMismatch, for the first mismatch.
+	fm, ok := err.(*ErrFieldMismatch)
+	if !ok {
+		t.Fatalf("got %T %v, want *ErrFieldMismatch", err, err)
+	}
+	if fm.FieldName != "X" {
+		t.Errorf("FieldName = %q, want %q", fm.FieldName, "X")
+	}
+	if dst.A != 2 {
+		t.Errorf("A = %d, want 2", dst.A)
+	}
+	var names []string
+	for _, m := range fm.Mismatches() {
+		names = append(names, m.FieldName)
+	}
+	if len(names) != 2 || names[0] != "X" || names[1] != "Y" {
+		t.Errorf("Mismatches fields = %q, want [X Y]", names)
+	}
+	if want := `datastore: cannot load field "X" into a "struct { A int64 }": no such struct field (and 1 more)`; err.Error() != want {
+		t.Errorf("Error() = %q, want %q", err.Error(), want)
+	}
+
+	err = loadProps(&dst, Property{Name: "X", Value: int64(1)})
+	if fm, ok := err.(*ErrFieldMismatch); !ok || len(fm.Mismatches()) != 1 {
+		t.Errorf("one mismatch: got %v, want a single *ErrFieldMismatch", err)
+	}
+}
+
+func TestLoadNilNestedStructPtr(t *testing.T) {
+	type Inner struct {
+		X int64
+	}
+	var dst struct {
+		I *Inner
+	}
+	err := loadProps(&dst, Property{Name: "I.Unknown", Value: int64(1)})
+	if _, ok := err.(*ErrFieldMismatch); !ok {
+		t.Errorf("got %v, want an *ErrFieldMismatch", err)
+	}
+	if dst.I != nil {
+		t.Errorf("I = %+v after an unknown subfield, want nil", dst.I)
+	}
+
+	err = loadProps(&dst, Property{Name: "I.X", Value: "not an int"})
+	if _, ok := err.(*ErrFieldMismatch); !ok {
+		t.Errorf("got %v, want an *ErrFieldMismatch", err)
+	}
+	if dst.I != nil {
+		t.Errorf("I = %+v after a mismatched subfield, want nil", dst.I)
+	}
+
+	if err := loadProps(&dst, Property{Name: "I.X", Value: int64(7)}); err != nil {
+		t.Fatalf("LoadStruct: %v", err)
+	}
+	if dst.I == nil || dst.I.X != 7 {
+		t.Errorf("I = %+v, want &{X:7}", dst.I)
+	}
+}
+
+// lenient ignores unknown properties when Ignore is set.
+type lenient struct {
+	A      int64
+	Ignore bool `datastore:"-"`
+}
+
+func (l *lenient) IgnoreUnknownFields() bool { return l.Ignore }
+
+func TestUnknownFieldsIgnorer(t *testing.T) {
+	props := []Property{
+		{Name: "X", Value: int64(1)},
+		{Name: "A", Value: int64(2)},
+	}
+	dst := &lenient{Ignore: true}
+	if err := loadProps(dst, props...); err != nil {
+		t.Errorf("ignoring unknown fields: got %v, want nil", err)
+	}
+	if dst.A != 2 {
+		t.Errorf("A = %d, want 2", dst.A)
+	}
+
+	// Only missing fields are ignored; a type mismatch is still reported.
+	err := loadProps(dst, Property{Name: "A", Value: "not an int"})
+	if fm, ok := err.(*ErrFieldMismatch); !ok || fm.FieldName != "A" {
+		t.Errorf("mismatched A: got %v, want an *ErrFieldMismatch for A", err)
+	}
+
+	dst = &lenient{Ignore: false}
+	err = loadProps(dst, props...)
+	if fm, ok := err.(*ErrFieldMismatch); !ok || fm.FieldName != "X" {
+		t.Errorf("not ignoring unknown fields: got %v, want an *ErrFieldMismatch for X", err)
+	}
+	if dst.A != 2 {
+		t.Errorf("A = %d, want 2", dst.A)
+	}
+}
+
+// blobEntity is an entity with a large blob that a listing never needs.
+type blobEntity struct {
+	Title string
+	Tags  []string
+	Blob  []byte
+}
+
+func newBlobEntity() *blobEntity {
+	return &blobEntity{
+		Title: "title",
+		Tags:  []string{"a", "b", "c"},
+		Blob:  make([]byte, 1<<20),
+	}
+}
+
+func TestIgnoreFields(t *testing.T) {
+	e, err := saveEntity("dev~app", NewKey(newMemContext(), "Blob", "b", 0, nil), newBlobEntity())
+	if err != nil {
+		t.Fatalf("saveEntity: %v", err)
+	}
+	dst := &blobEntity{Blob: []byte("unchanged")}
+	if err := NewQuery("Blob").IgnoreFields("Blob").loadEntity(dst, e); err != nil {
+		t.Fatalf("loadEntity: %v", err)
+	}
+	if dst.Title != "title" || len(dst.Tags) != 3 || string(dst.Blob) != "unchanged" {
+		t.Errorf("got %q, %q, %d-byte blob; want the blob left unchanged", dst.Title, dst.Tags, len(dst.Blob))
+	}
+}
+
+// benchmarkLoadBlob loads a blobEntity from its 1MB proto, with or without
+// ignoring the blob.
+func benchmarkLoadBlob(b *testing.B, ignore bool) {
+	q := NewQuery("Blob")
+	if ignore {
+		q = q.IgnoreFields("Blob")
+	}
+	e, err := saveEntity("dev~app", NewKey(newMemContext(), "Blob", "b", 0, nil), newBlobEntity())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := q.loadEntity(&blobEntity{}, e); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkLoadBlob(b *testing.B)       { benchmarkLoadBlob(b, false) }
+func BenchmarkLoadIgnoreBlob(b *testing.B) { benchmarkLoadBlob(b, true) }
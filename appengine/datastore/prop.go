@@ -12,8 +12,11 @@ import (
 	"unicode"
 )
 
-// Entities with more than this many indexed properties will not be saved.
-const maxIndexedProperties = 5000
+// MaxIndexedProperties is the largest number of indexed property values that
+// an entity may have to be saved. Each value of a multi-valued property counts
+// separately. Put returns an error, without calling the datastore service, for
+// an entity with more.
+const MaxIndexedProperties = 5000
 
 // []byte fields more than 1 megabyte long will not be loaded or saved.
 const maxBlobLen = 1 << 20
@@ -74,6 +77,224 @@ type PropertyLoadSaver interface {
 	Save(chan<- Property) error
 }
 
+// UnknownFieldsIgnorer can be implemented by a struct type to control how
+// loading an entity into it treats a stored property with no matching struct
+// field, such as one whose field has since been removed. If
+// IgnoreUnknownFields returns true, such properties are skipped; otherwise,
+// as for a struct that does not implement UnknownFieldsIgnorer, they cause
+// an ErrFieldMismatch. Other mismatches, such as a property whose type does
+// not match its field's, are reported either way.
+type UnknownFieldsIgnorer interface {
+	IgnoreUnknownFields() bool
+}
+
+// PropertyConverter can be implemented by the type of a struct field to
+// convert the field to and from a single Property, instead of the default
+// encoding for its kind. The Name, NoIndex and Multiple fields of the
+// Property are derived from the struct field and its tag; ToProperty only
+// needs to set Value, and may set NoIndex to prevent indexing.
+// FromProperty must be implemented with a pointer receiver, as it modifies
+// the field.
+//
+// A field may also be of type *T, where *T implements PropertyConverter. A nil
+// such field is saved as a property with a nil Value, and a nil field is set
+// to a new T before FromProperty is called on load.
+type PropertyConverter interface {
+	ToProperty() (Property, error)
+	FromProperty(Property) error
+}
+
+// propertyConverter returns v as a PropertyConverter, if its type has a
+// converter registered by RegisterConverter, or if its type or, when v is
+// addressable, its pointer type implements PropertyConverter.
+func propertyConverter(v reflect.Value) (PropertyConverter, bool) {
+	if conv := registeredConverter(v.Type()); conv != nil {
+		return fieldConverter{v, conv}, true
+	}
+	if v.Type().Implements(typeOfPropertyConverter) {
+		// Such as a field of type *T, where *T implements PropertyConverter.
+		return v.Interface().(PropertyConverter), true
+	}
+	if v.CanAddr() {
+		v = v.Addr()
+	}
+	pc, ok := v.Interface().(PropertyConverter)
+	return pc, ok
+}
+
+// isNilConverterPtr returns whether v is a nil pointer of a type that
+// implements PropertyConverter.
+func isNilConverterPtr(v reflect.Value) bool {
+	return v.Kind() == reflect.Ptr && v.IsNil() && v.Type().Implements(typeOfPropertyConverter)
+}
+
+// isNestedStructPtr returns whether t is a pointer to a struct type whose
+// fields are flattened into properties, as for a nested struct field.
+func isNestedStructPtr(t reflect.Type) bool {
+	if t.Kind() != reflect.Ptr {
+		return false
+	}
+	e := t.Elem()
+	if e.Kind() != reflect.Struct || e == typeOfKey || e == typeOfTime || e == typeOfGeoPoint {
+		return false
+	}
+	return !t.Implements(typeOfPropertyConverter) && registeredConverter(t) == nil && registeredConverter(e) == nil
+}
+
+// valueCodec is a pair of functions registered by RegisterFieldCodec.
+type valueCodec struct {
+	encode, decode func([]byte) ([]byte, error)
+}
+
+var (
+	valueCodecsMu sync.RWMutex
+	valueCodecs   = make(map[string]*valueCodec)
+)
+
+// RegisterFieldCodec registers functions that transform the stored value of
+// struct fields tagged with the given option, such as "crypt" in
+// `datastore:"ssn,crypt"`, for example to encrypt it at rest. Such a field
+// must be a string or a []byte. When saving, encode is passed the field's
+// bytes and its result is stored as a []byte property that is never indexed,
+// since the transformed bytes cannot usefully be sorted or filtered on.
+// When loading, decode is passed the stored bytes and its result is set in
+// the field.
+//
+// RegisterFieldCodec must be called, typically from an init function, before
+// any struct with such a field is saved or loaded. It panics if option is
+// empty or is one of the options the package defines itself.
+func RegisterFieldCodec(option string, encode, decode func([]byte) ([]byte, error)) {
+	switch option {
+	case "", "noindex", "asstring", "lower":
+		panic(fmt.Sprintf("datastore: RegisterFieldCodec of reserved option %q", option))
+	}
+	valueCodecsMu.Lock()
+	defer valueCodecsMu.Unlock()
+	valueCodecs[option] = &valueCodec{encode: encode, decode: decode}
+}
+
+// registeredValueCodec returns the codec registered for option, or nil.
+func registeredValueCodec(option string) *valueCodec {
+	valueCodecsMu.RLock()
+	defer valueCodecsMu.RUnlock()
+	return valueCodecs[option]
+}
+
+// converter is a pair of functions registered by RegisterConverter.
+type converter struct {
+	to, from func(interface{}) (interface{}, error)
+}
+
+var (
+	convertersMu sync.RWMutex
+	converters   = make(map[reflect.Type]*converter)
+)
+
+// RegisterConverter registers functions that convert struct fields of type t,
+// which cannot be changed to implement PropertyConverter, such as *big.Rat or
+// a decimal type from another package, to and from a single Property.
+// to is passed a field's value and returns a Property value, such as a string
+// or an int64; from is passed a Property value and returns a value of type t.
+// Such fields, and the elements of slice fields of type []t, are then saved
+// and loaded as if t implemented PropertyConverter. The converter applies to
+// type t exactly: registering big.Rat does not affect *big.Rat fields.
+//
+// The chosen encoding determines how the property is indexed and ordered.
+// Exact decimals are usually stored either as strings, such as "12.34", which
+// order lexicographically, so that "9" sorts after "10" and inequality
+// filters and sort orders are not numeric, or as int64s scaled by a fixed
+// power of ten, such as cents, which order numerically but limit the range
+// and precision. Store a value that is never queried on with the "noindex"
+// option.
+//
+// RegisterConverter is typically called from an init function. It panics if
+// t implements PropertyConverter itself.
+func RegisterConverter(t reflect.Type, to, from func(interface{}) (interface{}, error)) {
+	if t.Implements(typeOfPropertyConverter) || reflect.PtrTo(t).Implements(typeOfPropertyConverter) {
+		panic(fmt.Sprintf("datastore: RegisterConverter of %v, which implements PropertyConverter", t))
+	}
+	convertersMu.Lock()
+	defer convertersMu.Unlock()
+	converters[t] = &converter{to: to, from: from}
+}
+
+// registeredConverter returns the converter registered for t, or nil.
+func registeredConverter(t reflect.Type) *converter {
+	convertersMu.RLock()
+	defer convertersMu.RUnlock()
+	return converters[t]
+}
+
+// fieldConverter adapts a struct field whose type has a registered converter
+// to the PropertyConverter interface.
+type fieldConverter struct {
+	v    reflect.Value
+	conv *converter
+}
+
+func (f fieldConverter) ToProperty() (Property, error) {
+	x, err := f.conv.to(f.v.Interface())
+	return Property{Value: x}, err
+}
+
+func (f fieldConverter) FromProperty(p Property) error {
+	x, err := f.conv.from(p.Value)
+	if err != nil {
+		return err
+	}
+	xv := reflect.ValueOf(x)
+	if !xv.IsValid() {
+		f.v.Set(reflect.Zero(f.v.Type()))
+		return nil
+	}
+	if xv.Type() != f.v.Type() {
+		return fmt.Errorf("datastore: converter for %v returned a %v", f.v.Type(), xv.Type())
+	}
+	f.v.Set(xv)
+	return nil
+}
+
+var (
+	typeOfStringer = reflect.TypeOf((*fmt.Stringer)(nil)).Elem()
+
+	enumParsersMu sync.RWMutex
+	enumParsers   = make(map[reflect.Type]func(string) (int64, error))
+)
+
+// isEnumType returns whether t can be stored by an "asstring" field: a signed
+// integer type with a String method.
+func isEnumType(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return t.Implements(typeOfStringer)
+	}
+	return false
+}
+
+// RegisterEnum registers parse as the inverse of the String method of enum's
+// type, for struct fields of that type tagged with the "asstring" option.
+// Such fields are saved as the string returned by String, and parse converts
+// that string back to the field's integer value when loading.
+//
+// RegisterEnum is typically called from an init function. It panics if
+// enum's type is not a signed integer type.
+func RegisterEnum(enum fmt.Stringer, parse func(string) (int64, error)) {
+	t := reflect.TypeOf(enum)
+	if !isEnumType(t) {
+		panic(fmt.Sprintf("datastore: RegisterEnum of non-integer type %v", t))
+	}
+	enumParsersMu.Lock()
+	defer enumParsersMu.Unlock()
+	enumParsers[t] = parse
+}
+
+// enumParser returns the function registered by RegisterEnum for t, or nil.
+func enumParser(t reflect.Type) func(string) (int64, error) {
+	enumParsersMu.RLock()
+	defer enumParsersMu.RUnlock()
+	return enumParsers[t]
+}
+
 // PropertyList converts a []Property to implement PropertyLoadSaver.
 type PropertyList []Property
 
@@ -132,10 +353,23 @@ func validPropertyName(name string) bool {
 // name is just the field name. A "-" name means that the datastore ignores
 // that field.
 type structTag struct {
-	name    string
-	noIndex bool
+	name     string
+	noIndex  bool
+	asString bool
+	lower    bool
+	// transform, if non-nil, is the codec registered by RegisterFieldCodec
+	// for one of the field's options.
+	transform *valueCodec
 }
 
+// lowerSuffix is appended to the name of a "lower" field to name the
+// property holding its lowercased shadow copy.
+const lowerSuffix = "_lower"
+
+// emptySliceSuffix is appended to the name of a []string field to name the
+// marker property saved when the field is empty but not nil.
+const emptySliceSuffix = ".__empty__"
+
 // structCodec describes how to convert a struct to and from a sequence of
 // properties.
 type structCodec struct {
@@ -152,10 +386,15 @@ type structCodec struct {
 }
 
 // fieldCodec is a struct field's index and, if that struct field's type is
-// itself a struct, that substruct's structCodec.
+// itself a struct, that substruct's structCodec. If shadow is true, the
+// property is the lowercased copy saved for a "lower" field, and is not
+// loaded. If emptySlice is true, the property is the marker saved for an
+// empty, non-nil []string field.
 type fieldCodec struct {
 	index          int
 	substructCodec *structCodec
+	shadow         bool
+	emptySlice     bool
 }
 
 // structCodecs collects the structCodecs that have already been calculated.
@@ -211,15 +450,27 @@ func getStructCodecLocked(t reflect.Type) (ret *structCodec, retErr error) {
 		}
 
 		substructType, fIsSlice := reflect.Type(nil), false
-		switch f.Type.Kind() {
-		case reflect.Struct:
-			substructType = f.Type
-		case reflect.Slice:
-			if f.Type.Elem().Kind() == reflect.Struct {
-				substructType = f.Type.Elem()
+		if !reflect.PtrTo(f.Type).Implements(typeOfPropertyConverter) && registeredConverter(f.Type) == nil {
+			// A field that converts itself is a single property,
+			// whatever its kind.
+			switch f.Type.Kind() {
+			case reflect.Struct:
+				substructType = f.Type
+			case reflect.Ptr:
+				if isNestedStructPtr(f.Type) {
+					substructType = f.Type.Elem()
+				}
+			case reflect.Slice:
+				if f.Type.Elem().Kind() == reflect.Struct {
+					substructType = f.Type.Elem()
+				}
+				fIsSlice = f.Type != typeOfByteSlice
+				c.hasSlice = c.hasSlice || fIsSlice
 			}
-			fIsSlice = f.Type != typeOfByteSlice
-			c.hasSlice = c.hasSlice || fIsSlice
+		}
+		if substructType != nil && (reflect.PtrTo(substructType).Implements(typeOfPropertyConverter) || registeredConverter(substructType) != nil) {
+			// So is each element of a slice of such structs.
+			substructType = nil
 		}
 
 		if substructType != nil && substructType != typeOfTime && substructType != typeOfGeoPoint {
@@ -250,12 +501,49 @@ func getStructCodecLocked(t reflect.Type) (ret *structCodec, retErr error) {
 				return nil, fmt.Errorf("datastore: struct tag has repeated property name: %q", name)
 			}
 			c.byName[name] = fieldCodec{index: i}
+			if fIsSlice && f.Type.Elem().Kind() == reflect.String && substructType == nil {
+				if _, ok := c.byName[name+emptySliceSuffix]; ok {
+					return nil, fmt.Errorf("datastore: struct tag has repeated property name: %q", name+emptySliceSuffix)
+				}
+				c.byName[name+emptySliceSuffix] = fieldCodec{index: i, emptySlice: true}
+			}
 		}
 
-		c.byIndex[i] = structTag{
-			name:    name,
-			noIndex: opts == "noindex",
+		tag := structTag{name: name}
+		for _, opt := range strings.Split(opts, ",") {
+			switch opt {
+			case "noindex":
+				tag.noIndex = true
+			case "asstring":
+				if !isEnumType(f.Type) && !(f.Type.Kind() == reflect.Slice && isEnumType(f.Type.Elem())) {
+					return nil, fmt.Errorf("datastore: asstring field %q must be a signed integer type with a String method, or a slice of one", f.Name)
+				}
+				tag.asString = true
+			case "lower":
+				if f.Type.Kind() != reflect.String && !(f.Type.Kind() == reflect.Slice && f.Type.Elem().Kind() == reflect.String) {
+					return nil, fmt.Errorf("datastore: lower field %q must be a string or a slice of strings", f.Name)
+				}
+				if _, ok := c.byName[name+lowerSuffix]; ok {
+					return nil, fmt.Errorf("datastore: struct tag has repeated property name: %q", name+lowerSuffix)
+				}
+				c.byName[name+lowerSuffix] = fieldCodec{index: i, shadow: true}
+				tag.lower = true
+			default:
+				vc := registeredValueCodec(opt)
+				if vc == nil {
+					break
+				}
+				if f.Type.Kind() != reflect.String && f.Type != typeOfByteSlice {
+					return nil, fmt.Errorf("datastore: %s field %q must be a string or a []byte", opt, f.Name)
+				}
+				tag.transform = vc
+			}
+		}
+		if tag.lower && tag.transform != nil {
+			// The shadow property would store the value untransformed.
+			return nil, fmt.Errorf("datastore: field %q cannot be both lower and transformed by a field codec", f.Name)
 		}
+		c.byIndex[i] = tag
 	}
 	c.complete = true
 	return c, nil
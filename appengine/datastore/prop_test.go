@@ -0,0 +1,397 @@
+// Copyright 2015 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// upper is saved as its string in upper case, and loaded as given.
+type upper struct {
+	S string
+}
+
+func (u *upper) ToProperty() (Property, error) {
+	return Property{Value: strings.ToUpper(u.S)}, nil
+}
+
+func (u *upper) FromProperty(p Property) error {
+	u.S, _ = p.Value.(string)
+	return nil
+}
+
+// saveProps saves src with SaveStruct and returns its properties.
+func saveProps(src interface{}) ([]Property, error) {
+	c := make(chan Property, 32)
+	err := SaveStruct(src, c)
+	var props []Property
+	for p := range c {
+		props = append(props, p)
+	}
+	return props, err
+}
+
+func TestPropertyConverterPointerField(t *testing.T) {
+	type T struct {
+		P   *upper
+		Nil *upper
+	}
+	props, err := saveProps(&T{P: &upper{"abc"}})
+	if err != nil {
+		t.Fatalf("SaveStruct: %v", err)
+	}
+	if len(props) != 2 || props[0].Value != "ABC" || props[1].Value != nil {
+		t.Fatalf("saved %+v, want P=ABC and a nil Nil", props)
+	}
+
+	var dst T
+	if err := loadProps(&dst, props...); err != nil {
+		t.Fatalf("LoadStruct: %v", err)
+	}
+	if dst.P == nil || dst.P.S != "ABC" {
+		t.Errorf("loaded P = %+v, want &{ABC}", dst.P)
+	}
+	if dst.Nil == nil || dst.Nil.S != "" {
+		t.Errorf("loaded Nil = %+v, want a new zero upper", dst.Nil)
+	}
+}
+
+// suit is an enum that implements PropertyConverter to be saved by name.
+type suit int
+
+var suitNames = []string{"clubs", "diamonds", "hearts", "spades"}
+
+func (s suit) ToProperty() (Property, error) {
+	if s < 0 || int(s) >= len(suitNames) {
+		return Property{}, fmt.Errorf("invalid suit %d", s)
+	}
+	return Property{Value: suitNames[s]}, nil
+}
+
+func (s *suit) FromProperty(p Property) error {
+	name, _ := p.Value.(string)
+	for i, n := range suitNames {
+		if n == name {
+			*s = suit(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown suit %q", name)
+}
+
+func TestPropertyConverterEnum(t *testing.T) {
+	type Card struct {
+		Suit  suit
+		Rank  int
+		Trump []suit `datastore:",noindex"`
+	}
+	src := Card{Suit: 2, Rank: 12, Trump: []suit{0, 3}}
+	props, err := saveProps(&src)
+	if err != nil {
+		t.Fatalf("saveProps: %v", err)
+	}
+	want := []Property{
+		{Name: "Suit", Value: "hearts"},
+		{Name: "Rank", Value: int64(12)},
+		{Name: "Trump", Value: "clubs", NoIndex: true, Multiple: true},
+		{Name: "Trump", Value: "spades", NoIndex: true, Multiple: true},
+	}
+	if !reflect.DeepEqual(props, want) {
+		t.Errorf("saved %+v, want %+v", props, want)
+	}
+	var dst Card
+	if err := loadProps(&dst, props...); err != nil {
+		t.Fatalf("loadProps: %v", err)
+	}
+	if !reflect.DeepEqual(dst, src) {
+		t.Errorf("loaded %+v, want %+v", dst, src)
+	}
+
+	if _, err := saveProps(&Card{Suit: 7}); err == nil || !strings.Contains(err.Error(), "invalid suit 7") {
+		t.Errorf("saving an invalid suit: got %v", err)
+	}
+	err = loadProps(&dst, Property{Name: "Suit", Value: "jokers"})
+	if fm, ok := err.(*ErrFieldMismatch); !ok || !strings.Contains(fm.Reason, "unknown suit") {
+		t.Errorf("loading an unknown suit: got %v, want an *ErrFieldMismatch", err)
+	}
+}
+
+// color is an enum that "asstring" fields save by name.
+type color int
+
+var colorNames = []string{"red", "green", "blue"}
+
+func (c color) String() string { return colorNames[c] }
+
+func parseColor(s string) (int64, error) {
+	for i, name := range colorNames {
+		if s == name {
+			return int64(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown color %q", s)
+}
+
+func init() {
+	RegisterEnum(color(0), parseColor)
+}
+
+// shade is an enum whose parser is never registered.
+type shade int
+
+func (s shade) String() string { return "dark" }
+
+// label has a String method but is not an integer type, so is not an enum.
+type label string
+
+func (l label) String() string { return string(l) }
+
+func TestRegisterEnum(t *testing.T) {
+	type T struct {
+		C  color   `datastore:",asstring"`
+		Cs []color `datastore:",noindex,asstring"`
+		N  color
+	}
+	src := T{C: 2, Cs: []color{1, 0}, N: 1}
+	props, err := saveProps(&src)
+	if err != nil {
+		t.Fatalf("saveProps: %v", err)
+	}
+	want := []Property{
+		{Name: "C", Value: "blue"},
+		{Name: "Cs", Value: "green", NoIndex: true, Multiple: true},
+		{Name: "Cs", Value: "red", NoIndex: true, Multiple: true},
+		{Name: "N", Value: int64(1)},
+	}
+	if !reflect.DeepEqual(props, want) {
+		t.Errorf("saved %v, want %v", props, want)
+	}
+	var dst T
+	if err := loadProps(&dst, props...); err != nil {
+		t.Fatalf("loadProps: %v", err)
+	}
+	if !reflect.DeepEqual(dst, src) {
+		t.Errorf("loaded %+v, want %+v", dst, src)
+	}
+
+	tests := []struct {
+		desc string
+		dst  interface{}
+		prop Property
+		want string
+	}{
+		{
+			desc: "unknown name",
+			dst: &struct {
+				C color `datastore:",asstring"`
+			}{},
+			prop: Property{Name: "C", Value: "mauve"},
+			want: `cannot parse "mauve"`,
+		},
+		{
+			desc: "integer value",
+			dst: &struct {
+				C color `datastore:",asstring"`
+			}{},
+			prop: Property{Name: "C", Value: int64(1)},
+			want: "needs a string",
+		},
+		{
+			desc: "no registered parser",
+			dst: &struct {
+				S shade `datastore:",asstring"`
+			}{},
+			prop: Property{Name: "S", Value: "dark"},
+			want: "see RegisterEnum",
+		},
+	}
+	for _, tt := range tests {
+		if err := loadProps(tt.dst, tt.prop); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got %v, want an error containing %q", tt.desc, err, tt.want)
+		}
+	}
+
+	// Only signed integer types with a String method are enums.
+	if _, err := saveProps(&struct {
+		S string `datastore:",asstring"`
+	}{}); err == nil {
+		t.Error("saving an asstring string field: got no error")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("RegisterEnum of a non-integer type did not panic")
+		}
+	}()
+	RegisterEnum(label("x"), nil)
+}
+
+var typeOfRat = reflect.TypeOf((*big.Rat)(nil))
+
+func init() {
+	RegisterConverter(typeOfRat,
+		func(v interface{}) (interface{}, error) {
+			r := v.(*big.Rat)
+			if r == nil {
+				return nil, nil
+			}
+			return r.RatString(), nil
+		},
+		func(v interface{}) (interface{}, error) {
+			switch v := v.(type) {
+			case nil:
+				return nil, nil
+			case string:
+				if r, ok := new(big.Rat).SetString(v); ok {
+					return r, nil
+				}
+				return nil, fmt.Errorf("bad rational %q", v)
+			case int64:
+				return "not a rational", nil
+			}
+			return nil, fmt.Errorf("unexpected %T", v)
+		})
+}
+
+func TestRegisterConverter(t *testing.T) {
+	type T struct {
+		R   *big.Rat
+		Rs  []*big.Rat
+		Nil *big.Rat
+	}
+	src := T{R: big.NewRat(1, 3), Rs: []*big.Rat{big.NewRat(5, 1), big.NewRat(-7, 2)}}
+	props, err := saveProps(&src)
+	if err != nil {
+		t.Fatalf("saveProps: %v", err)
+	}
+	want := []Property{
+		{Name: "R", Value: "1/3"},
+		{Name: "Rs", Value: "5", Multiple: true},
+		{Name: "Rs", Value: "-7/2", Multiple: true},
+		{Name: "Nil", Value: nil},
+	}
+	if !reflect.DeepEqual(props, want) {
+		t.Errorf("saved %v, want %v", props, want)
+	}
+	dst := T{Nil: big.NewRat(1, 1)}
+	if err := loadProps(&dst, props...); err != nil {
+		t.Fatalf("loadProps: %v", err)
+	}
+	if dst.R.Cmp(src.R) != 0 || len(dst.Rs) != 2 || dst.Rs[0].Cmp(src.Rs[0]) != 0 || dst.Rs[1].Cmp(src.Rs[1]) != 0 || dst.Nil != nil {
+		t.Errorf("loaded %v, want %v", dst, src)
+	}
+
+	tests := []struct {
+		desc string
+		prop Property
+		want string
+	}{
+		{"converter error", Property{Name: "R", Value: "one"}, `bad rational "one"`},
+		{"wrong result type", Property{Name: "R", Value: int64(1)}, "converter for *big.Rat returned a string"},
+	}
+	for _, tt := range tests {
+		if err := loadProps(&T{}, tt.prop); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got %v, want an error containing %q", tt.desc, err, tt.want)
+		}
+	}
+
+	// The converter applies to *big.Rat exactly, so a big.Rat field is saved
+	// as a struct, whose fields are all unexported.
+	if props, err := saveProps(&struct{ R big.Rat }{*big.NewRat(1, 3)}); err != nil || len(props) != 0 {
+		t.Errorf("saving a big.Rat field: got %v, %v, want no properties", props, err)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("RegisterConverter of a PropertyConverter did not panic")
+		}
+	}()
+	RegisterConverter(reflect.TypeOf(upper{}), nil, nil)
+}
+
+// xorBytes flips the case bit of every byte, standing in for encryption.
+func xorBytes(b []byte) ([]byte, error) {
+	x := make([]byte, len(b))
+	for i := range b {
+		x[i] = b[i] ^ 0x20
+	}
+	return x, nil
+}
+
+func init() {
+	RegisterFieldCodec("xor", xorBytes, xorBytes)
+	RegisterFieldCodec("broken",
+		func([]byte) ([]byte, error) { return nil, errors.New("cannot encode") },
+		func([]byte) ([]byte, error) { return nil, errors.New("cannot decode") })
+}
+
+func TestRegisterFieldCodec(t *testing.T) {
+	type T struct {
+		S string `datastore:",xor"`
+		B []byte `datastore:"b,xor"`
+	}
+	src := T{S: "abc", B: []byte("XYZ")}
+	props, err := saveProps(&src)
+	if err != nil {
+		t.Fatalf("saveProps: %v", err)
+	}
+	want := []Property{
+		{Name: "S", Value: []byte("ABC"), NoIndex: true},
+		{Name: "b", Value: []byte("xyz"), NoIndex: true},
+	}
+	if !reflect.DeepEqual(props, want) {
+		t.Errorf("saved %v, want %v", props, want)
+	}
+	var dst T
+	if err := loadProps(&dst, props...); err != nil {
+		t.Fatalf("loadProps: %v", err)
+	}
+	if !reflect.DeepEqual(dst, src) {
+		t.Errorf("loaded %+v, want %+v", dst, src)
+	}
+
+	type Broken struct {
+		S string `datastore:",broken"`
+	}
+	if _, err := saveProps(&Broken{S: "x"}); err == nil || !strings.Contains(err.Error(), "cannot encode") {
+		t.Errorf("saving with a failing codec: got %v", err)
+	}
+	if err := loadProps(&Broken{}, Property{Name: "S", Value: []byte("x")}); err == nil || !strings.Contains(err.Error(), "cannot decode") {
+		t.Errorf("loading with a failing codec: got %v", err)
+	}
+	if err := loadProps(&T{}, Property{Name: "S", Value: int64(1)}); err == nil {
+		t.Error("loading an int64 into a codec field: got no error")
+	}
+
+	bad := []struct {
+		desc string
+		src  interface{}
+	}{
+		{"int field", &struct {
+			N int `datastore:",xor"`
+		}{}},
+		{"lower field", &struct {
+			S string `datastore:",lower,xor"`
+		}{}},
+	}
+	for _, tt := range bad {
+		if _, err := saveProps(tt.src); err == nil {
+			t.Errorf("%s: got no error", tt.desc)
+		}
+	}
+	for _, option := range []string{"", "noindex", "asstring", "lower"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("RegisterFieldCodec(%q) did not panic", option)
+				}
+			}()
+			RegisterFieldCodec(option, xorBytes, xorBytes)
+		}()
+	}
+}
@@ -5,12 +5,14 @@
 package datastore
 
 import (
+	"bytes"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"math"
 	"reflect"
 	"strings"
+	"time"
 
 	"appengine"
 	"github.com/golang/protobuf/proto"
@@ -43,6 +45,13 @@ type filter struct {
 	Value     interface{}
 }
 
+// inFilter is a set of equality filters on a single field that are OR'ed
+// together.
+type inFilter struct {
+	FieldName string
+	Values    []interface{}
+}
+
 type sortDirection int
 
 const (
@@ -78,12 +87,18 @@ type Query struct {
 	kind       string
 	ancestor   *Key
 	filter     []filter
+	in         *inFilter
+	memFilter  []filter
 	order      []order
 	projection []string
+	distinctOn []string
+	ignore     []string
 
 	distinct bool
 	keysOnly bool
 	eventual bool
+	prefetch bool
+	merge    bool
 	limit    int32
 	offset   int32
 	start    *pb.CompiledCursor
@@ -103,6 +118,10 @@ func (q *Query) clone() *Query {
 		x.order = make([]order, len(q.order))
 		copy(x.order, q.order)
 	}
+	if len(q.memFilter) > 0 {
+		x.memFilter = make([]filter, len(q.memFilter))
+		copy(x.memFilter, q.memFilter)
+	}
 	return &x
 }
 
@@ -120,7 +139,9 @@ func (q *Query) Ancestor(ancestor *Key) *Query {
 
 // EventualConsistency returns a derivative query that returns eventually
 // consistent results.
-// It only has an effect on ancestor queries.
+// It only has an effect on ancestor queries, since queries without an ancestor
+// filter are always eventually consistent. Get and GetMulti are always
+// strongly consistent.
 func (q *Query) EventualConsistency() *Query {
 	q = q.clone()
 	q.eventual = true
@@ -132,12 +153,81 @@ func (q *Query) EventualConsistency() *Query {
 // followed by an operator, one of ">", "<", ">=", "<=", or "=".
 // Fields are compared against the provided value using the operator.
 // Multiple filters are AND'ed together.
+//
+// The field name "__key__" filters on entities' keys, in which case the value
+// must be a complete *Key in the app and namespace that the query is run in.
+// For example, Filter("__key__ >", k).Order("__key__") pages through a kind
+// after k, which scales better than an increasing Offset.
 func (q *Query) Filter(filterStr string, value interface{}) *Query {
 	q = q.clone()
+	f, err := parseFilter(filterStr, value)
+	if err != nil {
+		q.err = err
+		return q
+	}
+	if f.FieldName == "__key__" {
+		if k, ok := value.(*Key); !ok || !k.valid() || k.Incomplete() {
+			q.err = errors.New("datastore: __key__ filter value must be a complete *Key")
+			return q
+		}
+	}
+	q.filter = append(q.filter, f)
+	return q
+}
+
+// checkKeyFilters checks that the keys of the query's __key__ filters are in
+// the app and namespace that c runs the query in. The datastore would match
+// no entities with a key from elsewhere, rather than fail.
+func (q *Query) checkKeyFilters(c appengine.Context) error {
+	var here *Key
+	for _, f := range q.filter {
+		if f.FieldName != "__key__" {
+			continue
+		}
+		if here == nil {
+			here = NewIncompleteKey(c, "_", nil)
+		}
+		k, ok := f.Value.(*Key)
+		if !ok || !k.valid() || k.Incomplete() {
+			// FilterIn's per-value filters do not go through Filter.
+			return errors.New("datastore: __key__ filter value must be a complete *Key")
+		}
+		if k.appID != here.appID || k.namespace != here.namespace {
+			return fmt.Errorf("datastore: __key__ filter key is in app %q, namespace %q, but the query is in app %q, namespace %q",
+				k.appID, k.namespace, here.appID, here.namespace)
+		}
+	}
+	return nil
+}
+
+// FilterInMemory returns a derivative query with a field-based filter that is
+// applied by the client, not the datastore. Its filterStr and value are as
+// for Filter. Such filters need no index, and can match unindexed properties,
+// but every entity matching the query's other constraints is fetched and then
+// compared in memory. This does not scale: it is intended for small result
+// sets, such as a single entity group, and running the query fails if more
+// than 1000 entities are fetched. Keys and GeoPoints can only be compared for
+// equality.
+//
+// FilterInMemory queries cannot be projection queries or use cursors, and
+// their sort orders cannot involve the in-memory filtered fields unless
+// those are indexed.
+func (q *Query) FilterInMemory(filterStr string, value interface{}) *Query {
+	q = q.clone()
+	f, err := parseFilter(filterStr, value)
+	if err != nil {
+		q.err = err
+		return q
+	}
+	q.memFilter = append(q.memFilter, f)
+	return q
+}
+
+// parseFilter parses the arguments to Filter.
+func parseFilter(filterStr string, value interface{}) (filter, error) {
 	filterStr = strings.TrimSpace(filterStr)
 	if len(filterStr) < 1 {
-		q.err = errors.New("datastore: invalid filter: " + filterStr)
-		return q
+		return filter{}, errors.New("datastore: invalid filter: " + filterStr)
 	}
 	f := filter{
 		FieldName: strings.TrimRight(filterStr, " ><=!"),
@@ -155,10 +245,41 @@ func (q *Query) Filter(filterStr string, value interface{}) *Query {
 	case "=":
 		f.Op = equal
 	default:
-		q.err = fmt.Errorf("datastore: invalid operator %q in filter %q", op, filterStr)
+		return filter{}, fmt.Errorf("datastore: invalid operator %q in filter %q", op, filterStr)
+	}
+	return f, nil
+}
+
+// FilterIn returns a derivative query that matches entities whose fieldName
+// property is equal to any of the given values. At most one FilterIn may be
+// applied to a query.
+//
+// The datastore has no native IN operator, so running the query issues one
+// equality query per value and merges their results in memory, in the order
+// given by the query's sort orders and then by key, omitting entities that
+// match more than one value. The cost is therefore that of len(values)
+// separate queries. Offset and Limit apply to the merged results, and at most
+// 1000 results are held in memory, so a query that would yield more than that
+// needs a Limit. FilterIn queries cannot be used with cursors.
+func (q *Query) FilterIn(fieldName string, values ...interface{}) *Query {
+	q = q.clone()
+	fieldName = strings.TrimSpace(fieldName)
+	if fieldName == "" {
+		q.err = errors.New("datastore: empty FilterIn field name")
 		return q
 	}
-	q.filter = append(q.filter, f)
+	if q.in != nil {
+		q.err = errors.New("datastore: a query can have at most one FilterIn")
+		return q
+	}
+	if len(values) == 0 {
+		q.err = errors.New("datastore: FilterIn requires at least one value")
+		return q
+	}
+	q.in = &inFilter{
+		FieldName: fieldName,
+		Values:    append([]interface{}(nil), values...),
+	}
 	return q
 }
 
@@ -204,6 +325,60 @@ func (q *Query) Distinct() *Query {
 	return q
 }
 
+// DistinctOn returns a derivative query that yields de-duplicated entities
+// with respect to the given fields, which must be a subset of the projected
+// fields. It is only used for projection queries. For example, projecting
+// on "Tag" and "Author" but distinct on "Tag" yields one entity per tag.
+func (q *Query) DistinctOn(fieldNames ...string) *Query {
+	q = q.clone()
+	if len(fieldNames) == 0 {
+		q.err = errors.New("datastore: DistinctOn needs at least one field")
+		return q
+	}
+	q.distinctOn = append([]string(nil), fieldNames...)
+	return q
+}
+
+// IgnoreFields returns a derivative query whose results do not load the
+// named properties, or the flattened properties of the named struct fields,
+// into the destination passed to Iterator.Next or GetAll. Those fields are
+// left unchanged. This saves decoding large properties, such as unindexed
+// blobs, that cannot be excluded by a projection. The properties are still
+// transferred from the datastore.
+func (q *Query) IgnoreFields(fieldNames ...string) *Query {
+	q = q.clone()
+	q.ignore = append(append([]string(nil), q.ignore...), fieldNames...)
+	return q
+}
+
+// loadEntity is like the loadEntity function, but skips the properties
+// that the query ignores.
+func (q *Query) loadEntity(dst interface{}, src *pb.EntityProto) error {
+	if len(q.ignore) == 0 {
+		return loadEntity(dst, src)
+	}
+	e := *src
+	e.Property = q.keepProperties(src.Property)
+	e.RawProperty = q.keepProperties(src.RawProperty)
+	return loadEntity(dst, &e)
+}
+
+// keepProperties returns the properties that the query does not ignore.
+func (q *Query) keepProperties(props []*pb.Property) []*pb.Property {
+	kept := make([]*pb.Property, 0, len(props))
+loop:
+	for _, p := range props {
+		name := p.GetName()
+		for _, ig := range q.ignore {
+			if name == ig || strings.HasPrefix(name, ig+".") {
+				continue loop
+			}
+		}
+		kept = append(kept, p)
+	}
+	return kept
+}
+
 // KeysOnly returns a derivative query that yields only keys, not keys and
 // entities. It cannot be used with projection queries.
 func (q *Query) KeysOnly() *Query {
@@ -212,6 +387,31 @@ func (q *Query) KeysOnly() *Query {
 	return q
 }
 
+// Prefetch returns a derivative query whose iterators fetch each batch of
+// results in the background, overlapping the datastore round trip with the
+// caller's work on large scans. The fetch of the next batch starts when Next
+// returns the last result of the current one, so an iterator abandoned part
+// way through a batch issues no further API calls. At most one batch is
+// fetched ahead. An error from fetching a batch is returned by the call to
+// Next that needs that batch.
+func (q *Query) Prefetch() *Query {
+	q = q.clone()
+	q.prefetch = true
+	return q
+}
+
+// MergeJoin returns a derivative query that asks the datastore to answer it by
+// merge-joining the single-property indexes of its equality filters, scanning
+// them in step rather than through a composite index. The query must have
+// equality filters on at least two different properties; all of them are sent
+// in the one query, so no index beyond the built-in ones is needed unless the
+// query also has an inequality filter or a sort order.
+func (q *Query) MergeJoin() *Query {
+	q = q.clone()
+	q.merge = true
+	return q
+}
+
 // Limit returns a derivative query that has a limit on the number of results
 // returned. A negative value means unlimited.
 func (q *Query) Limit(limit int) *Query {
@@ -262,6 +462,100 @@ func (q *Query) End(c Cursor) *Query {
 	return q
 }
 
+// operatorToString maps each filter operator to its GQL spelling.
+var operatorToString = map[operator]string{
+	lessThan:    "<",
+	lessEq:      "<=",
+	equal:       "=",
+	greaterEq:   ">=",
+	greaterThan: ">",
+}
+
+// String returns a GQL-like rendering of the query, for use in logs and error
+// messages. It shows the kind, projection, ancestor, filters, sort orders,
+// limit and offset, but not cursors or any error recorded while building the
+// query. The result is not guaranteed to be valid GQL.
+func (q *Query) String() string {
+	var b bytes.Buffer
+	b.WriteString("SELECT ")
+	switch {
+	case q.distinctOn != nil:
+		fmt.Fprintf(&b, "DISTINCT ON (%s) ", strings.Join(q.distinctOn, ", "))
+	case q.distinct:
+		b.WriteString("DISTINCT ")
+	}
+	switch {
+	case q.projection != nil:
+		b.WriteString(strings.Join(q.projection, ", "))
+	case q.keysOnly:
+		b.WriteString("__key__")
+	default:
+		b.WriteString("*")
+	}
+	if q.kind != "" {
+		fmt.Fprintf(&b, " FROM %s", q.kind)
+	}
+	var conds []string
+	for _, f := range q.filter {
+		conds = append(conds, fmt.Sprintf("%s %s %s", f.FieldName, operatorToString[f.Op], gqlValue(f.Value)))
+	}
+	if q.in != nil {
+		vs := make([]string, len(q.in.Values))
+		for i, v := range q.in.Values {
+			vs[i] = gqlValue(v)
+		}
+		conds = append(conds, fmt.Sprintf("%s IN (%s)", q.in.FieldName, strings.Join(vs, ", ")))
+	}
+	if q.ancestor != nil {
+		conds = append(conds, "__key__ HAS ANCESTOR "+gqlValue(q.ancestor))
+	}
+	if len(conds) > 0 {
+		fmt.Fprintf(&b, " WHERE %s", strings.Join(conds, " AND "))
+	}
+	if len(q.memFilter) > 0 {
+		conds = conds[:0]
+		for _, f := range q.memFilter {
+			conds = append(conds, fmt.Sprintf("%s %s %s", f.FieldName, operatorToString[f.Op], gqlValue(f.Value)))
+		}
+		fmt.Fprintf(&b, " IN MEMORY WHERE %s", strings.Join(conds, " AND "))
+	}
+	if len(q.order) > 0 {
+		orders := make([]string, len(q.order))
+		for i, o := range q.order {
+			orders[i] = o.FieldName
+			if o.Direction == descending {
+				orders[i] += " DESC"
+			}
+		}
+		fmt.Fprintf(&b, " ORDER BY %s", strings.Join(orders, ", "))
+	}
+	if q.limit >= 0 {
+		fmt.Fprintf(&b, " LIMIT %d", q.limit)
+	}
+	if q.offset > 0 {
+		fmt.Fprintf(&b, " OFFSET %d", q.offset)
+	}
+	return b.String()
+}
+
+// gqlValue renders a filter value for Query.String.
+func gqlValue(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return fmt.Sprintf("%q", v)
+	case *Key:
+		if v == nil {
+			return "NULL"
+		}
+		return "KEY(" + v.String() + ")"
+	case time.Time:
+		return "DATETIME(" + v.UTC().Format(time.RFC3339Nano) + ")"
+	case nil:
+		return "NULL"
+	}
+	return fmt.Sprint(v)
+}
+
 // toProto converts the query to a protocol buffer.
 func (q *Query) toProto(dst *pb.Query, appID string) error {
 	if len(q.projection) != 0 && q.keysOnly {
@@ -278,10 +572,26 @@ func (q *Query) toProto(dst *pb.Query, appID string) error {
 			dst.Strong = proto.Bool(false)
 		}
 	}
+	if q.distinctOn != nil {
+		if q.distinct {
+			return errors.New("datastore: query cannot use both Distinct and DistinctOn")
+		}
+		projected := make(map[string]bool, len(q.projection))
+		for _, name := range q.projection {
+			projected[name] = true
+		}
+		for _, name := range q.distinctOn {
+			if !projected[name] {
+				return fmt.Errorf("datastore: DistinctOn field %q is not projected", name)
+			}
+		}
+	}
 	if q.projection != nil {
 		dst.PropertyName = q.projection
 		if q.distinct {
 			dst.GroupByPropertyName = q.projection
+		} else if q.distinctOn != nil {
+			dst.GroupByPropertyName = q.distinctOn
 		}
 	}
 	if q.keysOnly {
@@ -305,6 +615,18 @@ func (q *Query) toProto(dst *pb.Query, appID string) error {
 		}
 		dst.Filter = append(dst.Filter, xf)
 	}
+	if q.merge {
+		props := make(map[string]bool)
+		for _, qf := range q.filter {
+			if qf.Op == equal {
+				props[qf.FieldName] = true
+			}
+		}
+		if len(props) < 2 {
+			return errors.New("datastore: MergeJoin needs equality filters on at least two properties")
+		}
+		dst.Hint = pb.Query_FILTER_FIRST.Enum()
+	}
 	for _, qo := range q.order {
 		if qo.FieldName == "" {
 			return errors.New("datastore: empty query order field name")
@@ -337,6 +659,24 @@ func (q *Query) Count(c appengine.Context) (int, error) {
 		return 0, q.err
 	}
 
+	if q.in != nil || q.memFilter != nil {
+		// Results of FilterIn and FilterInMemory queries are merged or
+		// filtered in memory, so they can only be counted by running the query.
+		newQ := q.clone()
+		newQ.keysOnly = len(newQ.projection) == 0
+		n := 0
+		for t := newQ.Run(c); ; n++ {
+			_, _, err := t.next()
+			if err == Done {
+				break
+			}
+			if err != nil {
+				return 0, err
+			}
+		}
+		return n, nil
+	}
+
 	// Run a copy of the query, with keysOnly true (if we're not a projection,
 	// since the two are incompatible), and an adjusted offset. We also set the
 	// limit to zero, as we don't want any actual entity data, just the number
@@ -354,6 +694,9 @@ func (q *Query) Count(c appengine.Context) (int, error) {
 			newQ.offset = math.MaxInt32
 		}
 	}
+	if err := newQ.checkKeyFilters(c); err != nil {
+		return 0, err
+	}
 	req := &pb.Query{}
 	if err := newQ.toProto(req, c.FullyQualifiedAppID()); err != nil {
 		return 0, err
@@ -401,6 +744,81 @@ func (q *Query) Count(c appengine.Context) (int, error) {
 	return int(n), nil
 }
 
+// CountWithCursor counts the entities matching the query, in installments
+// that each take roughly the given duration, so that counting a very large
+// result set can be spread over several requests or tasks.
+//
+// The first call should pass a zero start Cursor. Each call returns the
+// number of entities counted in that call and, if done is false, the cursor
+// to pass as start to the next call; the total is the sum of the partial
+// counts. The query's Offset only applies to the first call. Queries with a
+// Limit, a FilterIn or a FilterInMemory are not supported.
+func (q *Query) CountWithCursor(c appengine.Context, start Cursor, deadline time.Duration) (partial int, next Cursor, done bool, err error) {
+	if q.err != nil {
+		return 0, Cursor{}, false, q.err
+	}
+	if q.in != nil {
+		return 0, Cursor{}, false, errors.New("datastore: FilterIn queries do not support cursors")
+	}
+	if q.memFilter != nil {
+		return 0, Cursor{}, false, errors.New("datastore: FilterInMemory queries do not support cursors")
+	}
+	if q.limit >= 0 {
+		return 0, Cursor{}, false, errors.New("datastore: CountWithCursor does not support Limit")
+	}
+	// As in Count, run a keys-only copy of the query that skips over every
+	// result rather than returning any, and count the skipped results.
+	newQ := q.clone()
+	newQ.keysOnly = len(newQ.projection) == 0
+	newQ.limit = 0
+	if start.cc != nil {
+		newQ.start = start.cc
+		newQ.offset = 0
+	}
+	// The offset is skipped along with the results, so start below zero.
+	partial = -int(newQ.offset)
+	newQ.offset = math.MaxInt32
+	if err := newQ.checkKeyFilters(c); err != nil {
+		return 0, Cursor{}, false, err
+	}
+	req := &pb.Query{}
+	if err := newQ.toProto(req, c.FullyQualifiedAppID()); err != nil {
+		return 0, Cursor{}, false, err
+	}
+	res := &pb.QueryResult{}
+	if err := c.Call("datastore_v3", "RunQuery", req, res, nil); err != nil {
+		return 0, Cursor{}, false, err
+	}
+	stop := time.Now().Add(deadline)
+	for {
+		if len(res.Result) != 0 {
+			return 0, Cursor{}, false, errors.New("datastore: internal error: Count request returned too much data")
+		}
+		partial += int(res.GetSkippedResults())
+		if !res.GetMoreResults() {
+			if partial < 0 {
+				partial = 0 // the offset exceeded the results
+			}
+			return partial, Cursor{}, true, nil
+		}
+		// Stop between batches, where the cursor marks the results
+		// skipped so far, if the offset has been skipped.
+		if partial >= 0 && time.Now().After(stop) {
+			cc := res.SkippedResultsCompiledCursor
+			if cc == nil {
+				cc = res.CompiledCursor
+			}
+			if cc == nil {
+				return 0, Cursor{}, false, errors.New("datastore: internal error: server did not return a cursor")
+			}
+			return partial, Cursor{cc}, false, nil
+		}
+		if err := callNext(c, res, math.MaxInt32, 0); err != nil {
+			return 0, Cursor{}, false, err
+		}
+	}
+}
+
 // callNext issues a datastore_v3/Next RPC to advance a cursor, such as that
 // returned by a query with more results.
 func callNext(c appengine.Context, res *pb.QueryResult, offset, limit int32) error {
@@ -483,8 +901,8 @@ func (q *Query) GetAll(c appengine.Context, dst interface{}) ([]*Key, error) {
 				x := reflect.MakeMap(elemType)
 				ev.Elem().Set(x)
 			}
-			if err = loadEntity(ev.Interface(), e); err != nil {
-				if _, ok := err.(*ErrFieldMismatch); ok {
+			if err = q.loadEntity(ev.Interface(), e); err != nil {
+				if isErrFieldMismatch(err) {
 					// We continue loading entities even in the face of field mismatch errors.
 					// If we encounter any other error, that other error is returned. Otherwise,
 					// an ErrFieldMismatch is returned.
@@ -508,12 +926,22 @@ func (q *Query) Run(c appengine.Context) *Iterator {
 	if q.err != nil {
 		return &Iterator{err: q.err}
 	}
+	if q.in != nil {
+		return q.runIn(c)
+	}
+	if q.memFilter != nil {
+		return q.runInMemory(c)
+	}
 	t := &Iterator{
 		c:      c,
 		limit:  q.limit,
 		q:      q,
 		prevCC: q.start,
 	}
+	if err := q.checkKeyFilters(c); err != nil {
+		t.err = err
+		return t
+	}
 	var req pb.Query
 	if err := q.toProto(&req, c.FullyQualifiedAppID()); err != nil {
 		t.err = err
@@ -543,6 +971,476 @@ func (q *Query) Run(c appengine.Context) *Iterator {
 	return t
 }
 
+// runIn runs a query that has a FilterIn, by running one equality query per
+// value and merging their results in the query's sort order.
+func (q *Query) runIn(c appengine.Context) *Iterator {
+	t := &Iterator{
+		c:     c,
+		limit: -1,
+		q:     q,
+	}
+	if q.start != nil || q.end != nil {
+		t.err = errors.New("datastore: FilterIn queries cannot be used with cursors")
+		return t
+	}
+	srcs := make([]*inSource, 0, len(q.in.Values))
+	for _, v := range q.in.Values {
+		sub := q.clone()
+		sub.in = nil
+		sub.filter = append(sub.filter, filter{
+			FieldName: q.in.FieldName,
+			Op:        equal,
+			Value:     v,
+		})
+		// Each sub-query might contribute all of the merged results, so it
+		// must not skip any of them.
+		sub.offset = 0
+		if q.limit >= 0 {
+			sub.limit = q.offset + q.limit
+			if sub.limit < 0 {
+				sub.limit = -1 // overflow
+			}
+		}
+		src := &inSource{it: sub.Run(c)}
+		if err := src.advance(); err != nil {
+			t.err = err
+			return t
+		}
+		if src.e != nil {
+			srcs = append(srcs, src)
+		}
+	}
+
+	// An entity matching several values is yielded by several sub-queries.
+	// A projection query yields a result per projected value, so results
+	// sharing a key are distinct there.
+	var seen map[string]bool
+	if len(q.projection) == 0 {
+		seen = make(map[string]bool)
+	}
+	var results []*pb.EntityProto
+	for skip := q.offset; len(srcs) > 0 && (q.limit < 0 || len(results) < int(q.limit)); {
+		min := 0
+		for i := 1; i < len(srcs); i++ {
+			if q.compareResults(srcs[i].k, srcs[i].e, srcs[min].k, srcs[min].e) < 0 {
+				min = i
+			}
+		}
+		src := srcs[min]
+		k, e := src.k, src.e
+		if err := src.advance(); err != nil {
+			t.err = err
+			return t
+		}
+		if src.e == nil {
+			srcs = append(srcs[:min], srcs[min+1:]...)
+		}
+		if seen != nil {
+			id := k.Encode()
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+		}
+		if skip > 0 {
+			skip--
+			continue
+		}
+		if len(results) == maxInMemoryEntities {
+			t.err = fmt.Errorf("datastore: FilterIn query yielded more than %d entities; use Limit", maxInMemoryEntities)
+			return t
+		}
+		results = append(results, e)
+	}
+	t.res.Result = results
+	t.res.MoreResults = proto.Bool(false)
+	return t
+}
+
+// inSource is the results of one of a FilterIn query's sub-queries, with the
+// next one read ahead so that the sources can be merged.
+type inSource struct {
+	it *Iterator
+	k  *Key
+	e  *pb.EntityProto // nil once the sub-query is exhausted
+}
+
+func (s *inSource) advance() error {
+	k, e, err := s.it.next()
+	if err == Done {
+		s.k, s.e = nil, nil
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	s.k, s.e = k, e
+	return nil
+}
+
+// compareResults compares two query results by the query's sort orders and
+// then by key, as the datastore orders them, returning -1, 0 or +1.
+func (q *Query) compareResults(ak *Key, a *pb.EntityProto, bk *Key, b *pb.EntityProto) int {
+	for _, o := range q.order {
+		var cmp int
+		if o.FieldName == "__key__" {
+			cmp = compareKeys(ak, bk)
+		} else {
+			desc := o.Direction == descending
+			cmp = compareSortValues(sortValue(a, o.FieldName, desc), sortValue(b, o.FieldName, desc))
+		}
+		if cmp != 0 {
+			if o.Direction == descending {
+				return -cmp
+			}
+			return cmp
+		}
+	}
+	return compareKeys(ak, bk)
+}
+
+// sortValue returns the value of e's name property that the datastore sorts
+// e by: the least of a multi-valued property's values when sorting in
+// ascending order, or the greatest in descending order.
+func sortValue(e *pb.EntityProto, name string, desc bool) interface{} {
+	var v interface{}
+	found := false
+	for _, p := range e.Property {
+		if p.GetName() != name {
+			continue
+		}
+		x, err := propValue(p.Value, p.GetMeaning())
+		if err != nil {
+			continue
+		}
+		if cmp := compareSortValues(x, v); !found || (desc && cmp > 0) || (!desc && cmp < 0) {
+			v, found = x, true
+		}
+	}
+	return v
+}
+
+// compareSortValues compares two values returned by propValue in the
+// datastore's sort order, in which values of different types are ordered by
+// type, returning -1, 0 or +1.
+func compareSortValues(a, b interface{}) int {
+	if ra, rb := sortTypeRank(a), sortTypeRank(b); ra != rb {
+		if ra < rb {
+			return -1
+		}
+		return +1
+	}
+	switch a := a.(type) {
+	case *Key:
+		return compareKeys(a, b.(*Key))
+	case appengine.GeoPoint:
+		b := b.(appengine.GeoPoint)
+		if a.Lat != b.Lat {
+			return compareFloats(a.Lat, b.Lat)
+		}
+		return compareFloats(a.Lng, b.Lng)
+	}
+	cmp, _ := compareValues(a, b)
+	return cmp
+}
+
+// sortTypeRank returns the position of v's type in the datastore's ordering
+// of values of different types.
+func sortTypeRank(v interface{}) int {
+	switch v.(type) {
+	case nil:
+		return 0
+	case int64, time.Time:
+		return 1
+	case bool:
+		return 2
+	case string, appengine.BlobKey, ByteString, []byte:
+		return 3
+	case float64:
+		return 4
+	case appengine.GeoPoint:
+		return 5
+	case *Key:
+		return 7
+	}
+	return 8
+}
+
+// compareKeys compares two keys in the datastore's key order: element by
+// element from the root, by kind, then with integer IDs before string IDs,
+// with an ancestor before its descendants. It returns -1, 0 or +1.
+func compareKeys(a, b *Key) int {
+	ka, kb := keyPath(a), keyPath(b)
+	for i := 0; i < len(ka) && i < len(kb); i++ {
+		x, y := ka[i], kb[i]
+		if cmp := compareStrings(x.kind, y.kind); cmp != 0 {
+			return cmp
+		}
+		switch {
+		case x.stringID == "" && y.stringID != "":
+			return -1
+		case x.stringID != "" && y.stringID == "":
+			return +1
+		case x.stringID != "":
+			if cmp := compareStrings(x.stringID, y.stringID); cmp != 0 {
+				return cmp
+			}
+		case x.intID < y.intID:
+			return -1
+		case x.intID > y.intID:
+			return +1
+		}
+	}
+	switch {
+	case len(ka) < len(kb):
+		return -1
+	case len(ka) > len(kb):
+		return +1
+	}
+	return 0
+}
+
+// keyPath returns k and its ancestors, root first.
+func keyPath(k *Key) []*Key {
+	var path []*Key
+	for ; k != nil; k = k.parent {
+		path = append(path, k)
+	}
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return path
+}
+
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return +1
+	}
+	return 0
+}
+
+// window applies the query's offset and limit to results gathered in memory.
+func (q *Query) window(results []*pb.EntityProto) []*pb.EntityProto {
+	if int(q.offset) < len(results) {
+		results = results[q.offset:]
+	} else {
+		results = nil
+	}
+	if q.limit >= 0 && int(q.limit) < len(results) {
+		results = results[:q.limit]
+	}
+	return results
+}
+
+// maxInMemoryEntities is the most entities that a FilterInMemory query may
+// fetch before filtering them.
+const maxInMemoryEntities = 1000
+
+// runInMemory runs a query that has FilterInMemory filters, by running it
+// without them and filtering the resulting entities in memory.
+func (q *Query) runInMemory(c appengine.Context) *Iterator {
+	t := &Iterator{
+		c:     c,
+		limit: -1,
+		q:     q,
+	}
+	if q.start != nil || q.end != nil {
+		t.err = errors.New("datastore: FilterInMemory queries cannot be used with cursors")
+		return t
+	}
+	if len(q.projection) != 0 {
+		t.err = errors.New("datastore: FilterInMemory queries cannot be projection queries")
+		return t
+	}
+	appID := c.FullyQualifiedAppID()
+	want := make([]interface{}, len(q.memFilter))
+	for i, f := range q.memFilter {
+		p, errStr := valueToProto(appID, f.FieldName, reflect.ValueOf(f.Value), false)
+		if errStr != "" {
+			t.err = errors.New("datastore: bad query filter value type: " + errStr)
+			return t
+		}
+		var err error
+		if want[i], err = propValue(p.Value, p.GetMeaning()); err != nil {
+			t.err = err
+			return t
+		}
+	}
+
+	base := q.clone()
+	base.memFilter = nil
+	base.keysOnly = false
+	base.offset = 0
+	base.limit = maxInMemoryEntities + 1
+	var results []*pb.EntityProto
+	for st, n := base.Run(c), 0; ; n++ {
+		_, e, err := st.next()
+		if err == Done {
+			break
+		}
+		if err != nil {
+			t.err = err
+			return t
+		}
+		if n == maxInMemoryEntities {
+			t.err = fmt.Errorf("datastore: FilterInMemory query fetched more than %d entities", maxInMemoryEntities)
+			return t
+		}
+		if q.matchesInMemory(e, want) {
+			results = append(results, e)
+		}
+	}
+	t.res.Result = q.window(results)
+	t.res.MoreResults = proto.Bool(false)
+	return t
+}
+
+// matchesInMemory returns whether e satisfies all of the query's in-memory
+// filters, whose values are given by want. As in the datastore, a filter on
+// a multi-valued property matches if any of its values does.
+func (q *Query) matchesInMemory(e *pb.EntityProto, want []interface{}) bool {
+	for i, f := range q.memFilter {
+		if !propertyMatches(e.Property, f, want[i]) && !propertyMatches(e.RawProperty, f, want[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func propertyMatches(props []*pb.Property, f filter, want interface{}) bool {
+	for _, p := range props {
+		if p.GetName() != f.FieldName {
+			continue
+		}
+		v, err := propValue(p.Value, p.GetMeaning())
+		if err != nil {
+			continue
+		}
+		cmp, ok := compareValues(v, want)
+		if !ok {
+			continue
+		}
+		switch f.Op {
+		case lessThan:
+			ok = cmp < 0
+		case lessEq:
+			ok = cmp <= 0
+		case equal:
+			ok = cmp == 0
+		case greaterEq:
+			ok = cmp >= 0
+		case greaterThan:
+			ok = cmp > 0
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// compareValues compares two values returned by propValue, returning -1, 0 or
+// +1. It returns false if they are of different types, or if they are unequal
+// values of a type that is only compared for equality.
+func compareValues(a, b interface{}) (int, bool) {
+	switch a := a.(type) {
+	case nil:
+		return 0, b == nil
+	case int64:
+		b, ok := b.(int64)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case a < b:
+			return -1, true
+		case a > b:
+			return +1, true
+		}
+		return 0, true
+	case float64:
+		b, ok := b.(float64)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case a < b:
+			return -1, true
+		case a > b:
+			return +1, true
+		}
+		return 0, true
+	case bool:
+		b, ok := b.(bool)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case !a && b:
+			return -1, true
+		case a && !b:
+			return +1, true
+		}
+		return 0, true
+	case string:
+		b, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return compareStrings(a, b), true
+	case appengine.BlobKey:
+		b, ok := b.(appengine.BlobKey)
+		if !ok {
+			return 0, false
+		}
+		return compareStrings(string(a), string(b)), true
+	case ByteString:
+		b, ok := b.(ByteString)
+		if !ok {
+			return 0, false
+		}
+		return bytes.Compare(a, b), true
+	case []byte:
+		b, ok := b.([]byte)
+		if !ok {
+			return 0, false
+		}
+		return bytes.Compare(a, b), true
+	case time.Time:
+		b, ok := b.(time.Time)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case a.Before(b):
+			return -1, true
+		case a.After(b):
+			return +1, true
+		}
+		return 0, true
+	case *Key:
+		b, ok := b.(*Key)
+		return 0, ok && a.Equal(b)
+	case appengine.GeoPoint:
+		b, ok := b.(appengine.GeoPoint)
+		return 0, ok && a == b
+	}
+	return 0, false
+}
+
+func compareStrings(a, b string) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return +1
+	}
+	return 0
+}
+
 // Iterator is the result of running a query.
 type Iterator struct {
 	c   appengine.Context
@@ -559,6 +1457,38 @@ type Iterator struct {
 	// prevCC is the compiled cursor that marks the end of the previous batch
 	// of results.
 	prevCC *pb.CompiledCursor
+	// pending is the batch following res that is being prefetched, if any.
+	pending *prefetchedBatch
+}
+
+// prefetchedBatch is a batch of results fetched in the background for a
+// Prefetch query. Once the Next API call completes, its error is sent on errc
+// and res holds its result.
+type prefetchedBatch struct {
+	res  pb.QueryResult
+	errc chan error
+}
+
+// startPrefetch starts fetching the batch following t.res, if the query is a
+// Prefetch query and there is one. It is called once the caller has taken the
+// last result of t.res, and so is likely to want the next batch.
+func (t *Iterator) startPrefetch() {
+	if !t.q.prefetch || !t.res.GetMoreResults() {
+		return
+	}
+	p := &prefetchedBatch{
+		res: pb.QueryResult{
+			Cursor:         t.res.Cursor,
+			CompiledCursor: t.res.CompiledCursor,
+		},
+		errc: make(chan error, 1),
+	}
+	// The goroutine must not touch t, which Restart may overwrite.
+	c, limit := t.c, t.limit
+	go func() {
+		p.errc <- callNext(c, &p.res, 0, limit)
+	}()
+	t.pending = p
 }
 
 // Done is returned when a query iteration has completed.
@@ -576,7 +1506,7 @@ func (t *Iterator) Next(dst interface{}) (*Key, error) {
 		return nil, err
 	}
 	if dst != nil && !t.q.keysOnly {
-		err = loadEntity(dst, e)
+		err = t.q.loadEntity(dst, e)
 	}
 	return k, err
 }
@@ -593,7 +1523,15 @@ func (t *Iterator) next() (*Key, *pb.EntityProto, error) {
 			return nil, nil, t.err
 		}
 		t.prevCC = t.res.CompiledCursor
-		if err := callNext(t.c, &t.res, 0, t.limit); err != nil {
+		var err error
+		if p := t.pending; p != nil {
+			t.pending = nil
+			err = <-p.errc
+			t.res = p.res
+		} else {
+			err = callNext(t.c, &t.res, 0, t.limit)
+		}
+		if err != nil {
 			t.err = err
 			return nil, nil, t.err
 		}
@@ -614,6 +1552,9 @@ func (t *Iterator) next() (*Key, *pb.EntityProto, error) {
 	// Extract the key from the t.i'th element of t.res.Result.
 	e := t.res.Result[t.i]
 	t.i++
+	if t.i == len(t.res.Result) {
+		t.startPrefetch()
+	}
 	if e.Key == nil {
 		return nil, nil, errors.New("datastore: internal error: server did not return a key")
 	}
@@ -624,11 +1565,32 @@ func (t *Iterator) next() (*Key, *pb.EntityProto, error) {
 	return k, e, nil
 }
 
+// Restart discards the iterator's position, including any error it has
+// encountered, and re-runs its query from the beginning. It is typically used
+// to retry a partially consumed query after a transient error.
+//
+// The query is re-run against the datastore's current contents, so if entities
+// have been added, modified or removed since the query was first run, then the
+// results may differ from those already returned.
+func (t *Iterator) Restart() {
+	if t.q == nil {
+		// The query was invalid, so there is nothing to re-run.
+		return
+	}
+	*t = *t.q.Run(t.c)
+}
+
 // Cursor returns a cursor for the iterator's current location.
 func (t *Iterator) Cursor() (Cursor, error) {
 	if t.err != nil && t.err != Done {
 		return Cursor{}, t.err
 	}
+	if t.q.in != nil {
+		return Cursor{}, errors.New("datastore: FilterIn queries do not support cursors")
+	}
+	if t.q.memFilter != nil {
+		return Cursor{}, errors.New("datastore: FilterInMemory queries do not support cursors")
+	}
 	// If we are at either end of the current batch of results,
 	// return the compiled cursor at that end.
 	skipped := t.res.GetSkippedResults()
@@ -710,3 +1672,90 @@ func DecodeCursor(s string) (Cursor, error) {
 	}
 	return Cursor{cc}, nil
 }
+
+// KindIterator scans every entity of a kind in batches, in key order, and
+// can resume the scan from a Cursor. It suits migrations and other jobs that
+// process a whole kind in chunks across requests, such as a task that handles
+// a batch, saves the Cursor, and enqueues itself to handle the next one.
+type KindIterator struct {
+	q         *Query
+	batchSize int
+	cursor    *Cursor
+	done      bool
+}
+
+// NewKindIterator returns a KindIterator over the entities of the given kind
+// that returns at most batchSize of them from each call to NextBatch.
+func NewKindIterator(kind string, batchSize int) *KindIterator {
+	q := NewQuery(kind).Order("__key__").KeysOnly()
+	if batchSize <= 0 && q.err == nil {
+		q.err = fmt.Errorf("datastore: NewKindIterator given a non-positive batch size: %d", batchSize)
+	}
+	return &KindIterator{q: q, batchSize: batchSize}
+}
+
+// Resume makes the scan continue from a cursor previously returned by the
+// Cursor method of a KindIterator for the same kind.
+func (it *KindIterator) Resume(c Cursor) {
+	it.cursor = &c
+	it.done = false
+}
+
+// NextBatch returns the keys of the next batch of entities and sets dst, a
+// pointer to a slice of a type that GetMulti accepts, to a new slice holding
+// the entities. It returns Done when the scan is complete.
+//
+// The keys are found by a keys-only query and the entities loaded with
+// GetMulti, so an entity deleted in between makes NextBatch return an
+// appengine.MultiError holding ErrNoSuchEntity for it, as GetMulti does,
+// along with the keys; the scan can still continue.
+func (it *KindIterator) NextBatch(c appengine.Context, dst interface{}) ([]*Key, error) {
+	if it.done {
+		return nil, Done
+	}
+	dv := reflect.ValueOf(dst)
+	if dv.Kind() != reflect.Ptr || dv.IsNil() || dv.Elem().Kind() != reflect.Slice {
+		return nil, ErrInvalidEntityType
+	}
+	q := it.q.Limit(it.batchSize)
+	if it.cursor != nil {
+		q = q.Start(*it.cursor)
+	}
+	t := q.Run(c)
+	var keys []*Key
+	for {
+		k, err := t.Next(nil)
+		if err == Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	cursor, err := t.Cursor()
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		it.done = true
+		return nil, Done
+	}
+	it.cursor = &cursor
+	it.done = len(keys) < it.batchSize
+
+	slice := reflect.MakeSlice(dv.Elem().Type(), len(keys), len(keys))
+	err = GetMulti(c, keys, slice.Interface())
+	dv.Elem().Set(slice)
+	return keys, err
+}
+
+// Cursor returns the position after the last batch returned by NextBatch,
+// from which Resume continues the scan. Before the first batch, it returns
+// the position that Resume was given, if any, or the start of the kind.
+func (it *KindIterator) Cursor() Cursor {
+	if it.cursor == nil {
+		return Cursor{&zeroCC}
+	}
+	return *it.cursor
+}
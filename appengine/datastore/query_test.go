@@ -0,0 +1,714 @@
+// Copyright 2015 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package datastore
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	"appengine"
+	"appengine_internal"
+	pb "appengine_internal/datastore"
+)
+
+func TestCompareKeys(t *testing.T) {
+	parent := &Key{kind: "A", intID: 1}
+	// Each key sorts before the next. An ancestor sorts before its
+	// descendants, and integer IDs sort before string IDs.
+	keys := []*Key{
+		&Key{kind: "A", intID: 0},
+		parent,
+		&Key{kind: "B", intID: 5, parent: parent},
+		&Key{kind: "B", stringID: "a", parent: parent},
+		&Key{kind: "A", intID: 2},
+		&Key{kind: "A", stringID: "a"},
+		&Key{kind: "A", stringID: "b"},
+		&Key{kind: "B", intID: 1},
+	}
+	for i, a := range keys {
+		for j, b := range keys {
+			want := 0
+			switch {
+			case i < j:
+				want = -1
+			case i > j:
+				want = +1
+			}
+			if got := compareKeys(a, b); got != want {
+				t.Errorf("compareKeys(%v, %v) = %d, want %d", a, b, got, want)
+			}
+		}
+	}
+}
+
+func TestCompareResults(t *testing.T) {
+	entity := func(vals ...int64) *pb.EntityProto {
+		e := &pb.EntityProto{}
+		for _, v := range vals {
+			e.Property = append(e.Property, &pb.Property{
+				Name:     proto.String("N"),
+				Value:    &pb.PropertyValue{Int64Value: proto.Int64(v)},
+				Multiple: proto.Bool(len(vals) > 1),
+			})
+		}
+		return e
+	}
+	k1, k2 := &Key{kind: "K", intID: 1}, &Key{kind: "K", intID: 2}
+	tests := []struct {
+		q    *Query
+		a, b *pb.EntityProto
+		want int
+	}{
+		{NewQuery("K").Order("N"), entity(1), entity(2), -1},
+		{NewQuery("K").Order("-N"), entity(1), entity(2), +1},
+		// Ties are broken by key.
+		{NewQuery("K").Order("N"), entity(3), entity(3), -1},
+		{NewQuery("K").Order("-N"), entity(3), entity(3), -1},
+		// Multi-valued properties sort by their least value ascending,
+		// and by their greatest value descending.
+		{NewQuery("K").Order("N"), entity(1, 9), entity(2), -1},
+		{NewQuery("K").Order("-N"), entity(1, 9), entity(2), -1},
+		{NewQuery("K").Order("-__key__"), entity(1), entity(2), +1},
+		{NewQuery("K"), entity(2), entity(1), -1},
+	}
+	for i, tt := range tests {
+		if got := tt.q.compareResults(k1, tt.a, k2, tt.b); got != tt.want {
+			t.Errorf("%d: compareResults = %d, want %d", i, got, tt.want)
+		}
+	}
+}
+
+func TestQueryString(t *testing.T) {
+	ancestor := &Key{kind: "Gopher", stringID: "tom"}
+	when := time.Date(2015, 4, 1, 12, 30, 0, 0, time.UTC)
+	tests := []struct {
+		q    *Query
+		want string
+	}{
+		{
+			NewQuery("Gopher"),
+			"SELECT * FROM Gopher",
+		},
+		{
+			NewQuery(""),
+			"SELECT *",
+		},
+		{
+			NewQuery("Gopher").KeysOnly(),
+			"SELECT __key__ FROM Gopher",
+		},
+		{
+			NewQuery("Gopher").Project("Name", "Age").Distinct(),
+			"SELECT DISTINCT Name, Age FROM Gopher",
+		},
+		{
+			NewQuery("Gopher").Project("Name", "Age").DistinctOn("Name"),
+			"SELECT DISTINCT ON (Name) Name, Age FROM Gopher",
+		},
+		{
+			NewQuery("Gopher").Filter("Name =", "fred").Filter("Age >=", 3).Filter("Born <", when),
+			`SELECT * FROM Gopher WHERE Name = "fred" AND Age >= 3 AND Born < DATETIME(2015-04-01T12:30:00Z)`,
+		},
+		{
+			NewQuery("Gopher").Filter("Friend =", (*Key)(nil)).Filter("Tag =", nil),
+			"SELECT * FROM Gopher WHERE Friend = NULL AND Tag = NULL",
+		},
+		{
+			NewQuery("Gopher").FilterIn("Color", "red", "blue"),
+			`SELECT * FROM Gopher WHERE Color IN ("red", "blue")`,
+		},
+		{
+			NewQuery("Gopher").Ancestor(ancestor),
+			"SELECT * FROM Gopher WHERE __key__ HAS ANCESTOR KEY(/Gopher,tom)",
+		},
+		{
+			NewQuery("Gopher").Filter("Age >", 3).Ancestor(ancestor),
+			"SELECT * FROM Gopher WHERE Age > 3 AND __key__ HAS ANCESTOR KEY(/Gopher,tom)",
+		},
+		{
+			NewQuery("Gopher").Filter("Age >", 3).FilterInMemory("Name <=", "m"),
+			`SELECT * FROM Gopher WHERE Age > 3 IN MEMORY WHERE Name <= "m"`,
+		},
+		{
+			NewQuery("Gopher").Order("Name").Order("-Age"),
+			"SELECT * FROM Gopher ORDER BY Name, Age DESC",
+		},
+		{
+			NewQuery("Gopher").Limit(10),
+			"SELECT * FROM Gopher LIMIT 10",
+		},
+		{
+			NewQuery("Gopher").Limit(0),
+			"SELECT * FROM Gopher LIMIT 0",
+		},
+		{
+			NewQuery("Gopher").Offset(5),
+			"SELECT * FROM Gopher OFFSET 5",
+		},
+		{
+			NewQuery("Gopher").Filter("Age >", 3).Order("-Age").Limit(10).Offset(20),
+			"SELECT * FROM Gopher WHERE Age > 3 ORDER BY Age DESC LIMIT 10 OFFSET 20",
+		},
+	}
+	for _, tt := range tests {
+		if got := tt.q.String(); got != tt.want {
+			t.Errorf("String() = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+// batchContext serves RunQuery and Next calls from batches of keys-only
+// results, recording the number of Next calls it receives.
+type batchContext struct {
+	appengine.Context
+	batches [][]int64     // the integer IDs of each batch's keys
+	latency time.Duration // how long each call takes
+
+	mu    sync.Mutex
+	nexts int
+}
+
+func (c *batchContext) FullyQualifiedAppID() string { return "dev~app" }
+
+func (c *batchContext) Call(service, method string, in, out appengine_internal.ProtoMessage, opts *appengine_internal.CallOptions) error {
+	time.Sleep(c.latency)
+	var i uint64
+	switch method {
+	case "RunQuery":
+	case "Next":
+		c.mu.Lock()
+		c.nexts++
+		c.mu.Unlock()
+		i = in.(*pb.NextRequest).Cursor.GetCursor()
+	default:
+		return fmt.Errorf("unexpected %s.%s call", service, method)
+	}
+	res := out.(*pb.QueryResult)
+	res.Cursor = &pb.Cursor{Cursor: proto.Uint64(i + 1)}
+	res.MoreResults = proto.Bool(int(i+1) < len(c.batches))
+	for _, id := range c.batches[i] {
+		k := &Key{kind: "Gopher", intID: id, appID: c.FullyQualifiedAppID()}
+		res.Result = append(res.Result, &pb.EntityProto{Key: keyToProto("", k)})
+	}
+	return nil
+}
+
+func (c *batchContext) nextCalls() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.nexts
+}
+
+func TestPrefetch(t *testing.T) {
+	c := &batchContext{batches: [][]int64{{1, 2}, {3, 4}, {5}}}
+	it := NewQuery("Gopher").KeysOnly().Prefetch().Run(c)
+	var got []int64
+	next := func() {
+		k, err := it.Next(nil)
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		got = append(got, k.IntID())
+	}
+
+	// Part way through a batch, nothing is fetched ahead, so an abandoned
+	// iterator issues no further calls.
+	next()
+	if it.pending != nil {
+		t.Fatal("prefetch started before the batch's last result was taken")
+	}
+
+	// Taking a batch's last result starts fetching the next.
+	next()
+	if it.pending == nil {
+		t.Fatal("prefetch not started after the batch's last result was taken")
+	}
+
+	for {
+		k, err := it.Next(nil)
+		if err == Done {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		got = append(got, k.IntID())
+	}
+	if want := []int64{1, 2, 3, 4, 5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got IDs %v, want %v", got, want)
+	}
+	// The final batch has no successor, so there is no call beyond it.
+	if n := c.nextCalls(); n != 2 {
+		t.Errorf("got %d Next calls, want 2", n)
+	}
+}
+
+// keyRangeContext serves RunQuery calls for keys-only queries on a kind
+// holding entities with the integer IDs in ids, applying the queries'
+// __key__ filters and limits. It records the filters of each query.
+type keyRangeContext struct {
+	appengine.Context
+	ids     []int64 // in ascending order
+	filters [][]*pb.Query_Filter
+}
+
+func (c *keyRangeContext) FullyQualifiedAppID() string { return "dev~app" }
+
+func (c *keyRangeContext) Call(service, method string, in, out appengine_internal.ProtoMessage, opts *appengine_internal.CallOptions) error {
+	if method != "RunQuery" {
+		return fmt.Errorf("unexpected %s.%s call", service, method)
+	}
+	req, res := in.(*pb.Query), out.(*pb.QueryResult)
+	c.filters = append(c.filters, req.Filter)
+	res.Cursor = &pb.Cursor{Cursor: proto.Uint64(1)}
+	res.MoreResults = proto.Bool(false)
+	for _, id := range c.ids {
+		if req.Limit != nil && len(res.Result) == int(req.GetLimit()) {
+			break
+		}
+		k := &Key{kind: req.GetKind(), intID: id, appID: c.FullyQualifiedAppID()}
+		match := true
+		for _, f := range req.Filter {
+			p := f.Property[0]
+			if p.GetName() != "__key__" {
+				return fmt.Errorf("unexpected filter on %q", p.GetName())
+			}
+			fk, err := referenceValueToKey(p.Value.Referencevalue)
+			if err != nil {
+				return err
+			}
+			switch f.GetOp() {
+			case pb.Query_Filter_GREATER_THAN:
+				match = match && id > fk.IntID()
+			case pb.Query_Filter_GREATER_THAN_OR_EQUAL:
+				match = match && id >= fk.IntID()
+			case pb.Query_Filter_EQUAL:
+				match = match && id == fk.IntID()
+			default:
+				return fmt.Errorf("unexpected filter operator %v", f.GetOp())
+			}
+		}
+		if match {
+			res.Result = append(res.Result, &pb.EntityProto{Key: keyToProto("", k)})
+		}
+	}
+	return nil
+}
+
+func TestKeyRangePagination(t *testing.T) {
+	c := &keyRangeContext{ids: []int64{1, 2, 3, 5, 8, 13, 21}}
+	var (
+		got  []int64
+		last *Key
+	)
+	for {
+		q := NewQuery("Gopher").KeysOnly().Order("__key__").Limit(3)
+		if last != nil {
+			q = q.Filter("__key__ >", last)
+		}
+		keys, err := q.GetAll(c, nil)
+		if err != nil {
+			t.Fatalf("GetAll: %v", err)
+		}
+		if len(keys) == 0 {
+			break
+		}
+		for _, k := range keys {
+			got = append(got, k.IntID())
+		}
+		last = keys[len(keys)-1]
+	}
+	if !reflect.DeepEqual(got, c.ids) {
+		t.Errorf("got IDs %v, want %v", got, c.ids)
+	}
+	// The first page has no filter; each later one starts after the
+	// previous page's last key.
+	if n := len(c.filters); n != 4 {
+		t.Fatalf("got %d queries, want 4", n)
+	}
+	if len(c.filters[0]) != 0 {
+		t.Errorf("first page has filters %v, want none", c.filters[0])
+	}
+	for i, after := range []int64{3, 13, 21} {
+		fs := c.filters[i+1]
+		if len(fs) != 1 || fs[0].GetOp() != pb.Query_Filter_GREATER_THAN {
+			t.Errorf("page %d: got filters %v, want one __key__ > filter", i+2, fs)
+			continue
+		}
+		if k, err := referenceValueToKey(fs[0].Property[0].Value.Referencevalue); err != nil || k.IntID() != after {
+			t.Errorf("page %d: filter key %v (error %v), want ID %d", i+2, k, err, after)
+		}
+	}
+}
+
+func TestKeyFilterErrors(t *testing.T) {
+	c := &keyRangeContext{ids: []int64{1}}
+	here := &Key{kind: "Gopher", intID: 1, appID: "dev~app"}
+	tests := []struct {
+		desc string
+		q    *Query
+	}{
+		{"nil key", NewQuery("Gopher").Filter("__key__ >", (*Key)(nil))},
+		{"incomplete key", NewQuery("Gopher").Filter("__key__ >", &Key{kind: "Gopher", appID: "dev~app"})},
+		{"non-key value", NewQuery("Gopher").Filter("__key__ >", 1)},
+		{"key in another app", NewQuery("Gopher").Filter("__key__ >", &Key{kind: "Gopher", intID: 1, appID: "dev~other"})},
+		{"key in another namespace", NewQuery("Gopher").Filter("__key__ >", &Key{kind: "Gopher", intID: 1, appID: "dev~app", namespace: "ns"})},
+		{"FilterIn nil key", NewQuery("Gopher").FilterIn("__key__", here, (*Key)(nil))},
+		{"FilterIn incomplete key", NewQuery("Gopher").FilterIn("__key__", &Key{kind: "Gopher", appID: "dev~app"})},
+		{"FilterIn non-key value", NewQuery("Gopher").FilterIn("__key__", "k")},
+	}
+	for _, tt := range tests {
+		if _, err := tt.q.KeysOnly().GetAll(c, nil); err == nil {
+			t.Errorf("%s: GetAll succeeded, want error", tt.desc)
+		}
+	}
+	for _, q := range []*Query{
+		NewQuery("Gopher").Filter("__key__ >=", here),
+		NewQuery("Gopher").FilterIn("__key__", here),
+	} {
+		if keys, err := q.KeysOnly().GetAll(c, nil); err != nil || len(keys) != 1 {
+			t.Errorf("%v: GetAll = %v, %v; want one key", q, keys, err)
+		}
+	}
+}
+
+func TestPrefetchRestart(t *testing.T) {
+	c := &batchContext{batches: [][]int64{{1}, {2}}}
+	it := NewQuery("Gopher").KeysOnly().Prefetch().Run(c)
+	// Taking the first batch's only result starts a prefetch, which Restart
+	// must not interfere with.
+	if _, err := it.Next(nil); err != nil {
+		t.Fatalf("Next: %v", err)
+	}
+	it.Restart()
+	var got []int64
+	for {
+		k, err := it.Next(nil)
+		if err == Done {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		got = append(got, k.IntID())
+	}
+	if want := []int64{1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got IDs %v, want %v", got, want)
+	}
+}
+
+// benchmarkScan scans a query of 20 batches of 4 results, where each API call
+// takes a millisecond and the caller spends half a millisecond on each result.
+func benchmarkScan(b *testing.B, prefetch bool) {
+	c := &batchContext{latency: time.Millisecond}
+	for i := int64(0); i < 20; i++ {
+		c.batches = append(c.batches, []int64{4*i + 1, 4*i + 2, 4*i + 3, 4*i + 4})
+	}
+	q := NewQuery("Gopher").KeysOnly()
+	if prefetch {
+		q = q.Prefetch()
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		it := q.Run(c)
+		for {
+			_, err := it.Next(nil)
+			if err == Done {
+				break
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+			time.Sleep(time.Millisecond / 2)
+		}
+	}
+}
+
+func BenchmarkScan(b *testing.B)         { benchmarkScan(b, false) }
+func BenchmarkScanPrefetch(b *testing.B) { benchmarkScan(b, true) }
+
+func TestMergeJoin(t *testing.T) {
+	type Gopher struct {
+		Color string
+		Size  int
+	}
+	c := newMemContext()
+	gophers := []Gopher{
+		{"blue", 1}, {"blue", 2}, {"green", 2}, {"blue", 2}, {"green", 1},
+	}
+	keys := make([]*Key, len(gophers))
+	for i := range keys {
+		keys[i] = NewKey(c, "Gopher", "", int64(i+1), nil)
+	}
+	if _, err := PutMulti(c, keys, gophers); err != nil {
+		t.Fatalf("PutMulti: %v", err)
+	}
+	c.calls = nil
+
+	q := NewQuery("Gopher").Filter("Color =", "blue").Filter("Size =", 2).MergeJoin()
+	var got []Gopher
+	gotKeys, err := q.GetAll(c, &got)
+	if err != nil {
+		t.Fatalf("GetAll: %v", err)
+	}
+	if len(gotKeys) != 2 || gotKeys[0].IntID() != 2 || gotKeys[1].IntID() != 4 {
+		t.Errorf("got keys %v, want IDs 2 and 4", gotKeys)
+	}
+	for _, g := range got {
+		if g != (Gopher{"blue", 2}) {
+			t.Errorf("got %+v, want a blue gopher of size 2", g)
+		}
+	}
+
+	// Both filters are sent in the one query, with the merge-join hint.
+	if m := c.methods(); !reflect.DeepEqual(m, []string{"RunQuery"}) {
+		t.Fatalf("got calls %v, want a single RunQuery", m)
+	}
+	req := c.calls[0].in.(*pb.Query)
+	if len(req.Filter) != 2 {
+		t.Errorf("got %d filters, want 2", len(req.Filter))
+	}
+	if req.GetHint() != pb.Query_FILTER_FIRST {
+		t.Errorf("got hint %v, want %v", req.GetHint(), pb.Query_FILTER_FIRST)
+	}
+
+	// A query without equality filters on two properties cannot be merge-joined.
+	for _, q := range []*Query{
+		NewQuery("Gopher").MergeJoin(),
+		NewQuery("Gopher").Filter("Color =", "blue").Filter("Color =", "green").MergeJoin(),
+		NewQuery("Gopher").Filter("Color =", "blue").Filter("Size >", 1).MergeJoin(),
+	} {
+		if _, err := q.GetAll(c, nil); err == nil {
+			t.Errorf("%v: got no error, want one", q)
+		}
+	}
+}
+
+func TestDistinctOn(t *testing.T) {
+	tests := []struct {
+		desc        string
+		q           *Query
+		wantGroupBy []string
+		wantErr     bool
+	}{
+		{
+			desc:        "subset of the projection",
+			q:           NewQuery("Post").Project("Tag", "Author").DistinctOn("Tag"),
+			wantGroupBy: []string{"Tag"},
+		},
+		{
+			desc:        "whole projection",
+			q:           NewQuery("Post").Project("Tag", "Author").DistinctOn("Author", "Tag"),
+			wantGroupBy: []string{"Author", "Tag"},
+		},
+		{
+			desc:    "field not projected",
+			q:       NewQuery("Post").Project("Tag").DistinctOn("Author"),
+			wantErr: true,
+		},
+		{
+			desc:    "not a projection query",
+			q:       NewQuery("Post").DistinctOn("Tag"),
+			wantErr: true,
+		},
+		{
+			desc:    "with Distinct",
+			q:       NewQuery("Post").Project("Tag").Distinct().DistinctOn("Tag"),
+			wantErr: true,
+		},
+		{
+			desc:    "no fields",
+			q:       NewQuery("Post").Project("Tag").DistinctOn(),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		var req pb.Query
+		err := tt.q.err
+		if err == nil {
+			err = tt.q.toProto(&req, "dev~app")
+		}
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, want error = %v", tt.desc, err, tt.wantErr)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(req.GroupByPropertyName, tt.wantGroupBy) {
+			t.Errorf("%s: got group-by %v, want %v", tt.desc, req.GroupByPropertyName, tt.wantGroupBy)
+		}
+	}
+
+	// One entity per tag is returned.
+	type Post struct {
+		Tag    string
+		Author string
+	}
+	c := newMemContext()
+	posts := []Post{{"go", "ann"}, {"go", "bob"}, {"gae", "bob"}, {"go", "cat"}, {"gae", "ann"}}
+	for i := range posts {
+		if _, err := Put(c, NewKey(c, "Post", "", int64(i+1), nil), &posts[i]); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	var got []Post
+	_, err := NewQuery("Post").Project("Tag", "Author").DistinctOn("Tag").Order("Tag").GetAll(c, &got)
+	if err != nil {
+		t.Fatalf("GetAll: %v", err)
+	}
+	if want := []Post{{"gae", "bob"}, {"go", "ann"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestFilterInMemory(t *testing.T) {
+	type Gopher struct {
+		Color string
+		Size  int `datastore:",noindex"`
+	}
+	c := newMemContext()
+	gophers := []Gopher{{"blue", 1}, {"blue", 3}, {"green", 5}, {"blue", 4}, {"blue", 2}}
+	keys := make([]*Key, len(gophers))
+	for i := range keys {
+		keys[i] = NewKey(c, "Gopher", "", int64(i+1), nil)
+	}
+	if _, err := PutMulti(c, keys, gophers); err != nil {
+		t.Fatalf("PutMulti: %v", err)
+	}
+
+	base := NewQuery("Gopher").Filter("Color =", "blue")
+	tests := []struct {
+		desc    string
+		q       *Query
+		wantIDs []int64
+		wantErr string
+	}{
+		{"unindexed field", NewQuery("Gopher").FilterInMemory("Size >", 2), []int64{2, 3, 4}, ""},
+		{"with a datastore filter", base.FilterInMemory("Size >", 2), []int64{2, 4}, ""},
+		{"two in-memory filters", base.FilterInMemory("Size >", 1).FilterInMemory("Size <=", 3), []int64{2, 5}, ""},
+		{"equality", base.FilterInMemory("Size =", 4), []int64{4}, ""},
+		{"keys only", base.FilterInMemory("Size >", 2).KeysOnly(), []int64{2, 4}, ""},
+		{"offset and limit", base.FilterInMemory("Size >", 1).Offset(1).Limit(1), []int64{4}, ""},
+		{"sort order", base.FilterInMemory("Size >", 1).Order("-__key__"), []int64{5, 4, 2}, ""},
+		{"no matches", base.FilterInMemory("Size >", 10), nil, ""},
+		{"cursor", base.FilterInMemory("Size >", 1).Start(Cursor{&pb.CompiledCursor{}}), nil, "cannot be used with cursors"},
+		{"projection", base.FilterInMemory("Size >", 1).Project("Color"), nil, "cannot be projection queries"},
+		{"bad operator", base.FilterInMemory("Size ~", 1), nil, "invalid operator"},
+	}
+	for _, tt := range tests {
+		keys, err := tt.q.GetAll(c, &[]Gopher{})
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: got error %v, want one containing %q", tt.desc, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.desc, err)
+			continue
+		}
+		var ids []int64
+		for _, k := range keys {
+			ids = append(ids, k.IntID())
+		}
+		if !reflect.DeepEqual(ids, tt.wantIDs) {
+			t.Errorf("%s: got IDs %v, want %v", tt.desc, ids, tt.wantIDs)
+		}
+		if n, err := tt.q.Count(c); err != nil || n != len(tt.wantIDs) {
+			t.Errorf("%s: Count = %d, %v, want %d", tt.desc, n, err, len(tt.wantIDs))
+		}
+	}
+
+	// Too many entities to filter in memory is an error.
+	many := make([]Gopher, maxInMemoryEntities+1-len(gophers))
+	manyKeys := make([]*Key, len(many))
+	for i := range manyKeys {
+		manyKeys[i] = NewKey(c, "Gopher", "", int64(100+i), nil)
+	}
+	if _, err := PutMulti(c, manyKeys, many); err != nil {
+		t.Fatalf("PutMulti: %v", err)
+	}
+	if _, err := NewQuery("Gopher").FilterInMemory("Size >", 2).GetAll(c, &[]Gopher{}); err == nil || !strings.Contains(err.Error(), "fetched more than") {
+		t.Errorf("too many entities: got error %v, want one about the limit", err)
+	}
+}
+
+func TestKindIteratorResume(t *testing.T) {
+	type Gopher struct {
+		N int
+	}
+	c := newMemContext()
+	const n = 7
+	keys := make([]*Key, n)
+	gophers := make([]Gopher, n)
+	for i := range keys {
+		keys[i] = NewKey(c, "Gopher", "", int64(i+1), nil)
+		gophers[i] = Gopher{i + 1}
+	}
+	if _, err := PutMulti(c, keys, gophers); err != nil {
+		t.Fatalf("PutMulti: %v", err)
+	}
+
+	// nextIDs returns the IDs of the next batch, checking them against
+	// the loaded entities.
+	nextIDs := func(it *KindIterator) ([]int64, error) {
+		var dst []Gopher
+		batch, err := it.NextBatch(c, &dst)
+		if err != nil {
+			return nil, err
+		}
+		if len(dst) != len(batch) {
+			t.Fatalf("got %d entities for %d keys", len(dst), len(batch))
+		}
+		var ids []int64
+		for i, k := range batch {
+			if int64(dst[i].N) != k.IntID() {
+				t.Errorf("key %v loaded %+v", k, dst[i])
+			}
+			ids = append(ids, k.IntID())
+		}
+		return ids, nil
+	}
+
+	it := NewKindIterator("Gopher", 3)
+	ids, err := nextIDs(it)
+	if err != nil {
+		t.Fatalf("first NextBatch: %v", err)
+	}
+	if !reflect.DeepEqual(ids, []int64{1, 2, 3}) {
+		t.Errorf("first batch: got IDs %v, want [1 2 3]", ids)
+	}
+
+	// A new iterator resumed from the saved cursor, as a later request
+	// would do, covers exactly the remaining entities.
+	cursor := it.Cursor()
+	it = NewKindIterator("Gopher", 3)
+	it.Resume(cursor)
+	var rest []int64
+	for {
+		ids, err := nextIDs(it)
+		if err == Done {
+			break
+		}
+		if err != nil {
+			t.Fatalf("NextBatch: %v", err)
+		}
+		rest = append(rest, ids...)
+	}
+	if want := []int64{4, 5, 6, 7}; !reflect.DeepEqual(rest, want) {
+		t.Errorf("resumed scan: got IDs %v, want %v", rest, want)
+	}
+	if _, err := nextIDs(it); err != Done {
+		t.Errorf("NextBatch after the end: got %v, want Done", err)
+	}
+
+	if _, err := nextIDs(NewKindIterator("Gopher", 0)); err == nil {
+		t.Error("zero batch size: got no error")
+	}
+}
@@ -9,7 +9,9 @@ import (
 	"fmt"
 	"math"
 	"reflect"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"appengine"
 	"github.com/golang/protobuf/proto"
@@ -138,6 +140,19 @@ func saveStructProperty(c chan<- Property, name string, noIndex, multiple bool,
 		NoIndex:  noIndex,
 		Multiple: multiple,
 	}
+	if isNilConverterPtr(v) {
+		c <- p
+		return nil
+	}
+	if pc, ok := propertyConverter(v); ok {
+		cp, err := pc.ToProperty()
+		if err != nil {
+			return fmt.Errorf("datastore: converting field %q: %v", name, err)
+		}
+		p.Value, p.NoIndex = cp.Value, p.NoIndex || cp.NoIndex
+		c <- p
+		return nil
+	}
 	switch x := v.Interface().(type) {
 	case *Key:
 		p.Value = x
@@ -201,8 +216,38 @@ func (s structPLS) save(c chan<- Property, prefix string, noIndex, multiple bool
 			continue
 		}
 		noIndex1 := noIndex || t.noIndex
+		if t.asString {
+			saveEnum(c, name, noIndex1, multiple, v)
+			continue
+		}
+		if t.lower {
+			saveLower(c, name+lowerSuffix, noIndex1, multiple, v)
+		}
+		if t.transform != nil {
+			if err := saveTransformed(c, name, multiple, v, t.transform); err != nil {
+				return err
+			}
+			continue
+		}
+		// A nil pointer to a nested struct is saved as no properties at all.
+		if isNestedStructPtr(v.Type()) {
+			if v.IsNil() {
+				continue
+			}
+			v = v.Elem()
+		}
 		// For slice fields that aren't []byte, save each element.
-		if v.Kind() == reflect.Slice && v.Type().Elem().Kind() != reflect.Uint8 {
+		if _, ok := propertyConverter(v); !ok && v.Kind() == reflect.Slice && v.Type().Elem().Kind() != reflect.Uint8 {
+			if v.Len() == 0 && !v.IsNil() && v.Type().Elem().Kind() == reflect.String {
+				// An empty, non-nil []string is saved as a marker, so
+				// that it loads back as empty rather than nil.
+				c <- Property{
+					Name:    name + emptySliceSuffix,
+					Value:   true,
+					NoIndex: true,
+				}
+				continue
+			}
 			for j := 0; j < v.Len(); j++ {
 				if err := saveStructProperty(c, name, noIndex1, true, v.Index(j)); err != nil {
 					return err
@@ -218,6 +263,112 @@ func (s structPLS) save(c chan<- Property, prefix string, noIndex, multiple bool
 	return nil
 }
 
+// saveEnum saves an "asstring" struct field, or each element of one that is
+// a slice, as the string returned by its String method.
+func saveEnum(c chan<- Property, name string, noIndex, multiple bool, v reflect.Value) {
+	if v.Kind() != reflect.Slice {
+		c <- Property{
+			Name:     name,
+			Value:    v.Interface().(fmt.Stringer).String(),
+			NoIndex:  noIndex,
+			Multiple: multiple,
+		}
+		return
+	}
+	for j := 0; j < v.Len(); j++ {
+		saveEnum(c, name, noIndex, true, v.Index(j))
+	}
+}
+
+// saveTransformed saves a struct field with a RegisterFieldCodec option as
+// the unindexed bytes returned by the codec's encode function.
+func saveTransformed(c chan<- Property, name string, multiple bool, v reflect.Value, vc *valueCodec) error {
+	var b []byte
+	if v.Kind() == reflect.String {
+		b = []byte(v.String())
+	} else {
+		b = v.Bytes()
+	}
+	x, err := vc.encode(b)
+	if err != nil {
+		return fmt.Errorf("datastore: encoding field %q: %v", name, err)
+	}
+	c <- Property{
+		Name:     name,
+		Value:    x,
+		NoIndex:  true,
+		Multiple: multiple,
+	}
+	return nil
+}
+
+// saveLower saves the lowercased shadow copy of a "lower" struct field, or of
+// each element of one that is a slice.
+func saveLower(c chan<- Property, name string, noIndex, multiple bool, v reflect.Value) {
+	if v.Kind() != reflect.Slice {
+		c <- Property{
+			Name:     name,
+			Value:    strings.ToLower(v.String()),
+			NoIndex:  noIndex,
+			Multiple: multiple,
+		}
+		return
+	}
+	for j := 0; j < v.Len(); j++ {
+		saveLower(c, name, noIndex, true, v.Index(j))
+	}
+}
+
+// maxIndexedStringLen is the longest string, in characters, or ByteString,
+// in bytes, that can be indexed.
+const maxIndexedStringLen = 500
+
+// ValidateStruct reports whether src, a struct pointer, could be saved by Put,
+// without saving it or needing an appengine.Context. It returns the first
+// error that saving would encounter, such as an unsupported field type or too
+// many indexed properties, or if an indexed string is too long.
+func ValidateStruct(src interface{}) error {
+	// The key only needs to be well-formed enough to build the EntityProto.
+	key := &Key{kind: "ValidateStruct", appID: "validate"}
+	x, err := saveEntity(key.appID, key, src)
+	if err != nil {
+		return err
+	}
+	for _, p := range x.Property {
+		v := p.Value.StringValue
+		if v == nil {
+			continue
+		}
+		n := len(*v)
+		if p.GetMeaning() != pb.Property_BYTESTRING {
+			n = utf8.RuneCountInString(*v)
+		}
+		if n > maxIndexedStringLen {
+			return fmt.Errorf("datastore: indexed property %q is too long: %d, the limit is %d; tag it noindex", p.GetName(), n, maxIndexedStringLen)
+		}
+	}
+	return nil
+}
+
+// checkPropertyName returns an error if name cannot be used as the name of a
+// stored property. Names of the form "__*__", such as "__key__", are reserved
+// by the datastore. Dots separate the components of flattened struct fields,
+// so they may not be leading, trailing or doubled.
+func checkPropertyName(name string) error {
+	if name == "" {
+		return errors.New("datastore: empty property name")
+	}
+	if len(name) > 4 && strings.HasPrefix(name, "__") && strings.HasSuffix(name, "__") {
+		return fmt.Errorf("datastore: property name %q is reserved", name)
+	}
+	for _, s := range strings.Split(name, ".") {
+		if s == "" {
+			return fmt.Errorf("datastore: property name %q has an empty component", name)
+		}
+	}
+	return nil
+}
+
 func propertiesToProto(defaultAppID string, key *Key, src <-chan Property) (*pb.EntityProto, error) {
 	defer func() {
 		for _ = range src {
@@ -235,6 +386,9 @@ func propertiesToProto(defaultAppID string, key *Key, src <-chan Property) (*pb.
 	prevMultiple := make(map[string]bool)
 
 	for p := range src {
+		if err := checkPropertyName(p.Name); err != nil {
+			return nil, err
+		}
 		if pm, ok := prevMultiple[p.Name]; ok {
 			if !pm || !p.Multiple {
 				return nil, fmt.Errorf("datastore: multiple Properties with Name %q, but Multiple is false", p.Name)
@@ -299,10 +453,10 @@ func propertiesToProto(defaultAppID string, key *Key, src <-chan Property) (*pb.
 			e.RawProperty = append(e.RawProperty, x)
 		} else {
 			e.Property = append(e.Property, x)
-			if len(e.Property) > maxIndexedProperties {
-				return nil, errors.New("datastore: too many indexed properties")
-			}
 		}
 	}
+	if n := len(e.Property); n > MaxIndexedProperties {
+		return nil, fmt.Errorf("datastore: too many indexed properties: %d, the limit is %d", n, MaxIndexedProperties)
+	}
 	return e, nil
 }
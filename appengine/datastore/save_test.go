@@ -0,0 +1,246 @@
+// Copyright 2015 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package datastore
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEmptyStringSliceRoundTrip(t *testing.T) {
+	type Inner struct {
+		Tags []string
+	}
+	type T struct {
+		Tags  []string
+		Inner Inner
+		Ptr   *Inner
+	}
+	tests := []struct {
+		desc  string
+		src   T
+		props []Property
+	}{
+		{
+			desc:  "nil",
+			src:   T{},
+			props: nil,
+		},
+		{
+			desc: "empty",
+			src:  T{Tags: []string{}},
+			props: []Property{
+				{Name: "Tags.__empty__", Value: true, NoIndex: true},
+			},
+		},
+		{
+			desc: "populated",
+			src:  T{Tags: []string{"b", "a", "b"}},
+			props: []Property{
+				{Name: "Tags", Value: "b", Multiple: true},
+				{Name: "Tags", Value: "a", Multiple: true},
+				{Name: "Tags", Value: "b", Multiple: true},
+			},
+		},
+		{
+			desc: "nested empty",
+			src:  T{Inner: Inner{Tags: []string{}}, Ptr: &Inner{Tags: []string{}}},
+			props: []Property{
+				{Name: "Inner.Tags.__empty__", Value: true, NoIndex: true},
+				{Name: "Ptr.Tags.__empty__", Value: true, NoIndex: true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		props, err := saveProps(&tt.src)
+		if err != nil {
+			t.Errorf("%s: save: %v", tt.desc, err)
+			continue
+		}
+		if !reflect.DeepEqual(props, tt.props) {
+			t.Errorf("%s: saved %+v, want %+v", tt.desc, props, tt.props)
+		}
+		var dst T
+		if err := loadProps(&dst, props...); err != nil {
+			t.Errorf("%s: load: %v", tt.desc, err)
+			continue
+		}
+		if !reflect.DeepEqual(dst, tt.src) {
+			t.Errorf("%s: loaded %#v, want %#v", tt.desc, dst, tt.src)
+		}
+	}
+}
+
+func TestEmptyStringSliceMarker(t *testing.T) {
+	// A null element of a []string is data, not the empty marker.
+	var dst struct{ Tags []string }
+	if err := loadProps(&dst, Property{Name: "Tags", Value: nil, Multiple: true}); err != nil {
+		t.Fatalf("load null element: %v", err)
+	}
+	if !reflect.DeepEqual(dst.Tags, []string{""}) {
+		t.Errorf("load null element: Tags = %#v, want one empty string", dst.Tags)
+	}
+
+	// The marker leaves a non-empty slice as it is.
+	dst.Tags = []string{"a"}
+	if err := loadProps(&dst, Property{Name: "Tags.__empty__", Value: true, NoIndex: true}); err != nil {
+		t.Fatalf("load marker: %v", err)
+	}
+	if !reflect.DeepEqual(dst.Tags, []string{"a"}) {
+		t.Errorf("load marker into populated slice: Tags = %#v, want [a]", dst.Tags)
+	}
+
+	// A field whose name would collide with the marker is rejected.
+	type Clash struct {
+		Tags  []string
+		Other bool `datastore:"Tags.__empty__"`
+	}
+	if _, err := saveProps(&Clash{}); err == nil {
+		t.Error("struct with a field named like the empty marker: save succeeded, want error")
+	}
+}
+
+func TestCheckPropertyName(t *testing.T) {
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"A", true},
+		{"A.B.C", true},
+		{"__", true},
+		{"____", true},
+		{"_A_", true},
+		{"__A", true},
+		{"A__", true},
+		{"A.__empty__", true},
+		{"", false},
+		{"__key__", false},
+		{"__A__", false},
+		{".A", false},
+		{"A.", false},
+		{"A..B", false},
+		{".", false},
+	}
+	for _, tt := range tests {
+		if err := checkPropertyName(tt.name); (err == nil) != tt.ok {
+			t.Errorf("checkPropertyName(%q) = %v, want ok = %v", tt.name, err, tt.ok)
+		}
+	}
+
+	// A bad name is rejected when an entity is saved.
+	props := make(chan Property, 1)
+	props <- Property{Name: "__key__", Value: int64(1)}
+	close(props)
+	if _, err := propertiesToProto("dev~app", &Key{kind: "T", intID: 1}, props); err == nil {
+		t.Error("propertiesToProto: got no error for a reserved property name")
+	}
+}
+
+func TestValidateStruct(t *testing.T) {
+	type Indexed struct {
+		S []string
+	}
+	type Unindexed struct {
+		S []string `datastore:",noindex"`
+	}
+	type Bytes struct {
+		B ByteString
+	}
+	type Bad struct {
+		C chan int
+	}
+	long := strings.Repeat("x", maxIndexedStringLen)
+	many := make([]string, MaxIndexedProperties+1)
+
+	tests := []struct {
+		desc    string
+		src     interface{}
+		wantErr string
+	}{
+		{"valid", &Indexed{S: []string{"a", "b"}}, ""},
+		{"longest indexed string", &Indexed{S: []string{long}}, ""},
+		{"longest indexed string in runes", &Indexed{S: []string{strings.Repeat("é", maxIndexedStringLen)}}, ""},
+		{"indexed string too long", &Indexed{S: []string{long + "x"}}, `indexed property "S" is too long`},
+		{"unindexed long string", &Unindexed{S: []string{long + "x"}}, ""},
+		{"indexed ByteString too long", &Bytes{B: ByteString(long + "x")}, `indexed property "B" is too long`},
+		{"too many indexed values", &Indexed{S: many}, "too many indexed properties"},
+		{"too many unindexed values", &Unindexed{S: many}, ""},
+		{"unsupported field type", &Bad{}, "unsupported struct field type"},
+		{"not a struct pointer", Indexed{}, "invalid entity type"},
+	}
+	for _, tt := range tests {
+		err := ValidateStruct(tt.src)
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", tt.desc, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: got error %v, want one containing %q", tt.desc, err, tt.wantErr)
+		}
+	}
+}
+
+func TestLowerShadowProperty(t *testing.T) {
+	type T struct {
+		Name string   `datastore:",lower"`
+		Tags []string `datastore:",noindex,lower"`
+	}
+	src := T{Name: "George", Tags: []string{"Go", "GAE"}}
+	props, err := saveProps(&src)
+	if err != nil {
+		t.Fatalf("saveProps: %v", err)
+	}
+	want := []Property{
+		{Name: "Name_lower", Value: "george"},
+		{Name: "Name", Value: "George"},
+		{Name: "Tags_lower", Value: "go", NoIndex: true, Multiple: true},
+		{Name: "Tags_lower", Value: "gae", NoIndex: true, Multiple: true},
+		{Name: "Tags", Value: "Go", NoIndex: true, Multiple: true},
+		{Name: "Tags", Value: "GAE", NoIndex: true, Multiple: true},
+	}
+	if !reflect.DeepEqual(props, want) {
+		t.Errorf("saved %v, want %v", props, want)
+	}
+
+	// The shadow properties are ignored when loading, even if stale.
+	props[0].Value = "stale"
+	var dst T
+	if err := loadProps(&dst, props...); err != nil {
+		t.Fatalf("loadProps: %v", err)
+	}
+	if !reflect.DeepEqual(dst, src) {
+		t.Errorf("loaded %+v, want %+v", dst, src)
+	}
+
+	// The shadow property can be queried case-insensitively.
+	c := newMemContext()
+	for i, name := range []string{"George", "GEORGE", "Fred"} {
+		if _, err := Put(c, NewKey(c, "T", "", int64(i+1), nil), &T{Name: name}); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	if n, err := NewQuery("T").Filter("Name_lower =", "george").Count(c); err != nil || n != 2 {
+		t.Errorf("Count = %d, %v, want 2", n, err)
+	}
+
+	bad := []struct {
+		desc string
+		src  interface{}
+	}{
+		{"int field", &struct {
+			N int `datastore:",lower"`
+		}{}},
+		{"name taken", &struct {
+			Name      string `datastore:",lower"`
+			NameLower string `datastore:"Name_lower"`
+		}{}},
+	}
+	for _, tt := range bad {
+		if _, err := saveProps(tt.src); err == nil {
+			t.Errorf("%s: got no error", tt.desc)
+		}
+	}
+}
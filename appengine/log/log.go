@@ -32,6 +32,7 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"appengine"
@@ -66,12 +67,34 @@ type Query struct {
 	// application log of MinLevel or higher will be returned.
 	MinLevel int
 
+	// FilterAppLogsByLevel indicates if the AppLogs of each returned Record
+	// should be trimmed to the entries of MinLevel or higher.
+	// ApplyMinLevel selects which requests are returned, but each of their
+	// Records still holds every application log of the request, whatever its
+	// level; FilterAppLogsByLevel additionally drops those lower level lines.
+	// It has no effect unless both AppLogs and ApplyMinLevel are true.
+	FilterAppLogsByLevel bool
+
 	// Versions is the major version IDs whose logs should be retrieved.
 	// Logs for specific modules can be retrieved by the specifying versions
 	// in the form "module:version"; the default module is used if no module
 	// is specified.
 	Versions []string
 
+	// AllVersions indicates that logs for all versions of all modules should
+	// be retrieved, instead of those named by Versions. It cannot be combined
+	// with Versions. Such a query must scan the logs of every version, so
+	// narrow it with StartTime and EndTime where possible.
+	AllVersions bool
+
+	// MinStatus and MaxStatus, if non-zero, restrict the results to requests
+	// whose HTTP status code is at least MinStatus and at most MaxStatus,
+	// respectively; for example, MinStatus 500 and MaxStatus 599 select the
+	// requests that failed with a server error. The logs service cannot
+	// filter by status, so the filtering is done client-side: every record
+	// in the time range is still read, but only matching ones are returned.
+	MinStatus, MaxStatus int
+
 	// A list of requests to search for instead of a time-based scan. Cannot be
 	// combined with filtering options such as StartTime, EndTime, Offset,
 	// Incomplete, ApplyMinLevel, or Versions.
@@ -133,6 +156,19 @@ type Record struct {
 	InstanceID string
 }
 
+// AppLogsByLevel returns the application logs of the record whose level is at
+// least min, in their original order. Unlike Query.FilterAppLogsByLevel, it
+// leaves r.AppLogs unchanged.
+func (r *Record) AppLogsByLevel(min int) []AppLog {
+	var logs []AppLog
+	for _, l := range r.AppLogs {
+		if l.Level >= min {
+			logs = append(logs, l)
+		}
+	}
+	return logs
+}
+
 // Result represents the result of a query.
 type Result struct {
 	logs        []*Record
@@ -140,6 +176,15 @@ type Result struct {
 	request     *pb.LogReadRequest
 	resultsSeen bool
 	err         error
+
+	// If filterAppLogs is true, AppLogs below minLevel are dropped from
+	// each Record.
+	filterAppLogs bool
+	minLevel      int
+
+	// Records whose status is outside [minStatus, maxStatus] are dropped;
+	// a zero bound is not applied.
+	minStatus, maxStatus int
 }
 
 // Next returns the next log record,
@@ -186,6 +231,32 @@ func protoToAppLogs(logLines []*pb.LogLine) []AppLog {
 	return appLogs
 }
 
+// filterAppLogs returns the AppLogs in logs whose level is at least minLevel.
+// It reuses, and overwrites, the backing array of logs. That is safe only
+// because run calls it on the AppLogs of a Record it has just built, which
+// nothing else refers to yet.
+func filterAppLogs(logs []AppLog, minLevel int) []AppLog {
+	kept := logs[:0]
+	for _, l := range logs {
+		if l.Level >= minLevel {
+			kept = append(kept, l)
+		}
+	}
+	return kept
+}
+
+// statusInRange reports whether status satisfies the query's MinStatus and
+// MaxStatus.
+func (r *Result) statusInRange(status int32) bool {
+	if r.minStatus != 0 && int(status) < r.minStatus {
+		return false
+	}
+	if r.maxStatus != 0 && int(status) > r.maxStatus {
+		return false
+	}
+	return true
+}
+
 // protoToRecord converts a RequestLog, the internal Protocol Buffer
 // representation of a single request-level log, to a Record, its
 // corresponding external representation.
@@ -233,12 +304,54 @@ func protoToRecord(rl *pb.RequestLog) *Record {
 func (params *Query) Run(c appengine.Context) *Result {
 	req, err := makeRequest(params, c.FullyQualifiedAppID(), appengine.VersionID(c))
 	return &Result{
-		context: c,
-		request: req,
-		err:     err,
+		context:       c,
+		request:       req,
+		err:           err,
+		filterAppLogs: params.AppLogs && params.ApplyMinLevel && params.FilterAppLogsByLevel,
+		minLevel:      params.MinLevel,
+		minStatus:     params.MinStatus,
+		maxStatus:     params.MaxStatus,
 	}
 }
 
+// Stream runs the query in a new goroutine, sending each record on the
+// returned record channel. The record channel is closed when the results
+// are exhausted or an error occurs; a terminal error is then sent on the
+// error channel, which is closed once the goroutine is done.
+//
+// Calling cancel stops the goroutine early; it must be called if the
+// consumer stops receiving before the record channel is closed. It is safe
+// to call cancel more than once, and after the stream has ended.
+func (params *Query) Stream(c appengine.Context) (records <-chan *Record, errc <-chan error, cancel func()) {
+	recc := make(chan *Record)
+	ec := make(chan error, 1)
+	done := make(chan struct{})
+	var once sync.Once
+	cancel = func() { once.Do(func() { close(done) }) }
+
+	go func() {
+		defer close(ec)
+		defer close(recc)
+		res := params.Run(c)
+		for {
+			rec, err := res.Next()
+			if err == Done {
+				return
+			}
+			if err != nil {
+				ec <- err
+				return
+			}
+			select {
+			case recc <- rec:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return recc, ec, cancel
+}
+
 func makeRequest(params *Query, appID, versionID string) (*pb.LogReadRequest, error) {
 	req := &pb.LogReadRequest{}
 	req.AppId = &appID
@@ -264,7 +377,12 @@ func makeRequest(params *Query, appID, versionID string) (*pb.LogReadRequest, er
 	if params.ApplyMinLevel {
 		req.MinimumLogLevel = proto.Int32(int32(params.MinLevel))
 	}
-	if params.Versions == nil {
+	if params.AllVersions {
+		if params.Versions != nil {
+			return nil, errors.New("log: AllVersions cannot be combined with Versions")
+		}
+		// Leave both version filters unset.
+	} else if params.Versions == nil {
 		// If no versions were specified, default to the default module at
 		// the major version being used by this module.
 		if i := strings.Index(versionID, "."); i >= 0 {
@@ -306,12 +424,19 @@ func (r *Result) run() error {
 		return err
 	}
 
-	r.logs = make([]*Record, len(res.Log))
+	r.logs = make([]*Record, 0, len(res.Log))
 	r.request.Offset = res.Offset
 	r.resultsSeen = true
 
-	for i, log := range res.Log {
-		r.logs[i] = protoToRecord(log)
+	for _, log := range res.Log {
+		if !r.statusInRange(log.GetStatus()) {
+			continue
+		}
+		rec := protoToRecord(log)
+		if r.filterAppLogs {
+			rec.AppLogs = filterAppLogs(rec.AppLogs, r.minLevel)
+		}
+		r.logs = append(r.logs, rec)
 	}
 
 	return nil
@@ -0,0 +1,102 @@
+// Copyright 2015 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Levels as used by the log service: 0 is Debug and 4 is Critical.
+var testAppLogs = []AppLog{
+	{Level: 0, Message: "debug"},
+	{Level: 3, Message: "error"},
+	{Level: 1, Message: "info"},
+	{Level: 4, Message: "critical"},
+	{Level: 2, Message: "warning"},
+}
+
+func messages(logs []AppLog) []string {
+	var m []string
+	for _, l := range logs {
+		m = append(m, l.Message)
+	}
+	return m
+}
+
+func TestAppLogsByLevel(t *testing.T) {
+	tests := []struct {
+		min  int
+		want []string
+	}{
+		{0, []string{"debug", "error", "info", "critical", "warning"}},
+		{2, []string{"error", "critical", "warning"}},
+		{4, []string{"critical"}},
+		{5, nil},
+	}
+	for _, tt := range tests {
+		r := &Record{AppLogs: append([]AppLog(nil), testAppLogs...)}
+		if got := messages(r.AppLogsByLevel(tt.min)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("AppLogsByLevel(%d) = %q, want %q", tt.min, got, tt.want)
+		}
+		if !reflect.DeepEqual(r.AppLogs, testAppLogs) {
+			t.Errorf("AppLogsByLevel(%d) modified the record's AppLogs: %q", tt.min, messages(r.AppLogs))
+		}
+	}
+	if got := (&Record{}).AppLogsByLevel(0); got != nil {
+		t.Errorf("AppLogsByLevel on a record without AppLogs = %v, want nil", got)
+	}
+}
+
+func TestFilterAppLogs(t *testing.T) {
+	tests := []struct {
+		minLevel int
+		want     []string
+	}{
+		{0, []string{"debug", "error", "info", "critical", "warning"}},
+		{1, []string{"error", "info", "critical", "warning"}},
+		{3, []string{"error", "critical"}},
+		{5, nil},
+	}
+	for _, tt := range tests {
+		logs := append([]AppLog(nil), testAppLogs...)
+		got := filterAppLogs(logs, tt.minLevel)
+		if !reflect.DeepEqual(messages(got), tt.want) {
+			t.Errorf("filterAppLogs(%d) = %q, want %q", tt.minLevel, messages(got), tt.want)
+		}
+		if len(got) > 0 && &got[0] != &logs[0] {
+			t.Errorf("filterAppLogs(%d) did not reuse the backing array", tt.minLevel)
+		}
+	}
+	if got := filterAppLogs(nil, 0); len(got) != 0 {
+		t.Errorf("filterAppLogs(nil) = %v, want empty", got)
+	}
+}
+
+func TestStatusInRange(t *testing.T) {
+	tests := []struct {
+		min, max int
+		status   int32
+		want     bool
+	}{
+		{0, 0, 200, true},
+		{0, 0, 0, true},
+		{500, 0, 499, false},
+		{500, 0, 500, true},
+		{500, 0, 503, true},
+		{0, 399, 399, true},
+		{0, 399, 404, false},
+		{500, 599, 200, false},
+		{500, 599, 500, true},
+		{500, 599, 599, true},
+		{500, 599, 600, false},
+	}
+	for _, tt := range tests {
+		r := &Result{minStatus: tt.min, maxStatus: tt.max}
+		if got := r.statusInRange(tt.status); got != tt.want {
+			t.Errorf("statusInRange(%d) with MinStatus %d, MaxStatus %d = %v, want %v", tt.status, tt.min, tt.max, got, tt.want)
+		}
+	}
+}
@@ -4,12 +4,15 @@
 
 /*
 Package runtime exposes information about the resource usage of the application.
-It also provides a way to run code in a new background context of a module.
+It also provides a way to run code in a new background context of a module,
+and to be notified when an instance of a module is shutting down.
 */
 package runtime
 
 import (
+	"errors"
 	"net/http"
+	"sync"
 
 	"appengine"
 	"appengine_internal"
@@ -53,6 +56,88 @@ func Stats(c appengine.Context) (*Statistics, error) {
 	return s, nil
 }
 
+// CPUSampler measures the CPU consumed between a call to Start and a call
+// to Stop, using the CPU.Total reported by Stats.
+//
+// The measurement is coarse: the total covers the whole instance, including
+// any requests served concurrently with the sampled code, and the system
+// only refreshes it periodically, so a short interval may measure zero.
+// It is best used to compare the cost of code paths over many samples.
+type CPUSampler struct {
+	c       appengine.Context
+	start   float64
+	started bool
+}
+
+// NewCPUSampler returns a CPUSampler that reads statistics through c.
+func NewCPUSampler(c appengine.Context) *CPUSampler {
+	return &CPUSampler{c: c}
+}
+
+// Start records the current CPU total. It may be called again to restart
+// the sample.
+func (s *CPUSampler) Start() error {
+	st, err := Stats(s.c)
+	if err != nil {
+		return err
+	}
+	s.start, s.started = st.CPU.Total, true
+	return nil
+}
+
+// Stop returns the megacycles consumed since the last call to Start.
+func (s *CPUSampler) Stop() (float64, error) {
+	if !s.started {
+		return 0, errors.New("runtime: CPUSampler.Stop called before Start")
+	}
+	st, err := Stats(s.c)
+	if err != nil {
+		return 0, err
+	}
+	s.started = false
+	return st.CPU.Total - s.start, nil
+}
+
+var (
+	shutdownOnce sync.Once
+	shutdownMu   sync.Mutex
+	shutdownHook func(appengine.Context)
+)
+
+// SetShutdownHook arranges for f to be called when the instance is about to be
+// shut down, so that it can flush any state held in memory. Any previously set
+// hook is replaced.
+//
+// Only instances of manually or basically scaled modules are notified, by an
+// /_ah/stop request; the app must not register its own handler for that path.
+// f is called with that request's context and must return within 30 seconds,
+// after which the instance is terminated regardless. The hook is not called if
+// the instance is terminated unexpectedly.
+//
+// Unlike most functions in this package, SetShutdownHook takes no Context,
+// and f is passed one instead of closing over the caller's. A Context is only
+// valid during its own request, while the hook is usually set from an init
+// function, before any request, and runs long after the request that set it
+// has finished. f is given the /_ah/stop request's context, which it can use
+// to make API calls, as with the function passed to RunInBackground.
+func SetShutdownHook(f func(c appengine.Context)) {
+	shutdownMu.Lock()
+	shutdownHook = f
+	shutdownMu.Unlock()
+	shutdownOnce.Do(func() {
+		http.HandleFunc("/_ah/stop", handleStop)
+	})
+}
+
+func handleStop(w http.ResponseWriter, req *http.Request) {
+	shutdownMu.Lock()
+	f := shutdownHook
+	shutdownMu.Unlock()
+	if f != nil {
+		f(newContext(req))
+	}
+}
+
 /*
 RunInBackground makes an API call that triggers an /_ah/background request.
 
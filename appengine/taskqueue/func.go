@@ -0,0 +1,84 @@
+// Copyright 2015 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package taskqueue
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sync"
+
+	"appengine"
+)
+
+// funcPathPrefix is the path prefix of the handlers registered by Func.
+// The delay package owns the "delay" name under this prefix.
+const funcPathPrefix = "/_ah/queue/go/"
+
+var (
+	funcsMu sync.Mutex
+	funcs   = make(map[string]bool) // names registered by Func
+
+	validFuncName = regexp.MustCompile(`^[a-zA-Z0-9_\-.]+$`)
+)
+
+// Func registers f as the handler for tasks created by Enqueue with the given
+// name. The tasks are delivered to /_ah/queue/go/<name>, which must not be
+// marked as "login: required" in app.yaml.
+//
+// If f returns a non-nil error, the task fails and will be retried.
+//
+// Func must be called at program initialization time, in a global variable
+// declaration or from an init function, so that every instance that may
+// execute the task has registered f. It panics if name is invalid or has
+// already been registered.
+func Func(name string, f func(c appengine.Context, payload []byte) error) {
+	if !validFuncName.MatchString(name) || name == "delay" {
+		panic(fmt.Sprintf("taskqueue: invalid Func name %q", name))
+	}
+	funcsMu.Lock()
+	defer funcsMu.Unlock()
+	if funcs[name] {
+		panic(fmt.Sprintf("taskqueue: Func %q registered twice", name))
+	}
+	funcs[name] = true
+
+	http.HandleFunc(funcPathPrefix+name, func(w http.ResponseWriter, r *http.Request) {
+		c := appengine.NewContext(r)
+		defer r.Body.Close()
+		payload, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			c.Errorf("taskqueue: failed reading payload for Func %q: %v", name, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if err := f(c, payload); err != nil {
+			c.Errorf("taskqueue: Func %q failed (will retry): %v", name, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	})
+}
+
+// Enqueue adds a POST task to a named queue that will invoke the Func
+// registered with the given name, passing it payload.
+// An empty queue name means that the default queue will be used.
+func Enqueue(c appengine.Context, name string, payload []byte, queueName string) (*Task, error) {
+	funcsMu.Lock()
+	ok := funcs[name]
+	funcsMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("taskqueue: no Func registered with name %q", name)
+	}
+	h := make(http.Header)
+	h.Set("Content-Type", "application/octet-stream")
+	return Add(c, &Task{
+		Path:    funcPathPrefix + name,
+		Payload: payload,
+		Header:  h,
+		Method:  "POST",
+	}, queueName)
+}
@@ -0,0 +1,93 @@
+// Copyright 2015 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package taskqueue
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ErrNotTaskRequest is the error returned by ParseRequest for a request that
+// was not made by the taskqueue service.
+var ErrNotTaskRequest = errors.New("taskqueue: request was not made by the taskqueue service")
+
+// TaskInfo describes the task that a request executes, as reported by the
+// taskqueue service in the request's X-AppEngine-* headers.
+type TaskInfo struct {
+	// QueueName is the name of the queue the task was added to.
+	QueueName string
+	// TaskName is the name of the task, which the service generates if the
+	// task was added without one.
+	TaskName string
+	// RetryCount is the number of times the task has been retried, so it is
+	// zero on the first try.
+	RetryCount int
+	// ExecutionCount is the number of times the task has previously failed,
+	// not counting failures caused by a lack of available instances.
+	ExecutionCount int
+	// ETA is the time the task was scheduled to run at.
+	ETA time.Time
+	// PreviousResponse is the HTTP status code of the previous try, or zero
+	// on the first try.
+	PreviousResponse int
+	// FailFast is whether the task fails immediately, instead of waiting to
+	// be run on an existing instance, if no instance is idle.
+	FailFast bool
+}
+
+// IsTaskRequest reports whether r was made by the taskqueue service. The
+// App Engine front end strips the X-AppEngine-QueueName header from external
+// requests, so only the service can set it.
+func IsTaskRequest(r *http.Request) bool {
+	return r.Header.Get("X-AppEngine-QueueName") != ""
+}
+
+// ParseRequest returns the description of the task that r, a request made by
+// the taskqueue service to a push task's handler, executes. It returns
+// ErrNotTaskRequest if IsTaskRequest(r) is false.
+//
+// The handler makes the task be retried by responding with a status code
+// outside the range 200-299.
+func ParseRequest(r *http.Request) (*TaskInfo, error) {
+	if !IsTaskRequest(r) {
+		return nil, ErrNotTaskRequest
+	}
+	t := &TaskInfo{
+		QueueName: r.Header.Get("X-AppEngine-QueueName"),
+		TaskName:  r.Header.Get("X-AppEngine-TaskName"),
+		FailFast:  r.Header.Get("X-AppEngine-FailFast") != "",
+	}
+	ints := []struct {
+		header string
+		dst    *int
+	}{
+		{"X-AppEngine-TaskRetryCount", &t.RetryCount},
+		{"X-AppEngine-TaskExecutionCount", &t.ExecutionCount},
+		{"X-AppEngine-TaskPreviousResponse", &t.PreviousResponse},
+	}
+	for _, x := range ints {
+		s := r.Header.Get(x.header)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("taskqueue: bad %s header %q", x.header, s)
+		}
+		*x.dst = n
+	}
+	if s := r.Header.Get("X-AppEngine-TaskETA"); s != "" {
+		// The ETA is in seconds since the epoch, with microsecond precision.
+		secs, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("taskqueue: bad X-AppEngine-TaskETA header %q", s)
+		}
+		t.ETA = usecToTime(int64(secs*1e6 + 0.5))
+	}
+	return t, nil
+}
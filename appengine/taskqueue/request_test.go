@@ -0,0 +1,124 @@
+// Copyright 2015 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package taskqueue
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseRequest(t *testing.T) {
+	tests := []struct {
+		desc    string
+		header  map[string]string
+		want    *TaskInfo
+		wantErr bool
+	}{
+		{
+			desc: "all headers",
+			header: map[string]string{
+				"X-AppEngine-QueueName":            "default",
+				"X-AppEngine-TaskName":             "task1",
+				"X-AppEngine-TaskRetryCount":       "2",
+				"X-AppEngine-TaskExecutionCount":   "1",
+				"X-AppEngine-TaskETA":              "1427889600.123456",
+				"X-AppEngine-TaskPreviousResponse": "500",
+				"X-AppEngine-FailFast":             "true",
+			},
+			want: &TaskInfo{
+				QueueName:        "default",
+				TaskName:         "task1",
+				RetryCount:       2,
+				ExecutionCount:   1,
+				ETA:              time.Unix(1427889600, 123456000),
+				PreviousResponse: 500,
+				FailFast:         true,
+			},
+		},
+		{
+			desc: "only a queue name",
+			header: map[string]string{
+				"X-AppEngine-QueueName": "default",
+			},
+			want: &TaskInfo{QueueName: "default"},
+		},
+		{
+			desc: "whole-second ETA",
+			header: map[string]string{
+				"X-AppEngine-QueueName": "default",
+				"X-AppEngine-TaskETA":   "1427889600",
+			},
+			want: &TaskInfo{QueueName: "default", ETA: time.Unix(1427889600, 0)},
+		},
+		{
+			desc: "bad retry count",
+			header: map[string]string{
+				"X-AppEngine-QueueName":      "default",
+				"X-AppEngine-TaskRetryCount": "two",
+			},
+			wantErr: true,
+		},
+		{
+			desc: "bad previous response",
+			header: map[string]string{
+				"X-AppEngine-QueueName":            "default",
+				"X-AppEngine-TaskPreviousResponse": "5xx",
+			},
+			wantErr: true,
+		},
+		{
+			desc: "bad ETA",
+			header: map[string]string{
+				"X-AppEngine-QueueName": "default",
+				"X-AppEngine-TaskETA":   "tomorrow",
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		r, err := http.NewRequest("POST", "/worker", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range tt.header {
+			r.Header.Set(k, v)
+		}
+		got, err := ParseRequest(r)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: ParseRequest = %+v, want error", tt.desc, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: ParseRequest: %v", tt.desc, err)
+			continue
+		}
+		if !got.ETA.Equal(tt.want.ETA) {
+			t.Errorf("%s: ETA = %v, want %v", tt.desc, got.ETA, tt.want.ETA)
+		}
+		got.ETA, tt.want.ETA = time.Time{}, time.Time{}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: ParseRequest = %+v, want %+v", tt.desc, got, tt.want)
+		}
+	}
+}
+
+func TestParseRequestNotTask(t *testing.T) {
+	r, err := http.NewRequest("GET", "/worker", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without a queue name, the other headers could have come from anyone.
+	r.Header.Set("X-AppEngine-TaskName", "task1")
+	if IsTaskRequest(r) {
+		t.Error("IsTaskRequest = true, want false")
+	}
+	if _, err := ParseRequest(r); err != ErrNotTaskRequest {
+		t.Errorf("ParseRequest error = %v, want %v", err, ErrNotTaskRequest)
+	}
+}
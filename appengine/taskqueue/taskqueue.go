@@ -13,6 +13,18 @@ taskqueue operation is to add a single POST task, NewPOSTTask makes it easy.
 		"key": {key},
 	})
 	taskqueue.Add(c, t, "") // add t to the default queue; c is appengine.Context
+
+To run a Go function as a task without wiring up a handler by hand, register
+it with Func at initialization time and add tasks for it with Enqueue.
+
+	func init() {
+		taskqueue.Func("resize", resize) // resize is a func(appengine.Context, []byte) error
+	}
+
+	taskqueue.Enqueue(c, "resize", payload, "")
+
+A push task's handler can call ParseRequest to learn which task it is
+executing, such as how many times it has been retried.
 */
 package taskqueue
 
@@ -32,8 +44,14 @@ import (
 )
 
 var (
-	// ErrTaskAlreadyAdded is the error returned by Add and AddMulti when a task has already been added with a particular name.
+	// ErrTaskAlreadyAdded is the error returned by Add and AddMulti when a task has already been added with a particular name,
+	// including one that has since been executed or deleted, whose name may not be reused for some time.
 	ErrTaskAlreadyAdded = errors.New("taskqueue: task has already been added")
+	// ErrTombstonedTask is the error returned by Delete and DeleteMulti when a task with a particular name has already been executed or deleted.
+	// Add and AddMulti report adding a task with such a name as ErrTaskAlreadyAdded.
+	ErrTombstonedTask = errors.New("taskqueue: task name is tombstoned")
+	// ErrUnknownQueue is the error returned when the named queue does not exist.
+	ErrUnknownQueue = errors.New("taskqueue: unknown queue")
 )
 
 // RetryOptions let you control whether to retry a task and the backoff intervals between tries.
@@ -127,6 +145,26 @@ type Task struct {
 	RetryOptions *RetryOptions
 }
 
+// ETATime returns the earliest time the task may be executed or leased. For a
+// task with a Delay rather than an ETA, that is the Delay from now; the tasks
+// returned by Add and AddMulti have their ETA set instead.
+func (t *Task) ETATime() time.Time {
+	if !t.ETA.IsZero() {
+		return t.ETA
+	}
+	return time.Now().Add(t.Delay)
+}
+
+// String returns a summary of the task for logging, such as
+// `POST /worker (name "task1", ETA 2015-04-01 12:00:00 +0000 UTC)`.
+func (t *Task) String() string {
+	s := t.method()
+	if t.Path != "" {
+		s += " " + t.Path
+	}
+	return fmt.Sprintf("%s (name %q, ETA %v)", s, t.Name, t.ETATime())
+}
+
 func (t *Task) method() string {
 	if t.Method == "" {
 		return "POST"
@@ -151,6 +189,23 @@ var (
 	defaultNamespace = http.CanonicalHeaderKey("X-AppEngine-Default-Namespace")
 )
 
+// path returns the worker URL for the task when added to the named queue,
+// resolving an empty Path to the queue's default of /_ah/queue/<queueName>.
+func (t *Task) path(queueName string) string {
+	if t.Path != "" {
+		return t.Path
+	}
+	if queueName == "" {
+		queueName = "default"
+	}
+	return "/_ah/queue/" + queueName
+}
+
+// usecToTime converts a task queue timestamp in microseconds to a time.Time.
+func usecToTime(usec int64) time.Time {
+	return time.Unix(0, usec*1e3)
+}
+
 func newAddReq(c appengine.Context, task *Task, queueName string) (*pb.TaskQueueAddRequest, error) {
 	if queueName == "" {
 		queueName = "default"
@@ -225,15 +280,47 @@ func newAddReq(c appengine.Context, task *Task, queueName string) (*pb.TaskQueue
 	return req, nil
 }
 
-var alreadyAddedErrors = map[pb.TaskQueueServiceError_ErrorCode]bool{
-	pb.TaskQueueServiceError_TASK_ALREADY_EXISTS: true,
-	pb.TaskQueueServiceError_TOMBSTONED_TASK:     true,
+// codeError returns the error for a service error code: one of the exported
+// error values if it has one, or else an *appengine_internal.APIError, whose
+// message names the code using the map registered in init. adding is whether
+// the code is from Add or AddMulti, which report a tombstoned task as
+// ErrTaskAlreadyAdded, as they always have.
+func codeError(code pb.TaskQueueServiceError_ErrorCode, adding bool) error {
+	switch code {
+	case pb.TaskQueueServiceError_TASK_ALREADY_EXISTS:
+		return ErrTaskAlreadyAdded
+	case pb.TaskQueueServiceError_TOMBSTONED_TASK:
+		if adding {
+			return ErrTaskAlreadyAdded
+		}
+		return ErrTombstonedTask
+	case pb.TaskQueueServiceError_UNKNOWN_QUEUE:
+		return ErrUnknownQueue
+	}
+	return &appengine_internal.APIError{
+		Service: "taskqueue",
+		Code:    int32(code),
+	}
+}
+
+// mapError maps an error returned by a taskqueue call onto one of the
+// exported error values, as codeError does, if its code has one.
+func mapError(err error, adding bool) error {
+	if apiErr, ok := err.(*appengine_internal.APIError); ok && apiErr.Service == "taskqueue" {
+		e := codeError(pb.TaskQueueServiceError_ErrorCode(apiErr.Code), adding)
+		if _, ok := e.(*appengine_internal.APIError); !ok {
+			return e
+		}
+	}
+	return err
 }
 
 // Add adds the task to a named queue.
 // An empty queue name means that the default queue will be used.
 // Add returns an equivalent Task with defaults filled in, including setting
-// the task's Name field to the chosen name if the original was empty.
+// the task's Name field to the chosen name if the original was empty, the
+// Path of a push task to the queue's default path if the original was empty,
+// and its ETA to the absolute time it was scheduled for, rather than a Delay.
 func Add(c appengine.Context, task *Task, queueName string) (*Task, error) {
 	req, err := newAddReq(c, task, queueName)
 	if err != nil {
@@ -241,14 +328,14 @@ func Add(c appengine.Context, task *Task, queueName string) (*Task, error) {
 	}
 	res := &pb.TaskQueueAddResponse{}
 	if err := c.Call("taskqueue", "Add", req, res, nil); err != nil {
-		apiErr, ok := err.(*appengine_internal.APIError)
-		if ok && alreadyAddedErrors[pb.TaskQueueServiceError_ErrorCode(apiErr.Code)] {
-			return nil, ErrTaskAlreadyAdded
-		}
-		return nil, err
+		return nil, mapError(err, true)
 	}
 	resultTask := *task
 	resultTask.Method = task.method()
+	resultTask.ETA, resultTask.Delay = usecToTime(*req.EtaUsec), 0
+	if resultTask.Method != "PULL" {
+		resultTask.Path = task.path(queueName)
+	}
 	if task.Name == "" {
 		resultTask.Name = string(res.ChosenTaskName)
 	}
@@ -258,7 +345,9 @@ func Add(c appengine.Context, task *Task, queueName string) (*Task, error) {
 // AddMulti adds multiple tasks to a named queue.
 // An empty queue name means that the default queue will be used.
 // AddMulti returns a slice of equivalent tasks with defaults filled in, including setting
-// each task's Name field to the chosen name if the original was empty.
+// each task's Name field to the chosen name if the original was empty, the
+// Path of each push task to the queue's default path if the original was empty,
+// and each task's ETA to the absolute time it was scheduled for, as for Add.
 // If a given task is badly formed or could not be added, an appengine.MultiError is returned.
 func AddMulti(c appengine.Context, tasks []*Task, queueName string) ([]*Task, error) {
 	req := &pb.TaskQueueBulkAddRequest{
@@ -274,7 +363,7 @@ func AddMulti(c appengine.Context, tasks []*Task, queueName string) ([]*Task, er
 	}
 	res := &pb.TaskQueueBulkAddResponse{}
 	if err := c.Call("taskqueue", "BulkAdd", req, res, nil); err != nil {
-		return nil, err
+		return nil, mapError(err, true)
 	}
 	if len(res.Taskresult) != len(tasks) {
 		return nil, errors.New("taskqueue: server error")
@@ -284,18 +373,15 @@ func AddMulti(c appengine.Context, tasks []*Task, queueName string) ([]*Task, er
 		tasksOut[i] = new(Task)
 		*tasksOut[i] = *tasks[i]
 		tasksOut[i].Method = tasksOut[i].method()
+		tasksOut[i].ETA, tasksOut[i].Delay = usecToTime(*req.AddRequest[i].EtaUsec), 0
+		if tasksOut[i].Method != "PULL" {
+			tasksOut[i].Path = tasks[i].path(queueName)
+		}
 		if tasksOut[i].Name == "" {
 			tasksOut[i].Name = string(tr.ChosenTaskName)
 		}
 		if *tr.Result != pb.TaskQueueServiceError_OK {
-			if alreadyAddedErrors[*tr.Result] {
-				me[i] = ErrTaskAlreadyAdded
-			} else {
-				me[i] = &appengine_internal.APIError{
-					Service: "taskqueue",
-					Code:    int32(*tr.Result),
-				}
-			}
+			me[i] = codeError(*tr.Result, true)
 			any = true
 		}
 	}
@@ -330,7 +416,7 @@ func DeleteMulti(c appengine.Context, tasks []*Task, queueName string) error {
 	}
 	res := &pb.TaskQueueDeleteResponse{}
 	if err := c.Call("taskqueue", "Delete", req, res, nil); err != nil {
-		return err
+		return mapError(err, false)
 	}
 	if a, b := len(req.TaskName), len(res.Result); a != b {
 		return fmt.Errorf("taskqueue: internal error: requested deletion of %d tasks, got %d results", a, b)
@@ -338,10 +424,7 @@ func DeleteMulti(c appengine.Context, tasks []*Task, queueName string) error {
 	me, any := make(appengine.MultiError, len(res.Result)), false
 	for i, ec := range res.Result {
 		if ec != pb.TaskQueueServiceError_OK {
-			me[i] = &appengine_internal.APIError{
-				Service: "taskqueue",
-				Code:    int32(ec),
-			}
+			me[i] = codeError(ec, false)
 			any = true
 		}
 	}
@@ -0,0 +1,131 @@
+// Copyright 2015 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package taskqueue
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"appengine_internal"
+	pb "appengine_internal/taskqueue"
+)
+
+func TestCodeError(t *testing.T) {
+	tests := []struct {
+		code   pb.TaskQueueServiceError_ErrorCode
+		adding bool
+		want   error
+	}{
+		{pb.TaskQueueServiceError_TASK_ALREADY_EXISTS, true, ErrTaskAlreadyAdded},
+		{pb.TaskQueueServiceError_TOMBSTONED_TASK, true, ErrTaskAlreadyAdded},
+		{pb.TaskQueueServiceError_TOMBSTONED_TASK, false, ErrTombstonedTask},
+		{pb.TaskQueueServiceError_UNKNOWN_QUEUE, true, ErrUnknownQueue},
+		{pb.TaskQueueServiceError_UNKNOWN_QUEUE, false, ErrUnknownQueue},
+	}
+	for _, tt := range tests {
+		if got := codeError(tt.code, tt.adding); got != tt.want {
+			t.Errorf("codeError(%v, %v) = %v, want %v", tt.code, tt.adding, got, tt.want)
+		}
+		apiErr := &appengine_internal.APIError{Service: "taskqueue", Code: int32(tt.code)}
+		if got := mapError(apiErr, tt.adding); got != tt.want {
+			t.Errorf("mapError(%v, %v) = %v, want %v", apiErr, tt.adding, got, tt.want)
+		}
+	}
+
+	code := pb.TaskQueueServiceError_INVALID_QUEUE_NAME
+	err := codeError(code, true)
+	if apiErr, ok := err.(*appengine_internal.APIError); !ok || apiErr.Code != int32(code) {
+		t.Errorf("codeError(%v) = %#v, want an APIError", code, err)
+	}
+	if got := mapError(err, true); got != err {
+		t.Errorf("mapError(%v) = %v, want it unchanged", err, got)
+	}
+}
+
+func TestETATime(t *testing.T) {
+	eta := time.Date(2015, 4, 1, 12, 0, 0, 0, time.UTC)
+	if got := (&Task{ETA: eta}).ETATime(); !got.Equal(eta) {
+		t.Errorf("ETA task: ETATime() = %v, want %v", got, eta)
+	}
+	// An ETA takes precedence over a Delay.
+	if got := (&Task{ETA: eta, Delay: time.Hour}).ETATime(); !got.Equal(eta) {
+		t.Errorf("ETA and Delay task: ETATime() = %v, want %v", got, eta)
+	}
+
+	before := time.Now()
+	got := (&Task{Delay: time.Hour}).ETATime()
+	after := time.Now()
+	if got.Before(before.Add(time.Hour)) || got.After(after.Add(time.Hour)) {
+		t.Errorf("Delay task: ETATime() = %v, want an hour after %v", got, before)
+	}
+
+	before = time.Now()
+	got = (&Task{}).ETATime()
+	if got.Before(before) || got.After(time.Now()) {
+		t.Errorf("zero task: ETATime() = %v, want about now", got)
+	}
+}
+
+func TestTaskString(t *testing.T) {
+	eta := time.Date(2015, 4, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		task *Task
+		want string
+	}{
+		{
+			&Task{Path: "/worker", Name: "task1", ETA: eta},
+			`POST /worker (name "task1", ETA 2015-04-01 12:00:00 +0000 UTC)`,
+		},
+		{
+			&Task{Method: "PULL", ETA: eta},
+			`PULL (name "", ETA 2015-04-01 12:00:00 +0000 UTC)`,
+		},
+	}
+	for _, tt := range tests {
+		if got := tt.task.String(); got != tt.want {
+			t.Errorf("String() = %q, want %q", got, tt.want)
+		}
+	}
+
+	// A Delay is rendered as the absolute time it resolves to.
+	task := &Task{Path: "/worker", Delay: time.Minute}
+	prefix := `POST /worker (name "", ETA `
+	if got := task.String(); !strings.HasPrefix(got, prefix) {
+		t.Errorf("Delay task: String() = %q, want prefix %q", got, prefix)
+	} else if strings.Contains(got, "0001-01-01") {
+		t.Errorf("Delay task: String() = %q, want an absolute ETA", got)
+	}
+}
+
+func TestTaskPath(t *testing.T) {
+	tests := []struct {
+		task      *Task
+		queueName string
+		want      string
+	}{
+		{&Task{Path: "/worker"}, "q", "/worker"},
+		{&Task{}, "q", "/_ah/queue/q"},
+		{&Task{}, "", "/_ah/queue/default"},
+	}
+	for _, tt := range tests {
+		if got := tt.task.path(tt.queueName); got != tt.want {
+			t.Errorf("path(%q) of %v = %q, want %q", tt.queueName, tt.task, got, tt.want)
+		}
+
+		// The request leaves the default to the service. The namespace
+		// headers are set so that newAddReq needs no context.
+		task := *tt.task
+		task.Header = http.Header{currentNamespace: {""}, defaultNamespace: {""}}
+		req, err := newAddReq(nil, &task, tt.queueName)
+		if err != nil {
+			t.Fatalf("newAddReq: %v", err)
+		}
+		if string(req.Url) != tt.task.Path {
+			t.Errorf("request URL of %v = %q, want %q", tt.task, req.Url, tt.task.Path)
+		}
+	}
+}
@@ -25,9 +25,13 @@ To receive messages,
 package xmpp
 
 import (
+	"bytes"
+	"encoding/xml"
 	"errors"
 	"fmt"
 	"net/http"
+	"strings"
+	"unicode"
 
 	"appengine"
 	"appengine_internal"
@@ -38,7 +42,9 @@ import (
 // Message represents an incoming chat message.
 type Message struct {
 	// Sender is the JID of the sender.
-	// Optional for outgoing messages.
+	// Optional for outgoing messages. It may include a resource, such as
+	// "app@appspot.com/bot2", to distinguish the app's logical senders;
+	// a resource is only allowed on the app's own JIDs.
 	Sender string
 
 	// To is the intended recipients of the message.
@@ -48,17 +54,25 @@ type Message struct {
 	// Body is the body of the message.
 	Body string
 
-	// Type is the message type, per RFC 3921.
+	// Type is the message type, per RFC 3921: "chat", "error", "groupchat",
+	// "headline" or "normal".
 	// It defaults to "chat".
 	Type string
 
 	// RawXML is whether the body contains raw XML.
 	RawXML bool
+
+	// Thread is the identifier of the conversation thread that the
+	// message belongs to, per RFC 3921 (optional).
+	// It is sent as a <thread/> element alongside the body.
+	Thread string
 }
 
-// Presence represents an outgoing presence update.
+// Presence represents an outgoing presence update, or an incoming one when
+// passed to a handler registered with HandlePresence.
 type Presence struct {
 	// Sender is the JID (optional).
+	// As for Message, it may include a resource on the app's own JIDs.
 	Sender string
 
 	// The intended recipient of the presence update.
@@ -73,6 +87,10 @@ type Presence struct {
 
 	// Free text status message (optional).
 	Status string
+
+	// Stanza is the raw XML of an incoming presence stanza.
+	// It is ignored by Send.
+	Stanza string
 }
 
 var (
@@ -93,13 +111,136 @@ func Handle(f func(c appengine.Context, m *Message)) {
 	})
 }
 
+// HandlePresence arranges for f to be called for incoming presence updates.
+// The Presence's Type is "available", "unavailable" or "probe", and its State
+// and Status are those sent by the remote user, if any.
+// The app must enable the xmpp_presence inbound service in app.yaml.
+// Any previously registered handler will be replaced.
+func HandlePresence(f func(c appengine.Context, p *Presence)) {
+	http.HandleFunc("/_ah/xmpp/presence/", func(_ http.ResponseWriter, r *http.Request) {
+		f(appengine.NewContext(r), &Presence{
+			Sender: r.FormValue("from"),
+			To:     r.FormValue("to"),
+			Type:   strings.Trim(strings.TrimPrefix(r.URL.Path, "/_ah/xmpp/presence/"), "/"),
+			State:  r.FormValue("show"),
+			Status: r.FormValue("status"),
+			Stanza: r.FormValue("stanza"),
+		})
+	})
+}
+
+// messageTypes is the set of message types defined by RFC 3921.
+var messageTypes = map[string]bool{
+	"chat":      true,
+	"error":     true,
+	"groupchat": true,
+	"headline":  true,
+	"normal":    true,
+}
+
+// validJID returns whether jid is a well-formed JID of the form
+// [node@]domain[/resource], per RFC 3920.
+func validJID(jid string) bool {
+	if jid == "" || len(jid) > 3071 {
+		return false
+	}
+	bare, resource := jid, ""
+	if i := strings.Index(jid, "/"); i != -1 {
+		bare, resource = jid[:i], jid[i+1:]
+		if resource == "" || len(resource) > 1023 {
+			return false
+		}
+	}
+	node, domain := "", bare
+	if i := strings.Index(bare, "@"); i != -1 {
+		node, domain = bare[:i], bare[i+1:]
+		if node == "" || len(node) > 1023 || strings.ContainsAny(node, "\"&'/:<>@") {
+			return false
+		}
+	}
+	if domain == "" || len(domain) > 1023 || strings.ContainsAny(domain, "@/") {
+		return false
+	}
+	for _, r := range node + domain + resource {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// validSender returns whether jid is a well-formed JID that the app may send
+// from. A JID with a resource, such as "app@appspot.com/bot2", must belong to
+// one of the app's own domains: app@appspot.com or *@app.appspotchat.com.
+func validSender(c appengine.Context, jid string) bool {
+	if !validJID(jid) {
+		return false
+	}
+	i := strings.Index(jid, "/")
+	if i == -1 {
+		return true
+	}
+	bare := jid[:i]
+	appID := appengine.AppID(c)
+	if j := strings.Index(appID, ":"); j != -1 {
+		appID = appID[j+1:] // strip the domain prefix
+	}
+	if bare == appID+"@appspot.com" {
+		return true
+	}
+	return strings.HasSuffix(bare, "@"+appID+".appspotchat.com")
+}
+
+// multiValidJID is a batch version of validJID. It returns an error, not a
+// []bool.
+func multiValidJID(jids []string) error {
+	invalid := false
+	for _, jid := range jids {
+		if !validJID(jid) {
+			invalid = true
+			break
+		}
+	}
+	if !invalid {
+		return nil
+	}
+	err := make(appengine.MultiError, len(jids))
+	for i, jid := range jids {
+		if !validJID(jid) {
+			err[i] = ErrInvalidJID
+		}
+	}
+	return err
+}
+
 // Send sends a message.
 // If any failures occur with specific recipients, the error will be an appengine.MultiError.
+// Malformed recipient JIDs are reported as ErrInvalidJID without contacting
+// the XMPP service.
 func (m *Message) Send(c appengine.Context) error {
+	if m.Sender != "" && !validSender(c, m.Sender) {
+		return ErrInvalidJID
+	}
+	if err := multiValidJID(m.To); err != nil {
+		return err
+	}
+	if m.Type != "" && !messageTypes[m.Type] {
+		return fmt.Errorf("xmpp: invalid message type %q", m.Type)
+	}
+	body, rawXML := m.Body, m.RawXML
+	if m.Thread != "" {
+		// There is no thread field in the request, so send the
+		// <thread/> element as raw XML.
+		if !rawXML {
+			body = "<body>" + xmlEscape(body) + "</body>"
+			rawXML = true
+		}
+		body += "<thread>" + xmlEscape(m.Thread) + "</thread>"
+	}
 	req := &pb.XmppMessageRequest{
 		Jid:    m.To,
-		Body:   &m.Body,
-		RawXml: &m.RawXML,
+		Body:   &body,
+		RawXml: &rawXML,
 	}
 	if m.Type != "" && m.Type != "chat" {
 		req.Type = &m.Type
@@ -128,9 +269,20 @@ func (m *Message) Send(c appengine.Context) error {
 	return nil
 }
 
+// xmlEscape returns s with the XML special characters escaped.
+func xmlEscape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
 // Invite sends an invitation. If the from address is an empty string
 // the default (yourapp@appspot.com/bot) will be used.
+// ErrInvalidJID is returned if to or from is malformed.
 func Invite(c appengine.Context, to, from string) error {
+	if !validJID(to) || (from != "" && !validSender(c, from)) {
+		return ErrInvalidJID
+	}
 	req := &pb.XmppInviteRequest{
 		Jid: &to,
 	}
@@ -142,7 +294,11 @@ func Invite(c appengine.Context, to, from string) error {
 }
 
 // Send sends a presence update.
+// ErrInvalidJID is returned if p.To or p.Sender is malformed.
 func (p *Presence) Send(c appengine.Context) error {
+	if !validJID(p.To) || (p.Sender != "" && !validSender(c, p.Sender)) {
+		return ErrInvalidJID
+	}
 	req := &pb.XmppSendPresenceRequest{
 		Jid: &p.To,
 	}
@@ -175,7 +331,11 @@ var presenceMap = map[pb.PresenceResponse_SHOW]string{
 // (yourapp@appspot.com/bot) will be used.
 // Possible return values are "", "away", "dnd", "chat", "xa".
 // ErrPresenceUnavailable is returned if the presence is unavailable.
+// ErrInvalidJID is returned if to or from is malformed.
 func GetPresence(c appengine.Context, to string, from string) (string, error) {
+	if !validJID(to) || (from != "" && !validSender(c, from)) {
+		return "", ErrInvalidJID
+	}
 	req := &pb.PresenceRequest{
 		Jid: &to,
 	}
@@ -0,0 +1,43 @@
+// Copyright 2015 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidJID(t *testing.T) {
+	long := strings.Repeat("a", 1024)
+	tests := []struct {
+		jid  string
+		want bool
+	}{
+		{"example.com", true},
+		{"user@example.com", true},
+		{"user@example.com/resource", true},
+		{"example.com/resource", true},
+		{"user@example.com/res/with/slashes", true},
+
+		{"", false},
+		{"@example.com", false},
+		{"user@", false},
+		{"user@example.com/", false},
+		{"/resource", false},
+		{"us<er@example.com", false},
+		{"user@ex@ample.com", false},
+		{"us er@example.com", false},
+		{"user@example.com/res\x00", false},
+		{long + "@example.com", false},
+		{"user@" + long, false},
+		{"user@example.com/" + long, false},
+		{strings.Repeat("a", 1023) + "@" + strings.Repeat("b", 1023) + "/" + strings.Repeat("c", 1023), true},
+	}
+	for _, tt := range tests {
+		if got := validJID(tt.jid); got != tt.want {
+			t.Errorf("validJID(%.40q) = %v, want %v", tt.jid, got, tt.want)
+		}
+	}
+}
@@ -237,6 +237,12 @@ type context interface {
 	Request() interface{}
 }
 
+// moduleNamer is implemented by test contexts that report the name of the
+// module they run in, instead of the one in instanceConfig.
+type moduleNamer interface {
+	ModuleName() string
+}
+
 // httpContext represents the context of an in-flight HTTP request.
 // It implements the appengine.Context interface.
 type httpContext struct {
@@ -45,6 +45,14 @@ func DefaultVersionHostname(req interface{}) string {
 }
 
 func ModuleName(req interface{}) string {
+	if r, ok := req.(*http.Request); ok {
+		ctxsMu.Lock()
+		c := ctxs[r]
+		ctxsMu.Unlock()
+		if m, ok := c.(moduleNamer); ok {
+			return m.ModuleName()
+		}
+	}
 	// instanceConfig.VersionID is either "module:version.timestamp"
 	// or "version.timestamp".
 	if i := strings.Index(instanceConfig.VersionID, ":"); i >= 0 {
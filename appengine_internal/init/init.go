@@ -17,6 +17,8 @@ type failingTransport struct{}
 
 func (failingTransport) RoundTrip(*http.Request) (*http.Response, error) {
 	return nil, errors.New("http.DefaultTransport and http.DefaultClient are not available in App Engine. " +
+		"Use urlfetch.Client(c) or &http.Client{Transport: &urlfetch.Transport{Context: c}} " +
+		"from package appengine/urlfetch instead. " +
 		"See https://cloud.google.com/appengine/docs/go/urlfetch/")
 }
 
@@ -45,8 +45,20 @@ var errorCodeMaps = make(map[string]map[int32]string)
 
 // RegisterErrorCodeMap is called from API implementations to register their
 // error code map. This should only be called from init functions.
+// Several maps may be registered for one service; their entries are merged.
+// It panics if two maps give different names to the same code.
 func RegisterErrorCodeMap(service string, m map[int32]string) {
-	errorCodeMaps[service] = m
+	merged := errorCodeMaps[service]
+	if merged == nil {
+		merged = make(map[int32]string, len(m))
+		errorCodeMaps[service] = merged
+	}
+	for code, name := range m {
+		if old, ok := merged[code]; ok && old != name {
+			panic(fmt.Sprintf("appengine_internal: %s error code %d registered as both %s and %s", service, code, old, name))
+		}
+		merged[code] = name
+	}
 }
 
 type timeoutCodeKey struct {
@@ -0,0 +1,41 @@
+// Copyright 2015 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package appengine_internal
+
+import (
+	"testing"
+)
+
+func TestRegisterErrorCodeMap(t *testing.T) {
+	const service = "test_service"
+	defer delete(errorCodeMaps, service)
+	RegisterErrorCodeMap(service, map[int32]string{1: "BAD_REQUEST", 2: "INTERNAL_ERROR"})
+	RegisterErrorCodeMap(service, map[int32]string{2: "INTERNAL_ERROR", 3: "QUOTA_EXCEEDED"})
+
+	tests := []struct {
+		code int32
+		want string
+	}{
+		{1, "API error 1 (test_service: BAD_REQUEST)"},
+		{2, "API error 2 (test_service: INTERNAL_ERROR)"},
+		{3, "API error 3 (test_service: QUOTA_EXCEEDED)"},
+	}
+	for _, tt := range tests {
+		if got := (&APIError{Service: service, Code: tt.code}).Error(); got != tt.want {
+			t.Errorf("code %d: got %q, want %q", tt.code, got, tt.want)
+		}
+	}
+
+	// Two names for the same code is a programming error.
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a conflicting name did not panic")
+		}
+		if got := errorCodeMaps[service][1]; got != "BAD_REQUEST" {
+			t.Errorf("after the conflict, code 1 is named %q, want BAD_REQUEST", got)
+		}
+	}()
+	RegisterErrorCodeMap(service, map[int32]string{1: "NOT_FOUND"})
+}
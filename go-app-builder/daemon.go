@@ -0,0 +1,159 @@
+// Copyright 2015 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+// Daemon mode is EXPERIMENTAL. Rather than building once, go-app-builder
+// keeps running and builds the app each time it is asked to, re-parsing
+// only the source files that have changed since the previous build.
+//
+// Requests are read from stdin, one per line. A request is a space-separated
+// list of file names, taking the same form as go-app-builder's positional
+// arguments (including @file response files). All other settings come from
+// the flags go-app-builder was started with. For each request, a single line
+// is written to stdout: "ok" if the build succeeded, or "error: " followed by
+// the reason. Details are written to the log as usual. Any files named by
+// --manifest are built along with those of every request.
+//
+// Only the parsing of unchanged files is cached: each build still lists the
+// app's directories and reads the start of each file to evaluate its build
+// constraints. The --print_* modes and --prev_extras_hash describe a single
+// build, and cannot be used in daemon mode.
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"go/scanner"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// parsedFile is a cached result of parseFile.
+type parsedFile struct {
+	modTime time.Time
+	size    int64
+	file    File
+}
+
+// fileCache holds the files parsed by parseFile, keyed by their full path.
+// It is nil, and unused, unless running in daemon mode.
+var (
+	fileCacheMu sync.Mutex
+	fileCache   map[string]*parsedFile
+)
+
+// cachedFile returns the cached result of parsing filename, if it is
+// still current.
+func cachedFile(baseDir, filename string) (*File, bool) {
+	fileCacheMu.Lock()
+	defer fileCacheMu.Unlock()
+	if fileCache == nil {
+		return nil, false
+	}
+	fullName := filepath.Join(baseDir, filename)
+	pf, ok := fileCache[fullName]
+	if !ok {
+		return nil, false
+	}
+	fi, err := os.Stat(fullName)
+	if err != nil || !fi.ModTime().Equal(pf.modTime) || fi.Size() != pf.size {
+		delete(fileCache, fullName)
+		return nil, false
+	}
+	f := pf.file
+	f.Name = filename
+	return &f, true
+}
+
+// cacheFile records the result of parsing filename.
+func cacheFile(baseDir, filename string, f *File) {
+	fileCacheMu.Lock()
+	defer fileCacheMu.Unlock()
+	if fileCache == nil {
+		return
+	}
+	fullName := filepath.Join(baseDir, filename)
+	fi, err := os.Stat(fullName)
+	if err != nil {
+		return
+	}
+	fileCache[fullName] = &parsedFile{
+		modTime: fi.ModTime(),
+		size:    fi.Size(),
+		file:    *f,
+	}
+}
+
+// daemonIncompatibleFlags returns the names of the flags that are set but
+// cannot be used in daemon mode.
+func daemonIncompatibleFlags() []string {
+	var names []string
+	flag.Visit(func(f *flag.Flag) {
+		if v := f.Value.String(); v == "" || v == "false" {
+			return
+		}
+		if strings.HasPrefix(f.Name, "print_") || f.Name == "prev_extras_hash" {
+			names = append(names, "--"+f.Name)
+		}
+	})
+	return names
+}
+
+// serveDaemon serves build requests read from r, writing results to w,
+// until r is exhausted. extraFiles, such as those named by a manifest, are
+// built along with the files of every request.
+func serveDaemon(r io.Reader, w io.Writer, extraFiles []string) error {
+	fileCacheMu.Lock()
+	fileCache = make(map[string]*parsedFile)
+	fileCacheMu.Unlock()
+
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		args := strings.Fields(s.Text())
+		if len(args) == 0 {
+			continue
+		}
+		if err := daemonBuild(args, extraFiles); err != nil {
+			fmt.Fprintf(w, "error: %v\n", err)
+		} else {
+			fmt.Fprintln(w, "ok")
+		}
+	}
+	return s.Err()
+}
+
+// daemonBuild performs a single build for serveDaemon.
+func daemonBuild(args, extraFiles []string) error {
+	files, err := expandResponseFiles(args)
+	if err != nil {
+		return err
+	}
+	files = append(files, extraFiles...)
+	app, err := ParseFiles(*appBase, files)
+	if err != nil {
+		if errl, ok := err.(scanner.ErrorList); ok {
+			log.Printf("go-app-builder: Failed parsing input (%d error%s)", len(errl), plural(len(errl), "s"))
+			for _, err := range errl {
+				log.Println(err)
+			}
+			return fmt.Errorf("failed parsing input")
+		}
+		return fmt.Errorf("failed parsing input: %v", err)
+	}
+
+	gTimer = timer{name: *arch + "g"}
+	pTimer = timer{name: "gopack"}
+	lTimer = timer{name: *arch + "l"}
+	start := time.Now()
+	err = buildApp(app)
+	writeStamp(app, err)
+	logBuildTiming(app, time.Since(start))
+	return err
+}
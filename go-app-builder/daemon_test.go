@@ -0,0 +1,125 @@
+// Copyright 2015 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCachedFile(t *testing.T) {
+	dir, _, done := writeApp(t, map[string]string{
+		"foo/a.go": "package foo\n\nfunc init() {}\n",
+	})
+	defer done()
+	defer func(old map[string]*parsedFile) { fileCache = old }(fileCache)
+	fileCache = make(map[string]*parsedFile)
+	name := filepath.Join("foo", "a.go")
+	full := filepath.Join(dir, name)
+
+	if _, ok := cachedFile(dir, name); ok {
+		t.Fatal("cachedFile hit before the file was parsed")
+	}
+	if _, err := parseFile(dir, name); err != nil {
+		t.Fatal(err)
+	}
+	f, ok := cachedFile(dir, name)
+	if !ok {
+		t.Fatal("cachedFile missed after the file was parsed")
+	}
+	if f.Name != name || !f.HasInit {
+		t.Errorf("got cached file %v, want %s with an init function", f, name)
+	}
+
+	// A change of size makes the file be parsed again.
+	if err := ioutil.WriteFile(full, []byte("package foo\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cachedFile(dir, name); ok {
+		t.Error("cachedFile hit after the file's size changed")
+	}
+	if f, err := parseFile(dir, name); err != nil || f.HasInit {
+		t.Errorf("got %v, %v after the file changed, want no init function", f, err)
+	}
+
+	// So does a change of modification time alone.
+	fi, err := os.Stat(full)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cachedFile(dir, name); !ok {
+		t.Fatal("cachedFile missed after the file was parsed again")
+	}
+	mtime := fi.ModTime().Add(time.Hour)
+	if err := os.Chtimes(full, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cachedFile(dir, name); ok {
+		t.Error("cachedFile hit after the file's modification time changed")
+	}
+}
+
+// fakeTool is a shell script that stands in for the compiler, packer and
+// linker, writing something to the file named by any -o flag.
+const fakeTool = `#!/bin/sh
+while [ $# -gt 0 ]; do
+	if [ "$1" = -o ]; then
+		echo built > "$2"
+	fi
+	shift
+done
+`
+
+func TestServeDaemon(t *testing.T) {
+	dir, _, done := writeApp(t, map[string]string{
+		"foo/a.go":  "package foo\n\nfunc init() {}\n",
+		"bad/b.go":  "package bad\n\nfunc init() {\n",
+		"fake-tool": fakeTool,
+	})
+	defer done()
+	tool := filepath.Join(dir, "fake-tool")
+	if err := os.Chmod(tool, 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer func(base, work, c, p, l string) {
+		*appBase, *workDir, *compilerPath, *packerPath, *linkerPath = base, work, c, p, l
+	}(*appBase, *workDir, *compilerPath, *packerPath, *linkerPath)
+	*appBase, *workDir = dir, dir
+	*compilerPath, *packerPath, *linkerPath = tool, tool, tool
+	defer func(old map[string]*parsedFile) { fileCache = old }(fileCache)
+	defer log.SetOutput(os.Stderr)
+	log.SetOutput(ioutil.Discard)
+
+	in := strings.Join([]string{
+		filepath.Join("foo", "a.go"),
+		"",
+		filepath.Join("bad", "b.go"),
+		filepath.Join("foo", "missing.go"),
+		filepath.Join("foo", "a.go"),
+	}, "\n")
+	var out bytes.Buffer
+	if err := serveDaemon(strings.NewReader(in), &out, nil); err != nil {
+		t.Fatalf("serveDaemon: %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	want := []string{"ok", "error: failed parsing input", "error: failed parsing input: ", "ok"}
+	if len(lines) != len(want) {
+		t.Fatalf("got output %q, want %d lines", out.String(), len(want))
+	}
+	for i, line := range lines {
+		if want[i] == "ok" && line != "ok" || !strings.HasPrefix(line, want[i]) {
+			t.Errorf("line %d: got %q, want %q", i+1, line, want[i])
+		}
+	}
+	if _, ok := cachedFile(dir, filepath.Join("foo", "a.go")); !ok {
+		t.Error("the file built by the requests is not cached")
+	}
+}
@@ -5,6 +5,9 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"path"
 	"strings"
 )
 
@@ -42,3 +45,64 @@ func parseToolFlags(s string) []string {
 	}
 	return flags
 }
+
+// packageFlags is a set of tool flags for the packages whose import paths
+// match pattern, per path.Match, or for every package if pattern is empty.
+type packageFlags struct {
+	pattern string
+	flags   []string
+}
+
+// packageFlagsList is a flag.Value that may be set repeatedly. Each value is
+// either a comma-separated list of tool flags, which applies to every
+// package, or a pattern, "=", and such a list, as in "myapp/debug/*=-N,-l".
+// A value starting with "-" is always a plain list.
+type packageFlagsList struct {
+	values []string
+	list   []packageFlags
+}
+
+// packageFlagsVar defines a packageFlagsList flag.
+func packageFlagsVar(name, usage string) *packageFlagsList {
+	l := new(packageFlagsList)
+	flag.Var(l, name, usage)
+	return l
+}
+
+func (l *packageFlagsList) String() string {
+	return strings.Join(l.values, " ")
+}
+
+func (l *packageFlagsList) Set(s string) error {
+	var pf packageFlags
+	if s != "" && !strings.HasPrefix(s, "-") {
+		i := strings.Index(s, "=")
+		if i < 0 {
+			return fmt.Errorf("%q is neither flags nor pattern=flags", s)
+		}
+		pf.pattern = s[:i]
+		if _, err := path.Match(pf.pattern, ""); err != nil {
+			return fmt.Errorf("bad pattern %q: %v", pf.pattern, err)
+		}
+		pf.flags = parseToolFlags(s[i+1:])
+	} else {
+		pf.flags = parseToolFlags(s)
+	}
+	l.values = append(l.values, s)
+	l.list = append(l.list, pf)
+	return nil
+}
+
+// forPackage returns the flags for the package with the given import path.
+// If several values match, the last one given wins; they are not combined.
+func (l *packageFlagsList) forPackage(importPath string) []string {
+	var flags []string
+	for _, pf := range l.list {
+		if pf.pattern == "" {
+			flags = pf.flags
+		} else if ok, _ := path.Match(pf.pattern, importPath); ok {
+			flags = pf.flags
+		}
+	}
+	return flags
+}
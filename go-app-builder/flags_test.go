@@ -0,0 +1,113 @@
+// Copyright 2015 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseToolFlags(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"", nil},
+		{"-N", []string{"-N"}},
+		{"-N,-l", []string{"-N", "-l"}},
+		{`-D,a\,b`, []string{"-D", "a,b"}},
+		{`-X\\,y`, []string{`-X\`, "y"}},
+	}
+	for _, tt := range tests {
+		if got := parseToolFlags(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseToolFlags(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestPackageFlagsList(t *testing.T) {
+	tests := []struct {
+		desc   string
+		values []string
+		want   map[string][]string // import path to flags
+	}{
+		{
+			desc:   "plain list",
+			values: []string{"-N,-l"},
+			want: map[string][]string{
+				"main":          {"-N", "-l"},
+				"myapp/debug/x": {"-N", "-l"},
+			},
+		},
+		{
+			desc:   "plain list containing =",
+			values: []string{"-X=a,-l"},
+			want: map[string][]string{
+				"main": {"-X=a", "-l"},
+			},
+		},
+		{
+			desc:   "pattern",
+			values: []string{"myapp/debug/*=-N,-l"},
+			want: map[string][]string{
+				"main":          nil,
+				"myapp/debug/x": {"-N", "-l"},
+				"myapp/debug":   nil,
+			},
+		},
+		{
+			desc:   "pattern with escaped comma",
+			values: []string{`myapp/*=-D,a\,b`},
+			want: map[string][]string{
+				"myapp/x": {"-D", "a,b"},
+			},
+		},
+		{
+			desc:   "last match wins",
+			values: []string{"-l", "myapp/*=-N", "myapp/debug=-B"},
+			want: map[string][]string{
+				"main":        {"-l"},
+				"myapp/x":     {"-N"},
+				"myapp/debug": {"-B"},
+			},
+		},
+		{
+			desc:   "plain list after pattern",
+			values: []string{"myapp/*=-N", "-l"},
+			want: map[string][]string{
+				"myapp/x": {"-l"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		var l packageFlagsList
+		for _, v := range tt.values {
+			if err := l.Set(v); err != nil {
+				t.Fatalf("%s: Set(%q): %v", tt.desc, v, err)
+			}
+		}
+		for importPath, want := range tt.want {
+			if got := l.forPackage(importPath); !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: forPackage(%q) = %q, want %q", tt.desc, importPath, got, want)
+			}
+		}
+	}
+}
+
+func TestPackageFlagsListBadValues(t *testing.T) {
+	for _, v := range []string{
+		"myapp",      // neither flags nor pattern=flags
+		"myapp/[=-N", // bad pattern
+		`myapp/\=-N`, // bad pattern
+	} {
+		var l packageFlagsList
+		if err := l.Set(v); err == nil {
+			t.Errorf("Set(%q) succeeded, want error", v)
+		}
+		if len(l.list) != 0 {
+			t.Errorf("Set(%q) recorded %d values after failing", v, len(l.list))
+		}
+	}
+}
@@ -11,16 +11,28 @@ and finally compiles and links all these pieces.
 
 Files named *_test.go will be ignored.
 
+An argument of the form @file names a response file holding further
+file names, one per line. This avoids the operating system's limit on
+the length of the command line for apps with very many files.
+
+The --manifest flag names a JSON file that can supply the files, packages
+with their own base directories, and some settings instead; see manifest.go.
+
 Usage:
-	go-app-builder [options] [file.go ...]
+	go-app-builder [options] [file.go ...] [@file ...]
 */
 package main
 
 import (
+	"bytes"
 	"crypto/sha1"
+	"debug/elf"
+	"debug/macho"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"go/ast"
 	"go/scanner"
 	"io"
 	"io/ioutil"
@@ -43,27 +55,51 @@ var (
 	appBase         = flag.String("app_base", ".", "Path to app root. Command-line filenames are relative to this.")
 	arch            = flag.String("arch", defaultArch(), `The Go architecture specifier (e.g. "5", "6", "8").`)
 	binaryName      = flag.String("binary_name", "_go_app.bin", "Name of final binary, relative to --work_dir.")
+	compilerPath    = flag.String("compiler", "", "If set, the compiler to use instead of the one in --goroot.")
+	debugSymbols    = flag.String("debug_symbols", "strip", `What to do with the binary's symbols and DWARF: "strip" them, keeping it small, or also link a "separate" unstripped copy to --binary_name plus ".debug" for symbolizing crashes.`)
+	daemon          = flag.Bool("daemon", false, "EXPERIMENTAL: Serve build requests read from stdin, re-parsing only changed files.")
 	dynamic         = flag.Bool("dynamic", false, "Create a binary with a dynamic linking header.")
+	excludePkgs     = flag.String("exclude_packages", "", "Comma-separated list of packages to not link in unless another package imports them.")
 	extraImports    = flag.String("extra_imports", "", "A comma-separated list of extra packages to import.")
-	gcFlags         = flag.String("gcflags", "", "Comma-separated list of extra compiler flags.")
+	gcFlags         = packageFlagsVar("gcflags", `Comma-separated list of extra compiler flags, optionally preceded by an import path pattern and "=". May be repeated; the last match wins.`)
 	goPath          = flag.String("gopath", os.Getenv("GOPATH"), "Location of extra packages.")
 	goRoot          = flag.String("goroot", os.Getenv("GOROOT"), "Root of the Go installation.")
 	ldFlags         = flag.String("ldflags", "", "Comma-separated list of extra linker flags.")
+	listTools       = flag.Bool("list_tools", false, "Whether to skip building and just print the path and version of each tool used.")
+	linkerPath      = flag.String("linker", "", "If set, the linker to use instead of the one in --goroot.")
 	logFile         = flag.String("log_file", "", "If set, a file to write messages to.")
+	mainImportPath  = flag.String("main_import_path", "main", "Import path to use for the synthetic main package.")
+	manifestFile    = flag.String("manifest", "", "If set, a JSON file describing the build, merged with the command line.")
 	noBuildFiles    = flag.String("nobuild_files", "", "Regular expression matching files to not build.")
+	offline         = flag.Bool("offline", false, "Whether to refuse to run any tool other than the toolchain's, and to turn off network fetches in the tools' environment.")
+	packerPath      = flag.String("packer", "", "If set, the archiver to use instead of the pack tool in --goroot.")
 	parallelism     = flag.Int("parallelism", 1, "Maximum number of compiles to run in parallel.")
+	preMainImport   = flag.String("pre_main_import", "", `If set, a function (e.g. "myapp/framework.Setup") in an app package that main calls before serving. It must take no arguments and return nothing.`)
+	prevExtrasHash  = flag.String("prev_extras_hash", "", "The --print_extras_hash output of the previous build. If it still matches and nothing else about the build changed since the binary was built, the build is skipped.")
 	pkgDupes        = flag.String("pkg_dupe_whitelist", "", "Comma-separated list of packages that are okay to duplicate.")
+	profileBuild    = flag.Bool("profile_build", false, "Whether to also log how long each package took to compile, slowest first.")
+	printDeps       = flag.Bool("print_deps", false, "Whether to skip building and just print each package's imports.")
 	printExtras     = flag.Bool("print_extras", false, "Whether to skip building and just print extra-app files.")
 	printExtrasHash = flag.Bool("print_extras_hash", false, "Whether to skip building and just print a hash of the extra-app files.")
 	printExtraPkgs  = flag.Bool("print_extra_packages", false, "Whether to skip building and just print extra-app packages.")
+	race            = flag.Bool("race", false, "Build with the race detector enabled (amd64 only; implies -dynamic).")
+	rejectDupes     = flag.Bool("reject_gopath_dupes", true, "Whether an app package with the same import path as a package in --gopath is an error unless it is in --pkg_dupe_whitelist. If false, the app package shadows that package, with a warning.")
+	timingFormat    = flag.String("timing_format", "text", `How to log build timings: "text", "plain" (ASCII only) or "json".`)
 	trampoline      = flag.String("trampoline", "", "If set, a binary to invoke tools with.")
 	trampolineFlags = flag.String("trampoline_flags", "", "Comma-separated flags to pass to trampoline.")
 	unsafe          = flag.Bool("unsafe", false, "Permit unsafe packages.")
 	verbose         = flag.Bool("v", false, "Noisy output.")
+	verifyStatic    = flag.Bool("verify_static", false, "Whether to check that the binary has no dynamic linking headers, unless --dynamic is set.")
+	versionValue    = flag.String("version_value", "", "The value to set --version_var to. By default, the build time.")
+	versionVar      = flag.String("version_var", "", `If set, a string variable (e.g. "myapp/version.Build") that the linker sets to --version_value.`)
 	vm              = flag.Bool("vm", false, "Whether to build for Managed VMs (implies -unsafe).")
 	workDir         = flag.String("work_dir", "/tmp", "Directory to use for intermediate and output files.")
+	writeBuildInfo  = flag.Bool("write_build_info", false, "Whether to write a build-info.json file describing the build to --work_dir.")
 )
 
+// defaultArch returns the architecture specifier for runtime.GOARCH, or that
+// of amd64 if GOARCH is not supported. main logs the latter case, once any
+// --log_file is in effect.
 func defaultArch() string {
 	switch runtime.GOARCH {
 	case "386":
@@ -73,18 +109,19 @@ func defaultArch() string {
 	case "arm":
 		return "5"
 	}
-	// Default to amd64.
 	return "6"
 }
 
+// archNames maps the supported architecture specifiers to GOARCH values.
+var archNames = map[string]string{
+	"5": "arm",
+	"6": "amd64",
+	"8": "386",
+}
+
 func fullArch(c string) string {
-	switch c {
-	case "5":
-		return "arm"
-	case "6":
-		return "amd64"
-	case "8":
-		return "386"
+	if a, ok := archNames[c]; ok {
+		return a
 	}
 	return "amd64"
 }
@@ -116,7 +153,7 @@ func releaseTags(apiVersion string) []string {
 func main() {
 	flag.Usage = usage
 	flag.Parse()
-	if flag.NArg() == 0 {
+	if flag.NArg() == 0 && !*daemon && *manifestFile == "" && !*listTools {
 		flag.Usage()
 		os.Exit(1)
 	}
@@ -130,7 +167,53 @@ func main() {
 		log.SetOutput(f)
 	}
 
-	app, err := ParseFiles(*appBase, flag.Args())
+	archSet := false
+	flag.Visit(func(f *flag.Flag) { archSet = archSet || f.Name == "arch" })
+	if !archSet && archNames[*arch] != runtime.GOARCH {
+		log.Printf("go-app-builder: unknown GOARCH %q; defaulting --arch to 6 (amd64)", runtime.GOARCH)
+	}
+	if _, ok := archNames[*arch]; !ok {
+		log.Fatalf(`go-app-builder: Unknown --arch %q; must be one of "5", "6" or "8"`, *arch)
+	}
+	if *listTools {
+		printTools(os.Stdout)
+		return
+	}
+	if !debugSymbolsModes[*debugSymbols] {
+		log.Fatalf(`go-app-builder: Unknown --debug_symbols %q; must be "strip" or "separate"`, *debugSymbols)
+	}
+	if !timingFormats[*timingFormat] {
+		log.Fatalf(`go-app-builder: Unknown --timing_format %q; must be one of "text", "plain" or "json"`, *timingFormat)
+	}
+
+	var manifestFiles []string
+	if *manifestFile != "" {
+		m, err := readManifest(*manifestFile)
+		if err != nil {
+			log.Fatalf("go-app-builder: %v", err)
+		}
+		manifestFiles = applyManifest(m)
+	}
+
+	if *daemon {
+		if names := daemonIncompatibleFlags(); len(names) > 0 {
+			log.Fatalf("go-app-builder: %s cannot be used with --daemon", strings.Join(names, ", "))
+		}
+		if err := serveDaemon(os.Stdin, os.Stdout, manifestFiles); err != nil {
+			log.Fatalf("go-app-builder: Failed reading build requests: %v", err)
+		}
+		return
+	}
+
+	files, err := expandResponseFiles(flag.Args())
+	if err != nil {
+		log.Fatalf("go-app-builder: %v", err)
+	}
+	files = append(files, manifestFiles...)
+	if len(files) == 0 {
+		log.Fatalf("go-app-builder: No files to build")
+	}
+	app, err := ParseFiles(*appBase, files)
 	if err != nil {
 		if errl, ok := err.(scanner.ErrorList); ok {
 			log.Printf("go-app-builder: Failed parsing input (%d error%s)", len(errl), plural(len(errl), "s"))
@@ -142,6 +225,10 @@ func main() {
 		log.Fatalf("go-app-builder: Failed parsing input: %v", err)
 	}
 
+	if *printDeps {
+		printPackageDeps(os.Stdout, app)
+		return
+	}
 	if *printExtras {
 		printExtraFiles(os.Stdout, app)
 		return
@@ -154,13 +241,21 @@ func main() {
 		printExtraPackages(os.Stdout, app)
 		return
 	}
+	if *prevExtrasHash != "" && upToDate(app, *prevExtrasHash) {
+		if *verbose {
+			log.Printf("go-app-builder: %s is up to date; skipping build", *binaryName)
+		}
+		return
+	}
 
 	gTimer.name = *arch + "g"
 	pTimer.name = "gopack"
 	lTimer.name = *arch + "l"
 
+	start := time.Now()
 	err = buildApp(app)
-	log.Printf("go-app-builder: build timing: %v, %v, %v", &gTimer, &pTimer, &lTimer)
+	writeStamp(app, err)
+	logBuildTiming(app, time.Since(start))
 	if err != nil {
 		log.Fatalf("go-app-builder: %v", err)
 	}
@@ -177,7 +272,14 @@ func plural(n int, suffix string) string {
 }
 
 func buildApp(app *App) error {
-	mainStr, err := MakeMain(app)
+	var preMain *Package
+	if *preMainImport != "" {
+		var err error
+		if preMain, err = checkPreMain(app, *preMainImport); err != nil {
+			return fmt.Errorf("bad --pre_main_import %q: %v", *preMainImport, err)
+		}
+	}
+	mainStr, err := MakeMain(app, *preMainImport)
 	if err != nil {
 		return fmt.Errorf("failed creating main: %v", err)
 	}
@@ -186,8 +288,34 @@ func buildApp(app *App) error {
 	if err := ioutil.WriteFile(mainFile, []byte(mainStr), 0640); err != nil {
 		return fmt.Errorf("failed writing main: %v", err)
 	}
+	if !checkImport(*mainImportPath) {
+		return fmt.Errorf("bad --main_import_path %q", *mainImportPath)
+	}
+	if _, ok := app.PackageIndex[*mainImportPath]; ok {
+		return fmt.Errorf("--main_import_path %q collides with an app package", *mainImportPath)
+	}
+	if *race {
+		if err := checkRace(); err != nil {
+			return err
+		}
+	}
+	var versionFlags []string
+	if *versionVar != "" {
+		if !validPackageRef(*versionVar) {
+			return fmt.Errorf(`bad --version_var %q; want a reference like "import/path.Var"`, *versionVar)
+		}
+		value := *versionValue
+		if value == "" {
+			value = time.Now().UTC().Format(time.RFC3339)
+		}
+		versionFlags = []string{"-X", *versionVar, value}
+	}
+	mainDeps := app.RootPackages
+	if preMain != nil {
+		mainDeps = append([]*Package{preMain}, mainDeps...)
+	}
 	app.Packages = append(app.Packages, &Package{
-		ImportPath: "main",
+		ImportPath: *mainImportPath,
 		Files: []*File{
 			&File{
 				Name:        mainFile,
@@ -195,7 +323,7 @@ func buildApp(app *App) error {
 				// don't care about ImportPaths
 			},
 		},
-		Dependencies: app.RootPackages,
+		Dependencies: mainDeps,
 	})
 
 	// Prepare dependency channels.
@@ -209,18 +337,38 @@ func buildApp(app *App) error {
 		// Use a less efficient, but stricter malloc/free.
 		"MALLOC_CHECK_=3",
 	}
+	if *offline {
+		env = append(env, offlineEnv()...)
+	}
 	// Since we pass -I *workDir and -L *workDir to 6g and 6l respectively,
 	// we must also pass -I/-L $GOROOT/pkg/$GOOS_$GOARCH to them before that
 	// to ensure that the $GOROOT versions of dupe packages take precedence.
 	goRootSearchPath := filepath.Join(*goRoot, "pkg", runtime.GOOS+"_"+runtime.GOARCH)
+	if *race {
+		// The race detector needs the instrumented standard library.
+		goRootSearchPath += "_race"
+	}
+
+	// Check any overridden tools up front rather than fail mid-build.
+	for _, t := range []string{*compilerPath, *linkerPath, *packerPath} {
+		if t == "" {
+			continue
+		}
+		if fi, err := os.Stat(t); err != nil || fi.IsDir() {
+			return fmt.Errorf("tool %s not found", t)
+		}
+	}
+	compilerTool := toolOverride(*compilerPath, *arch+"g")
+	packTool := toolOverride(*packerPath, "pack")
+	linker := toolOverride(*linkerPath, *arch+"l")
 
 	// Compile phase.
 	c := &compiler{
 		app:              app,
 		mainFile:         mainFile,
 		goRootSearchPath: goRootSearchPath,
-		compiler:         toolPath(*arch + "g"),
-		gopack:           toolPath("pack"),
+		compiler:         compilerTool,
+		gopack:           packTool,
 		env:              env,
 	}
 	if *extraImports != "" {
@@ -280,29 +428,46 @@ func buildApp(app *App) error {
 	}
 
 	// Link phase.
-	linker := toolPath(*arch + "l")
 	ext := "." + *arch
 	archiveFile := filepath.Join(*workDir, app.Packages[len(app.Packages)-1].ImportPath) + ext
 	binaryFile := filepath.Join(*workDir, *binaryName)
-	args := []string{
-		linker,
-		"-L", goRootSearchPath,
-		"-L", *workDir,
-		"-o", binaryFile,
-	}
-	if !*dynamic {
-		// force the binary to be statically linked, disable dwarf generation, and strip binary
-		args = append(args, "-d", "-w", "-s")
-	}
-	if !*unsafe && !*vm {
-		// reject unsafe code
-		args = append(args, "-u")
+	link := func(name string, strip bool) error {
+		args := []string{
+			linker,
+			"-L", goRootSearchPath,
+			"-L", *workDir,
+			"-o", filepath.Join(*workDir, name),
+		}
+		if *race {
+			args = append(args, "-race")
+		}
+		if !*dynamic && !*race {
+			// force the binary to be statically linked
+			args = append(args, "-d")
+			if strip {
+				// disable dwarf generation, and strip binary
+				args = append(args, "-w", "-s")
+			}
+		}
+		if !*unsafe && !*vm {
+			// reject unsafe code
+			args = append(args, "-u")
+		}
+		args = append(args, versionFlags...)
+		if *ldFlags != "" {
+			args = append(args, parseToolFlags(*ldFlags)...)
+		}
+		args = append(args, archiveFile)
+		return lTimer.run(name, args, env)
 	}
-	if *ldFlags != "" {
-		args = append(args, parseToolFlags(*ldFlags)...)
+	if debugBinary() != "" {
+		// Link the same inputs without stripping, so that the addresses in
+		// the stripped binary's stack traces can be symbolized with it.
+		if err := link(debugBinary(), false); err != nil {
+			return err
+		}
 	}
-	args = append(args, archiveFile)
-	if err := lTimer.run(args, env); err != nil {
+	if err := link(*binaryName, true); err != nil {
 		return err
 	}
 
@@ -314,10 +479,77 @@ func buildApp(app *App) error {
 	if fi.Size() == 0 {
 		return errors.New("created binary has zero size")
 	}
+	if *verifyStatic && !*dynamic && !*race {
+		if err := checkStatic(binaryFile); err != nil {
+			return err
+		}
+	}
 
+	if *writeBuildInfo {
+		if err := writeBuildInfoFile(app); err != nil {
+			return fmt.Errorf("failed writing build info: %v", err)
+		}
+	}
 	return nil
 }
 
+// buildInfo records how a binary was built. It is written as JSON to
+// build-info.json in --work_dir if --write_build_info is set.
+type buildInfo struct {
+	GoVersion  string // the version of the Go installation at --goroot
+	APIVersion string
+	Arch       string
+	GCFlags    string
+	LDFlags    string
+	Binary     string
+	InputsHash string // the buildStamp of the build
+
+	DebugBinary string `json:",omitempty"` // the unstripped binary, with --debug_symbols=separate
+}
+
+// debugSymbolsModes is the set of valid --debug_symbols values.
+var debugSymbolsModes = map[string]bool{
+	"separate": true,
+	"strip":    true,
+}
+
+// debugBinary returns the name, relative to --work_dir, of the unstripped
+// binary to link in addition to --binary_name, or "" if there is none.
+// Dynamic and race builds are never stripped, so there is none for them.
+func debugBinary() string {
+	if *debugSymbols != "separate" || *dynamic || *race {
+		return ""
+	}
+	return *binaryName + ".debug"
+}
+
+func writeBuildInfoFile(app *App) error {
+	stamp, err := buildStamp(app)
+	if err != nil {
+		return err
+	}
+
+	goVersion := runtime.Version()
+	if b, err := ioutil.ReadFile(filepath.Join(*goRoot, "VERSION")); err == nil {
+		goVersion = strings.TrimSpace(string(b))
+	}
+	b, err := json.MarshalIndent(&buildInfo{
+		GoVersion:  goVersion,
+		APIVersion: *apiVersion,
+		Arch:       fullArch(*arch),
+		GCFlags:    gcFlags.String(),
+		LDFlags:    *ldFlags,
+		Binary:     *binaryName,
+		InputsHash: stamp,
+
+		DebugBinary: debugBinary(),
+	}, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(*workDir, "build-info.json"), append(b, '\n'), 0640)
+}
+
 type compiler struct {
 	app              *App
 	mainFile         string
@@ -361,9 +593,10 @@ func (c *compiler) compile(i int, pkg *Package) error {
 		// reject unsafe code
 		args = append(args, "-u")
 	}
-	if *gcFlags != "" {
-		args = append(args, parseToolFlags(*gcFlags)...)
+	if *race {
+		args = append(args, "-race")
 	}
+	args = append(args, gcFlags.forPackage(pkg.ImportPath)...)
 	stripDir := *appBase
 	var files []string
 	if i < len(c.app.Packages)-1 {
@@ -424,13 +657,104 @@ func (c *compiler) compile(i int, pkg *Package) error {
 
 	args = append(args, files...)
 	c.removeLater(objectFile)
-	if err := gTimer.run(args, c.env); err != nil {
+	start := time.Now()
+	err := gTimer.run(pkg.ImportPath, args, c.env)
+	pkg.compile = &timer{name: pkg.ImportPath}
+	pkg.compile.record(time.Since(start))
+	if err != nil {
 		return err
 	}
 
 	return nil
 }
 
+// identName matches the identifier part of a package reference.
+var identName = regexp.MustCompile(`^[\pL_][\pL\pN_]*$`)
+
+// validPackageRef reports whether s is a reference to a package-level
+// identifier, such as "myapp/version.Build", as taken by --version_var and
+// --pre_main_import.
+func validPackageRef(s string) bool {
+	i := strings.LastIndex(s, ".")
+	if i == -1 {
+		return false
+	}
+	return checkImport(s[:i]) && identName.MatchString(s[i+1:])
+}
+
+// checkPreMain checks that ref names an exported function, declared as
+// func F(), in one of app's packages, and returns that package.
+func checkPreMain(app *App, ref string) (*Package, error) {
+	if !validPackageRef(ref) {
+		return nil, errors.New(`want a reference like "import/path.Func"`)
+	}
+	i := strings.LastIndex(ref, ".")
+	path, name := ref[:i], ref[i+1:]
+	pkg := app.PackageIndex[path]
+	if pkg == nil || pkg.Dupe {
+		return nil, fmt.Errorf("package %q is not part of the app", path)
+	}
+	if !ast.IsExported(name) {
+		return nil, fmt.Errorf("%s is not exported", name)
+	}
+	for _, f := range pkg.Files {
+		for _, d := range f.decls {
+			if d.name != name {
+				continue
+			}
+			if !d.niladic {
+				return nil, fmt.Errorf("%s: %s must be declared as func %s()", d.pos, name, name)
+			}
+			return pkg, nil
+		}
+	}
+	return nil, fmt.Errorf("package %q has no function %s", path, name)
+}
+
+// checkStatic returns an error if the ELF or Mach-O binary at filename would
+// need a dynamic linker to run.
+func checkStatic(filename string) error {
+	if f, err := elf.Open(filename); err == nil {
+		defer f.Close()
+		for _, p := range f.Progs {
+			if p.Type == elf.PT_INTERP || p.Type == elf.PT_DYNAMIC {
+				return fmt.Errorf("created binary is dynamically linked (has a %v program header)", p.Type)
+			}
+		}
+		return nil
+	}
+	if f, err := macho.Open(filename); err == nil {
+		defer f.Close()
+		libs, err := f.ImportedLibraries()
+		if err != nil {
+			return fmt.Errorf("failed reading created binary: %v", err)
+		}
+		if len(libs) > 0 {
+			return fmt.Errorf("created binary is dynamically linked against %s", strings.Join(libs, ", "))
+		}
+		return nil
+	}
+	return errors.New("cannot verify static linking: created binary is neither ELF nor Mach-O")
+}
+
+// checkRace reports whether a race detector build is possible for the
+// target architecture and the Go installation at --goroot.
+func checkRace() error {
+	if a := fullArch(*arch); a != "amd64" {
+		return fmt.Errorf("--race is only supported on amd64, not %s", a)
+	}
+	switch runtime.GOOS {
+	case "darwin", "freebsd", "linux", "windows":
+	default:
+		return fmt.Errorf("--race is not supported on %s", runtime.GOOS)
+	}
+	dir := filepath.Join(*goRoot, "pkg", runtime.GOOS+"_"+runtime.GOARCH+"_race")
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		return fmt.Errorf("--race needs a race-enabled standard library in %s", dir)
+	}
+	return nil
+}
+
 func cp(src, dst string) error {
 	in, err := os.Open(src)
 	if err != nil {
@@ -456,27 +780,106 @@ type timer struct {
 	total time.Duration
 }
 
-func (t *timer) run(args, env []string) error {
+func (t *timer) run(label string, args, env []string) error {
 	start := time.Now()
-	err := run(args, env)
+	err := run(label, args, env)
+	t.record(time.Since(start))
+	return err
+}
 
+// record adds one run of duration d to the timer.
+func (t *timer) record(d time.Duration) {
 	t.mu.Lock()
 	t.n++
-	t.total += time.Since(start)
+	t.total += d
 	t.mu.Unlock()
-
-	return err
 }
 
 func (t *timer) String() string {
+	return t.format("×")
+}
+
+// format is like String, but separates the count and name with times.
+func (t *timer) format(times string) string {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
 	// Display total only to millisecond resolution.
 	tot := t.total - (t.total % time.Millisecond)
-	return fmt.Sprintf("%d×%s (%v total)", t.n, t.name, tot)
+	return fmt.Sprintf("%d%s%s (%v total)", t.n, times, t.name, tot)
+}
+
+// timerJSON is the JSON form of a timer for --timing_format=json.
+type timerJSON struct {
+	Phase   string `json:"phase"`
+	Count   int    `json:"count"`
+	TotalNS int64  `json:"total_ns"`
+}
+
+// timingFormats is the set of valid --timing_format values.
+var timingFormats = map[string]bool{
+	"json":  true,
+	"plain": true,
+	"text":  true,
+}
+
+// timingSummary formats the timers as --timing_format specifies.
+func timingSummary(timers ...*timer) string {
+	if *timingFormat == "json" {
+		ts := make([]timerJSON, len(timers))
+		for i, t := range timers {
+			t.mu.Lock()
+			ts[i] = timerJSON{t.name, t.n, int64(t.total)}
+			t.mu.Unlock()
+		}
+		b, err := json.Marshal(ts)
+		if err != nil {
+			return err.Error()
+		}
+		return string(b)
+	}
+	times := "×"
+	if *timingFormat == "plain" {
+		times = "x"
+	}
+	s := make([]string, len(timers))
+	for i, t := range timers {
+		s[i] = t.format(times)
+	}
+	return strings.Join(s, ", ")
+}
+
+// logBuildTiming logs the build's timers as --timing_format specifies, and
+// the total time the build took on a line of its own, so that the JSON form
+// of the timers is not broken.
+func logBuildTiming(app *App, total time.Duration) {
+	log.Printf("go-app-builder: build timing: %s", timingSummary(&gTimer, &pTimer, &lTimer))
+	log.Printf("go-app-builder: build total: %v", total)
+	if *profileBuild {
+		log.Printf("go-app-builder: package timing: %s", packageTimingSummary(app))
+	}
 }
 
+// packageTimingSummary formats the compile timer of each package that was
+// compiled, slowest first, as --timing_format specifies.
+func packageTimingSummary(app *App) string {
+	var timers []*timer
+	for _, pkg := range app.Packages {
+		if pkg.compile != nil {
+			timers = append(timers, pkg.compile)
+		}
+	}
+	sort.Sort(bySlowest(timers))
+	return timingSummary(timers...)
+}
+
+// bySlowest sorts timers by decreasing total time.
+type bySlowest []*timer
+
+func (s bySlowest) Len() int           { return len(s) }
+func (s bySlowest) Less(i, j int) bool { return s[i].total > s[j].total }
+func (s bySlowest) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
 func printExtraFiles(w io.Writer, app *App) {
 	for _, pkg := range app.Packages {
 		if pkg.BaseDir == "" {
@@ -493,26 +896,152 @@ func printExtraFiles(w io.Writer, app *App) {
 }
 
 func printExtraFilesHash(w io.Writer, app *App) {
-	// Compute a hash of the extra files information, namely the name and mtime
-	// of all the extra files. This is sufficient information for the dev_appserver
-	// to be able to decide whether a rebuild is necessary based on GOPATH changes.
+	hash, err := extraFilesHash(app)
+	if err != nil {
+		log.Fatalf("go-app-builder: %v", err)
+	}
+	fmt.Fprint(w, hash)
+}
+
+// extraFilesHash computes a hash of the extra files information, namely the
+// name and mtime of all the extra files. This is sufficient information for
+// the dev_appserver to be able to decide whether a rebuild is necessary based
+// on GOPATH changes.
+func extraFilesHash(app *App) (string, error) {
 	h := sha1.New()
-	sort.Sort(byImportPath(app.Packages)) // be deterministic
-	for _, pkg := range app.Packages {
+	// Sort copies, so that app.Packages keeps its topological order.
+	pkgs := append([]*Package(nil), app.Packages...)
+	sort.Sort(byImportPath(pkgs)) // be deterministic
+	for _, pkg := range pkgs {
 		if pkg.BaseDir == "" {
 			continue // app package
 		}
-		sort.Sort(byFileName(pkg.Files)) // be deterministic
-		for _, f := range pkg.Files {
+		files := append([]*File(nil), pkg.Files...)
+		sort.Sort(byFileName(files)) // be deterministic
+		for _, f := range files {
 			dst := filepath.Join(pkg.BaseDir, f.Name)
 			fi, err := os.Stat(dst)
 			if err != nil {
-				log.Fatalf("go-app-builder: os.Stat(%q): %v", dst, err)
+				return "", fmt.Errorf("os.Stat(%q): %v", dst, err)
 			}
 			fmt.Fprintf(h, "%s: %v\n", dst, fi.ModTime())
 		}
 	}
-	fmt.Fprintf(w, "%x", h.Sum(nil))
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// stampIgnoredFlags are the flags that cannot change the built binary, and
+// so are left out of a build stamp.
+var stampIgnoredFlags = map[string]bool{
+	"daemon":               true,
+	"list_tools":           true,
+	"log_file":             true,
+	"manifest":             true, // its settings are stamped in their own right
+	"parallelism":          true,
+	"prev_extras_hash":     true,
+	"print_deps":           true,
+	"print_extra_packages": true,
+	"print_extras":         true,
+	"print_extras_hash":    true,
+	"profile_build":        true,
+	"timing_format":        true,
+	"v":                    true,
+}
+
+// buildStamp returns a hash identifying the inputs of a build: the hash of
+// the extra files, the sorted list of app files with their sizes and mtimes,
+// and the value of every flag that can affect the binary.
+func buildStamp(app *App) (string, error) {
+	extra, err := extraFilesHash(app)
+	if err != nil {
+		return "", err
+	}
+	h := sha1.New()
+	fmt.Fprintf(h, "extras: %s\n", extra)
+	files := append([]*File(nil), app.Files...)
+	sort.Sort(byFileName(files)) // be deterministic
+	for _, f := range files {
+		name := filepath.Join(*appBase, f.Name)
+		fi, err := os.Stat(name)
+		if err != nil {
+			return "", fmt.Errorf("os.Stat(%q): %v", name, err)
+		}
+		fmt.Fprintf(h, "%s: %d %v\n", name, fi.Size(), fi.ModTime())
+	}
+	flag.VisitAll(func(f *flag.Flag) { // in lexical order
+		if !stampIgnoredFlags[f.Name] {
+			fmt.Fprintf(h, "-%s=%q\n", f.Name, f.Value.String())
+		}
+	})
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// stampFile is where a successful build records its buildStamp.
+func stampFile() string {
+	return filepath.Join(*workDir, *binaryName+".stamp")
+}
+
+// writeStamp records the stamp of the build that just produced the binary,
+// or removes any old stamp if the build failed.
+func writeStamp(app *App, buildErr error) {
+	if buildErr == nil {
+		stamp, err := buildStamp(app)
+		if err == nil {
+			err = ioutil.WriteFile(stampFile(), []byte(stamp), 0640)
+		}
+		if err == nil {
+			return
+		}
+		log.Printf("go-app-builder: Failed writing build stamp: %v", err)
+	}
+	os.Remove(stampFile())
+}
+
+// upToDate reports whether the binary from a previous build can be reused.
+// This is the case only if the extra files still hash to prevHash, and the
+// binary exists along with the stamp written by the build that produced it,
+// and the stamp matches the current build's. Any doubt forces a build.
+func upToDate(app *App, prevHash string) bool {
+	hash, err := extraFilesHash(app)
+	if err != nil || hash != prevHash {
+		return false
+	}
+	bfi, err := os.Stat(filepath.Join(*workDir, *binaryName))
+	if err != nil || bfi.Size() == 0 {
+		return false
+	}
+	prev, err := ioutil.ReadFile(stampFile())
+	if err != nil {
+		return false
+	}
+	stamp, err := buildStamp(app)
+	return err == nil && string(prev) == stamp
+}
+
+// printPackageDeps prints the import graph of the app, one line per package:
+// the package's import path, a colon, and the space-separated import paths
+// imported by any of its files. Packages and imports are sorted.
+func printPackageDeps(w io.Writer, app *App) {
+	pkgs := append([]*Package(nil), app.Packages...)
+	sort.Sort(byImportPath(pkgs)) // be deterministic
+	for _, pkg := range pkgs {
+		seen := make(map[string]bool)
+		var imps []string
+		for _, f := range pkg.Files {
+			for _, imp := range f.ImportPaths {
+				if !seen[imp] {
+					seen[imp] = true
+					imps = append(imps, imp)
+				}
+			}
+		}
+		sort.Strings(imps)
+		fmt.Fprintf(w, "%s:", pkg.ImportPath)
+		for _, imp := range imps {
+			fmt.Fprintf(w, " %s", imp)
+		}
+		fmt.Fprintln(w)
+	}
 }
 
 func printExtraPackages(w io.Writer, app *App) {
@@ -550,6 +1079,36 @@ func printExtraPackages(w io.Writer, app *App) {
 	}
 }
 
+// toolOverride returns override if it is set, and toolPath(x) otherwise.
+func toolOverride(override, x string) string {
+	if override != "" {
+		return override
+	}
+	return toolPath(x)
+}
+
+// printTools prints the path of each tool that a build would run, as
+// resolved from --goroot, --arch and any overrides, and the version that the
+// tool reports for -V, if it supports that.
+func printTools(w io.Writer) {
+	tools := []struct{ name, path string }{
+		{"compiler", toolOverride(*compilerPath, *arch+"g")},
+		{"linker", toolOverride(*linkerPath, *arch+"l")},
+		{"packer", toolOverride(*packerPath, "pack")},
+	}
+	for _, t := range tools {
+		version := "not found"
+		if fi, err := os.Stat(t.path); err == nil && !fi.IsDir() {
+			version = "unknown version"
+			out, err := exec.Command(t.path, "-V").CombinedOutput()
+			if line := strings.TrimSpace(strings.SplitN(string(out), "\n", 2)[0]); err == nil && line != "" {
+				version = line
+			}
+		}
+		fmt.Fprintf(w, "%s: %s (%s)\n", t.name, t.path, version)
+	}
+}
+
 func toolPath(x string) string {
 	ext := ""
 	if runtime.GOOS == "windows" {
@@ -558,16 +1117,88 @@ func toolPath(x string) string {
 	return filepath.Join(*goRoot, "pkg", "tool", runtime.GOOS+"_"+fullArch(*arch), x+ext)
 }
 
+// expandResponseFiles returns args with each argument of the form @file
+// replaced by the newline-separated file names listed in file.
+// Blank lines are ignored. Like the other arguments, the listed names are
+// relative to --app_base; the response file's own path is not.
+func expandResponseFiles(args []string) ([]string, error) {
+	var files []string
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "@") {
+			files = append(files, arg)
+			continue
+		}
+		b, err := ioutil.ReadFile(arg[1:])
+		if err != nil {
+			return nil, fmt.Errorf("failed reading response file: %v", err)
+		}
+		for _, line := range strings.Split(string(b), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				files = append(files, line)
+			}
+		}
+	}
+	return files, nil
+}
+
 func usage() {
-	fmt.Fprintf(os.Stderr, "Usage:  %s [options] <foo.go> ...\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Usage:  %s [options] <foo.go | @file> ...\n", os.Args[0])
 	flag.PrintDefaults()
 }
 
-func run(args []string, env []string) error {
+// offlineTools returns the tools that --offline permits running: the
+// toolchain directory of --goroot, ending in a separator, and any tools
+// explicitly named by --compiler, --linker or --packer. None of these fetch
+// anything over the network.
+func offlineTools() []string {
+	tools := []string{filepath.Dir(toolPath("pack")) + string(filepath.Separator)}
+	for _, t := range []string{*compilerPath, *linkerPath, *packerPath} {
+		if t != "" {
+			tools = append(tools, t)
+		}
+	}
+	return tools
+}
+
+// offlineAllowed reports whether --offline permits running the tool at path.
+func offlineAllowed(path string) bool {
+	for _, t := range offlineTools() {
+		if path == t || filepath.Dir(path)+string(filepath.Separator) == t {
+			return true
+		}
+	}
+	return false
+}
+
+// offlineEnv returns the variables that --offline adds to the tools'
+// environment. They turn off module, checksum and toolchain downloads, and
+// pass offlineTools to a --trampoline in GAB_OFFLINE_TOOLS, separated by
+// filepath.ListSeparator. run checks each tool before handing it to the
+// trampoline; a trampoline that launches anything else must refuse to unless
+// it is a listed tool or in a listed directory.
+func offlineEnv() []string {
+	return []string{
+		"GOPROXY=off",
+		"GOSUMDB=off",
+		"GOTOOLCHAIN=local",
+		"GAB_OFFLINE_TOOLS=" + strings.Join(offlineTools(), string(filepath.ListSeparator)),
+	}
+}
+
+// outputMu serializes the writing of tools' output by run.
+var outputMu sync.Mutex
+
+// run runs the tool named by args[0]. Its combined output is buffered, and
+// then written to stderr in one piece under a header line naming label,
+// so that the output of tools run in parallel does not interleave.
+func run(label string, args []string, env []string) error {
 	if *verbose {
 		log.Printf("run %v", args)
 	}
 	tool := filepath.Base(args[0])
+	if *offline && !offlineAllowed(args[0]) {
+		return fmt.Errorf("--offline: refusing to run %s, which is not a toolchain tool", args[0])
+	}
 	if *trampoline != "" {
 		// Add trampoline binary, its flags, and -- to the start.
 		newArgs := []string{*trampoline}
@@ -577,14 +1208,22 @@ func run(args []string, env []string) error {
 		newArgs = append(newArgs, "--")
 		args = append(newArgs, args...)
 	}
+	var out bytes.Buffer
 	cmd := &exec.Cmd{
 		Path:   args[0],
 		Args:   args,
 		Env:    env,
-		Stdout: os.Stdout,
-		Stderr: os.Stderr,
+		Stdout: &out,
+		Stderr: &out,
+	}
+	err := cmd.Run()
+	if out.Len() > 0 {
+		outputMu.Lock()
+		fmt.Fprintf(os.Stderr, "# %s\n", label)
+		os.Stderr.Write(out.Bytes())
+		outputMu.Unlock()
 	}
-	if err := cmd.Run(); err != nil {
+	if err != nil {
 		return fmt.Errorf("failed running %v: %v", tool, err)
 	}
 	return nil
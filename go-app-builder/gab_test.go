@@ -0,0 +1,183 @@
+// Copyright 2015 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildStamp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gab-stamp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"a.go", "b.go"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("package a\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func(old string) { *appBase = old }(*appBase)
+	*appBase = dir
+
+	stamp := func(names ...string) string {
+		app := &App{}
+		for _, name := range names {
+			app.Files = append(app.Files, &File{Name: name})
+		}
+		s, err := buildStamp(app)
+		if err != nil {
+			t.Fatalf("buildStamp: %v", err)
+		}
+		return s
+	}
+
+	base := stamp("a.go", "b.go")
+	if got := stamp("b.go", "a.go"); got != base {
+		t.Errorf("stamp depends on file order")
+	}
+	if got := stamp("a.go"); got == base {
+		t.Errorf("stamp unchanged after removing a file")
+	}
+
+	defer func(old bool) { *verbose = old }(*verbose)
+	*verbose = !*verbose
+	if got := stamp("a.go", "b.go"); got != base {
+		t.Errorf("stamp changed with -v")
+	}
+
+	defer func(old bool) { *race = old }(*race)
+	*race = !*race
+	if got := stamp("a.go", "b.go"); got == base {
+		t.Errorf("stamp unchanged after changing -race")
+	}
+	*race = !*race
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "b.go"), []byte("package a\n\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := stamp("a.go", "b.go"); got == base {
+		t.Errorf("stamp unchanged after changing a file's size")
+	}
+}
+
+func TestBuildInfoInputsHash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gab-info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "a.go"), []byte("package a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer func(base, work string) { *appBase, *workDir = base, work }(*appBase, *workDir)
+	*appBase, *workDir = dir, dir
+
+	app := &App{Files: []*File{{Name: "a.go"}}}
+	if err := writeBuildInfoFile(app); err != nil {
+		t.Fatalf("writeBuildInfoFile: %v", err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "build-info.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info buildInfo
+	if err := json.Unmarshal(b, &info); err != nil {
+		t.Fatal(err)
+	}
+	if stamp, err := buildStamp(app); err != nil || info.InputsHash != stamp {
+		t.Errorf("got InputsHash %q, want the build stamp %q (%v)", info.InputsHash, stamp, err)
+	}
+}
+
+func TestOfflineAllowed(t *testing.T) {
+	defer func(old string) { *goRoot = old }(*goRoot)
+	defer func(old string) { *compilerPath = old }(*compilerPath)
+	*goRoot = "/goroot"
+	*compilerPath = "/opt/bin/mygc"
+
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{toolPath("gc"), true},
+		{toolPath("link"), true},
+		{"/opt/bin/mygc", true},
+		{"/opt/bin/mylink", false},
+		{"/usr/bin/curl", false},
+		{"/goroot/bin/go", false},
+	}
+	for _, tt := range tests {
+		if got := offlineAllowed(tt.path); got != tt.want {
+			t.Errorf("offlineAllowed(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestOfflineEnv(t *testing.T) {
+	defer func(old string) { *goRoot = old }(*goRoot)
+	defer func(old string) { *linkerPath = old }(*linkerPath)
+	*goRoot = "/goroot"
+	*linkerPath = "/opt/bin/mylink"
+
+	want := map[string]bool{
+		"GOPROXY=off":       true,
+		"GOSUMDB=off":       true,
+		"GOTOOLCHAIN=local": true,
+		"GAB_OFFLINE_TOOLS=" + filepath.Dir(toolPath("pack")) + string(filepath.Separator) + string(filepath.ListSeparator) + "/opt/bin/mylink": true,
+	}
+	env := offlineEnv()
+	for _, kv := range env {
+		if !want[kv] {
+			t.Errorf("unexpected variable %q", kv)
+		}
+		delete(want, kv)
+	}
+	for kv := range want {
+		t.Errorf("missing variable %q in %q", kv, env)
+	}
+}
+
+func TestLogBuildTimingJSON(t *testing.T) {
+	defer func(old string) { *timingFormat = old }(*timingFormat)
+	defer func(old bool) { *profileBuild = old }(*profileBuild)
+	defer log.SetOutput(os.Stderr)
+	defer log.SetFlags(log.Flags())
+	*timingFormat, *profileBuild = "json", true
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+
+	pkg := &Package{ImportPath: "foo", compile: &timer{name: "foo", n: 1, total: time.Second}}
+	logBuildTiming(&App{Packages: []*Package{pkg}}, 2*time.Second)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("got %d lines, want 3:\n%s", len(lines), buf.String())
+	}
+	for _, prefix := range []string{"go-app-builder: build timing: ", "go-app-builder: package timing: "} {
+		var line string
+		for _, l := range lines {
+			if strings.HasPrefix(l, prefix) {
+				line = l
+			}
+		}
+		var ts []timerJSON
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, prefix)), &ts); err != nil {
+			t.Errorf("line %q is not %q followed by JSON: %v", line, prefix, err)
+		}
+	}
+	if want := "go-app-builder: build total: 2s"; lines[1] != want {
+		t.Errorf("got %q, want %q", lines[1], want)
+	}
+}
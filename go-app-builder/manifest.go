@@ -0,0 +1,165 @@
+// Copyright 2015 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+// A manifest is a JSON file, named by --manifest, that describes a build for
+// build systems that already know the app's layout. For example:
+//
+//	{
+//		"app_base": "/path/to/app",
+//		"files": ["main.go", "foo/foo.go"],
+//		"pkg_dupe_whitelist": ["errors"],
+//		"packages": [
+//			{"import_path": "bar", "files": ["bar.go"], "dupe_ok": true},
+//			{"import_path": "example.com/lib", "base_dir": "/src/lib", "files": ["lib.go"]}
+//		]
+//	}
+//
+// app_base replaces --app_base, files are built along with any named on the
+// command line, and pkg_dupe_whitelist is added to --pkg_dupe_whitelist.
+//
+// Each element of packages describes one package. Its files are relative to
+// its base_dir, which defaults to the package's directory in the app. A
+// package with a base_dir is built from there, like a package in --gopath,
+// instead of being found by the directories of the app's files. dupe_ok adds
+// the package's import path to --pkg_dupe_whitelist.
+//
+// Every field is optional except a package's import_path and files, but
+// unknown fields are an error.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+type manifest struct {
+	AppBase          string            `json:"app_base"`
+	Files            []string          `json:"files"`
+	PkgDupeWhitelist []string          `json:"pkg_dupe_whitelist"`
+	Packages         []manifestPackage `json:"packages"`
+}
+
+type manifestPackage struct {
+	ImportPath string   `json:"import_path"`
+	BaseDir    string   `json:"base_dir"`
+	Files      []string `json:"files"`
+	DupeOK     bool     `json:"dupe_ok"`
+}
+
+// manifestFields and manifestPackageFields are the sets of JSON field names
+// in a manifest and in each of its packages.
+var (
+	manifestFields = map[string]bool{
+		"app_base":           true,
+		"files":              true,
+		"pkg_dupe_whitelist": true,
+		"packages":           true,
+	}
+	manifestPackageFields = map[string]bool{
+		"import_path": true,
+		"base_dir":    true,
+		"files":       true,
+		"dupe_ok":     true,
+	}
+)
+
+// manifestPkgs are the manifest's packages that have a base_dir, which
+// ParseFiles adds to the app.
+var manifestPkgs []manifestPackage
+
+func readManifest(filename string) (*manifest, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, fmt.Errorf("bad manifest %s: %v", filename, err)
+	}
+	if err := checkFields(fields, manifestFields); err != nil {
+		return nil, fmt.Errorf("bad manifest %s: %v", filename, err)
+	}
+	if raw, ok := fields["packages"]; ok {
+		var pkgs []map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &pkgs); err != nil {
+			return nil, fmt.Errorf("bad manifest %s: %v", filename, err)
+		}
+		for _, p := range pkgs {
+			if err := checkFields(p, manifestPackageFields); err != nil {
+				return nil, fmt.Errorf("bad manifest %s: package: %v", filename, err)
+			}
+		}
+	}
+	m := new(manifest)
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, fmt.Errorf("bad manifest %s: %v", filename, err)
+	}
+	if err := checkFileNames(m.Files); err != nil {
+		return nil, fmt.Errorf("bad manifest %s: %v", filename, err)
+	}
+	for _, p := range m.Packages {
+		if p.ImportPath == "" {
+			return nil, fmt.Errorf("bad manifest %s: package with no import_path", filename)
+		}
+		if len(p.Files) == 0 {
+			return nil, fmt.Errorf("bad manifest %s: package %q has no files", filename, p.ImportPath)
+		}
+		if err := checkFileNames(p.Files); err != nil {
+			return nil, fmt.Errorf("bad manifest %s: package %q: %v", filename, p.ImportPath, err)
+		}
+	}
+	return m, nil
+}
+
+// checkFields returns an error if fields has a name that is not in known.
+func checkFields(fields map[string]json.RawMessage, known map[string]bool) error {
+	for f := range fields {
+		if !known[f] {
+			return fmt.Errorf("unknown field %q", f)
+		}
+	}
+	return nil
+}
+
+func checkFileNames(files []string) error {
+	for _, f := range files {
+		if f == "" {
+			return fmt.Errorf("empty file name")
+		}
+	}
+	return nil
+}
+
+// applyManifest merges the manifest into the flags and manifestPkgs, and
+// returns the files it names in the app.
+func applyManifest(m *manifest) []string {
+	if m.AppBase != "" {
+		*appBase = m.AppBase
+	}
+	files := m.Files
+	dupes := m.PkgDupeWhitelist
+	for _, p := range m.Packages {
+		if p.DupeOK {
+			dupes = append(dupes, p.ImportPath)
+		}
+		if p.BaseDir != "" {
+			manifestPkgs = append(manifestPkgs, p)
+			continue
+		}
+		for _, f := range p.Files {
+			files = append(files, filepath.Join(filepath.FromSlash(p.ImportPath), f))
+		}
+	}
+	if len(dupes) > 0 {
+		if *pkgDupes != "" {
+			dupes = append(strings.Split(*pkgDupes, ","), dupes...)
+		}
+		*pkgDupes = strings.Join(dupes, ",")
+	}
+	return files
+}
@@ -0,0 +1,178 @@
+// Copyright 2015 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadManifest(t *testing.T) {
+	tests := []struct {
+		desc    string
+		json    string
+		want    *manifest
+		wantErr string
+	}{
+		{
+			desc: "all fields",
+			json: `{"app_base": "/app", "files": ["a.go"], "pkg_dupe_whitelist": ["errors"],
+				"packages": [{"import_path": "lib", "base_dir": "/lib", "files": ["lib.go"], "dupe_ok": true}]}`,
+			want: &manifest{
+				AppBase:          "/app",
+				Files:            []string{"a.go"},
+				PkgDupeWhitelist: []string{"errors"},
+				Packages: []manifestPackage{
+					{ImportPath: "lib", BaseDir: "/lib", Files: []string{"lib.go"}, DupeOK: true},
+				},
+			},
+		},
+		{
+			desc: "no fields",
+			json: `{}`,
+			want: &manifest{},
+		},
+		{
+			desc:    "unknown field",
+			json:    `{"files": ["a.go"], "appbase": "/app"}`,
+			wantErr: `unknown field "appbase"`,
+		},
+		{
+			desc:    "unknown package field",
+			json:    `{"packages": [{"import_path": "lib", "files": ["lib.go"], "dir": "/lib"}]}`,
+			wantErr: `package: unknown field "dir"`,
+		},
+		{
+			desc:    "empty file name",
+			json:    `{"files": ["a.go", ""]}`,
+			wantErr: "empty file name",
+		},
+		{
+			desc:    "empty package file name",
+			json:    `{"packages": [{"import_path": "lib", "files": [""]}]}`,
+			wantErr: `package "lib": empty file name`,
+		},
+		{
+			desc:    "package with no import path",
+			json:    `{"packages": [{"files": ["lib.go"]}]}`,
+			wantErr: "package with no import_path",
+		},
+		{
+			desc:    "package with no files",
+			json:    `{"packages": [{"import_path": "lib"}]}`,
+			wantErr: `package "lib" has no files`,
+		},
+		{
+			desc:    "wrong type",
+			json:    `{"files": "a.go"}`,
+			wantErr: "cannot unmarshal",
+		},
+	}
+	for _, tt := range tests {
+		f, err := ioutil.TempFile("", "gab-manifest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString(tt.json)
+		f.Close()
+		got, err := readManifest(f.Name())
+		os.Remove(f.Name())
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: got error %v, want one containing %q", tt.desc, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.desc, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.desc, got, tt.want)
+		}
+	}
+}
+
+func TestApplyManifest(t *testing.T) {
+	defer func(base, dupes string, pkgs []manifestPackage) {
+		*appBase, *pkgDupes, manifestPkgs = base, dupes, pkgs
+	}(*appBase, *pkgDupes, manifestPkgs)
+	*appBase, *pkgDupes, manifestPkgs = "/flag", "os", nil
+
+	lib := manifestPackage{ImportPath: "example.com/lib", BaseDir: "/lib", Files: []string{"lib.go"}}
+	files := applyManifest(&manifest{
+		AppBase:          "/app",
+		Files:            []string{"main.go"},
+		PkgDupeWhitelist: []string{"errors"},
+		Packages: []manifestPackage{
+			{ImportPath: "foo/bar", Files: []string{"a.go", "b.go"}, DupeOK: true},
+			lib,
+		},
+	})
+	if want := []string{"main.go", filepath.Join("foo", "bar", "a.go"), filepath.Join("foo", "bar", "b.go")}; !reflect.DeepEqual(files, want) {
+		t.Errorf("got files %q, want %q", files, want)
+	}
+	if *appBase != "/app" {
+		t.Errorf("got --app_base %q, want %q", *appBase, "/app")
+	}
+	if want := "os,errors,foo/bar"; *pkgDupes != want {
+		t.Errorf("got --pkg_dupe_whitelist %q, want %q", *pkgDupes, want)
+	}
+	if want := []manifestPackage{lib}; !reflect.DeepEqual(manifestPkgs, want) {
+		t.Errorf("got manifest packages %+v, want %+v", manifestPkgs, want)
+	}
+
+	// A manifest without those settings leaves the flags alone.
+	*appBase, *pkgDupes = "/flag", "os"
+	applyManifest(&manifest{})
+	if *appBase != "/flag" || *pkgDupes != "os" {
+		t.Errorf("got --app_base %q and --pkg_dupe_whitelist %q, want them unchanged", *appBase, *pkgDupes)
+	}
+}
+
+func TestParseFilesManifestPackage(t *testing.T) {
+	dir, names, done := writeApp(t, map[string]string{
+		"app/main.go": "package app\n\nimport \"example.com/lib\"\n\nfunc init() { lib.F() }\n",
+		"lib/lib.go":  "package lib\n\nfunc F() {}\n",
+		"lib/init.go": "package lib\n\nfunc init() {}\n",
+	})
+	defer done()
+	defer func(pkgs []manifestPackage) { manifestPkgs = pkgs }(manifestPkgs)
+	libDir := filepath.Join(dir, "lib")
+	manifestPkgs = []manifestPackage{
+		{ImportPath: "example.com/lib", BaseDir: libDir, Files: []string{"lib.go", "init.go"}},
+	}
+
+	var appNames []string
+	for _, name := range names {
+		if filepath.Dir(name) == "app" {
+			appNames = append(appNames, name)
+		}
+	}
+	app, err := ParseFiles(dir, appNames)
+	if err != nil {
+		t.Fatalf("ParseFiles: %v", err)
+	}
+	lib := app.PackageIndex["example.com/lib"]
+	if lib == nil {
+		t.Fatalf("no package example.com/lib in %v", app.Packages)
+	}
+	if lib.BaseDir != libDir || len(lib.Files) != 2 || !lib.HasInit {
+		t.Errorf("got package %v, want two files in %s with an init function", lib, libDir)
+	}
+	if deps := app.PackageIndex["app"].Dependencies; len(deps) != 1 || deps[0] != lib {
+		t.Errorf("got app dependencies %v, want example.com/lib", deps)
+	}
+
+	// A manifest package may not replace one of the app's.
+	manifestPkgs[0].ImportPath = "app"
+	if _, err := ParseFiles(dir, appNames); err == nil || !strings.Contains(err.Error(), "is also in the app") {
+		t.Errorf("got error %v, want a collision with the app package", err)
+	}
+}
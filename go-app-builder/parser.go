@@ -6,7 +6,6 @@ package main
 
 import (
 	"bytes"
-	"errors"
 	"fmt"
 	"go/ast"
 	"go/build"
@@ -49,6 +48,7 @@ type Package struct {
 	Dupe         bool       // whether the package is a duplicate
 
 	compiled chan struct{} // closed when the package has finished compiling
+	compile  *timer        // time spent compiling the package, for --profile_build
 }
 
 func (p *Package) String() string {
@@ -68,6 +68,15 @@ type File struct {
 	ImportPaths []string // import paths
 	HasInit     bool     // whether the file has an init function
 	HasMain     bool     // whether the file has internal.Main
+
+	decls []decl // top-level declarations, for finding duplicates
+}
+
+// decl is a top-level declaration in a file. Methods are named T.M.
+type decl struct {
+	name    string
+	pos     token.Position
+	niladic bool // whether it is a function with no arguments or results
 }
 
 func (f *File) String() string {
@@ -196,32 +205,49 @@ func ParseFiles(baseDir string, filenames []string) (*App, error) {
 			imp = fmt.Sprintf("main%05d", rng.Intn(1e5))
 		}
 
+		if err := checkDuplicateDecls(files); err != nil {
+			return nil, err
+		}
+
 		p := &Package{
 			ImportPath: imp,
 			Files:      files,
 		}
-		if p.ImportPath == "main" {
-			return nil, errors.New("top-level main package is forbidden")
-		}
-		if isStandardPackage(p.ImportPath) {
-			if !allowedDupes[p.ImportPath] {
-				return nil, fmt.Errorf("package %q has the same name as a standard package", p.ImportPath)
+		if dirname != "." {
+			if err := checkDupe(p, filepath.Join(baseDir, dirname), allowedDupes); err != nil {
+				return nil, err
 			}
-			p.Dupe = true
 		}
-		for _, f := range files {
-			if f.HasInit {
-				p.HasInit = true
-			}
-			if f.HasMain {
-				p.HasMain = true
+		if err := app.addPackage(p); err != nil {
+			return nil, err
+		}
+	}
+
+	// Add the --manifest packages that are outside the app.
+	for _, mp := range manifestPkgs {
+		if app.PackageIndex[mp.ImportPath] != nil {
+			return nil, fmt.Errorf("manifest package %q in %s is also in the app", mp.ImportPath, mp.BaseDir)
+		}
+		p := &Package{
+			ImportPath: mp.ImportPath,
+			BaseDir:    mp.BaseDir,
+		}
+		for _, name := range mp.Files {
+			f, err := parseFile(mp.BaseDir, name)
+			if err != nil {
+				return nil, err
 			}
+			p.Files = append(p.Files, f)
 		}
-		app.Packages = append(app.Packages, p)
-		if p.HasInit || *vm {
-			app.RootPackages = append(app.RootPackages, p)
+		if err := checkDuplicateDecls(p.Files); err != nil {
+			return nil, err
+		}
+		if err := checkDupe(p, mp.BaseDir, allowedDupes); err != nil {
+			return nil, err
+		}
+		if err := app.addPackage(p); err != nil {
+			return nil, err
 		}
-		app.PackageIndex[p.ImportPath] = p
 	}
 
 	if *goPath != "" {
@@ -279,6 +305,12 @@ func ParseFiles(baseDir string, filenames []string) (*App, error) {
 		sort.Sort(byImportPath(p.Dependencies))
 	}
 
+	if *excludePkgs != "" {
+		if err := excludeRootPackages(app, strings.Split(*excludePkgs, ",")); err != nil {
+			return nil, err
+		}
+	}
+
 	// Sort topologically.
 	if err := topologicalSort(app.Packages); err != nil {
 		return nil, err
@@ -287,6 +319,27 @@ func ParseFiles(baseDir string, filenames []string) (*App, error) {
 	return app, nil
 }
 
+// addPackage adds p, a package of the app's own source, to the app.
+func (app *App) addPackage(p *Package) error {
+	if p.ImportPath == *mainImportPath {
+		return fmt.Errorf("package %q collides with the synthetic main package; see --main_import_path", p.ImportPath)
+	}
+	for _, f := range p.Files {
+		if f.HasInit {
+			p.HasInit = true
+		}
+		if f.HasMain {
+			p.HasMain = true
+		}
+	}
+	app.Packages = append(app.Packages, p)
+	if p.HasInit || *vm {
+		app.RootPackages = append(app.RootPackages, p)
+	}
+	app.PackageIndex[p.ImportPath] = p
+	return nil
+}
+
 // appFilesInGOPATH returns a set of app files that are in the GOPATH.
 // The constructed set of filenames is relative to the GOPATH's 'src' dir.
 // If any of these files appear in a package's source files, an error
@@ -311,6 +364,63 @@ func appFilesInGOPATH(baseDir, goPath string, app *App) map[string]bool {
 	return r
 }
 
+// checkDupe reports an error if the app package p, whose source is in dir,
+// has the same import path as a standard package, unless the path is in
+// allowed (--pkg_dupe_whitelist). A permitted duplicate of a standard package
+// is marked as a Dupe, since the $GOROOT version takes precedence.
+//
+// An app package with the same import path as a package in --gopath is also
+// an error unless the path is in allowed. With --reject_gopath_dupes=false,
+// the app package instead shadows that package, and a warning naming both
+// directories is logged.
+func checkDupe(p *Package, dir string, allowed map[string]bool) error {
+	if isStandardPackage(p.ImportPath) {
+		if allowed[p.ImportPath] {
+			p.Dupe = true
+			return nil
+		}
+		other, err := buildContext("").Import(p.ImportPath, "/nowhere", build.FindOnly)
+		if err != nil {
+			return fmt.Errorf("package %q in %s has the same import path as a standard package, which could not be located (%v); add %q to --pkg_dupe_whitelist if this is intended",
+				p.ImportPath, dir, err, p.ImportPath)
+		}
+		return dupeError(p, dir, "standard package", other.Dir)
+	}
+	if *goPath == "" || allowed[p.ImportPath] {
+		return nil
+	}
+	other, err := gopathPackage(p.ImportPath)
+	if err != nil || sameDir(other.Dir, dir) { // the app may itself be in $GOPATH
+		return nil
+	}
+	if !*rejectDupes {
+		log.Printf("go-app-builder: warning: package %q in %s shadows the package in $GOPATH in %s; add %q to --pkg_dupe_whitelist if this is intended",
+			p.ImportPath, dir, other.Dir, p.ImportPath)
+		return nil
+	}
+	return dupeError(p, dir, "package in $GOPATH", other.Dir)
+}
+
+// dupeError returns the error for an app package p, in dir, that duplicates
+// the package of the given kind in otherDir.
+func dupeError(p *Package, dir, kind, otherDir string) error {
+	return fmt.Errorf("package %q in %s has the same import path as the %s in %s; add %q to --pkg_dupe_whitelist if this is intended",
+		p.ImportPath, dir, kind, otherDir, p.ImportPath)
+}
+
+// sameDir reports whether a and b name the same directory.
+func sameDir(a, b string) bool {
+	fa, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	fb, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(fa, fb)
+}
+
 func validatePkgPaths(pkg *build.Package, appFilesInGOPATH map[string]bool) error {
 	for _, f := range pkg.GoFiles {
 		n := filepath.Join(pkg.ImportPath, f)
@@ -321,6 +431,56 @@ func validatePkgPaths(pkg *build.Package, appFilesInGOPATH map[string]bool) erro
 	return nil
 }
 
+// excludeRootPackages removes the named packages from the app's root packages,
+// so that the synthetic main package does not import them and their init
+// functions are not linked in. It is an error for an excluded package to
+// still be reachable from the remaining root packages.
+func excludeRootPackages(app *App, paths []string) error {
+	excluded := make(map[string]bool)
+	for _, path := range paths {
+		if app.PackageIndex[path] == nil {
+			return fmt.Errorf("excluded package %q is not part of the app", path)
+		}
+		if path == app.InternalPkg {
+			return fmt.Errorf("excluded package %q has internal.Main", path)
+		}
+		excluded[path] = true
+	}
+
+	roots := app.RootPackages[:0]
+	for _, p := range app.RootPackages {
+		if !excluded[p.ImportPath] {
+			roots = append(roots, p)
+		}
+	}
+	app.RootPackages = roots
+
+	// Walk the packages reachable from the remaining roots.
+	seen := make(map[*Package]bool)
+	queue := append([]*Package(nil), roots...)
+	if p := app.PackageIndex[app.InternalPkg]; p != nil {
+		queue = append(queue, p)
+	}
+	for _, p := range queue {
+		seen[p] = true
+	}
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+		for _, dep := range p.Dependencies {
+			if seen[dep] {
+				continue
+			}
+			if excluded[dep.ImportPath] {
+				return fmt.Errorf("excluded package %q is imported by %q", dep.ImportPath, p.ImportPath)
+			}
+			seen[dep] = true
+			queue = append(queue, dep)
+		}
+	}
+	return nil
+}
+
 // addFromGOPATH adds packages from GOPATH that are needed by the app.
 func addFromGOPATH(app *App, noBuild *regexp.Regexp, appFilesInGOPATH map[string]bool) error {
 	warned := make(map[string]bool)
@@ -390,6 +550,78 @@ func addFromGOPATH(app *App, noBuild *regexp.Regexp, appFilesInGOPATH map[string
 	return nil
 }
 
+// topLevelDecls returns the names declared at the top level of file,
+// other than init functions and blank identifiers.
+func topLevelDecls(fset *token.FileSet, file *ast.File) []decl {
+	var decls []decl
+	add := func(id *ast.Ident, name string) {
+		if id.Name != "_" {
+			decls = append(decls, decl{name: name, pos: fset.Position(id.Pos())})
+		}
+	}
+	for _, d := range file.Decls {
+		switch d := d.(type) {
+		case *ast.GenDecl:
+			for _, spec := range d.Specs {
+				switch spec := spec.(type) {
+				case *ast.TypeSpec:
+					add(spec.Name, spec.Name.Name)
+				case *ast.ValueSpec:
+					for _, id := range spec.Names {
+						add(id, id.Name)
+					}
+				}
+			}
+		case *ast.FuncDecl:
+			if d.Recv == nil {
+				if !isInit(d) {
+					add(d.Name, d.Name.Name)
+					if d.Name.Name != "_" {
+						decls[len(decls)-1].niladic = isNiladic(d, d.Name.Name)
+					}
+				}
+				continue
+			}
+			if len(d.Recv.List) == 0 {
+				continue
+			}
+			typ := d.Recv.List[0].Type
+			if star, ok := typ.(*ast.StarExpr); ok {
+				typ = star.X
+			}
+			if id, ok := typ.(*ast.Ident); ok {
+				add(d.Name, id.Name+"."+d.Name.Name)
+			}
+		}
+	}
+	return decls
+}
+
+// checkDuplicateDecls returns an error for each name declared more than once
+// at the top level of the package's files, naming both declarations.
+func checkDuplicateDecls(files []*File) error {
+	files = append([]*File(nil), files...)
+	sort.Sort(byFileName(files)) // be deterministic
+	var errs scanner.ErrorList
+	seen := make(map[string]token.Position)
+	for _, f := range files {
+		for _, d := range f.decls {
+			if prev, ok := seen[d.name]; ok {
+				errs = append(errs, &scanner.Error{
+					Pos: d.pos,
+					Msg: fmt.Sprintf("%s redeclared in this package; previous declaration at %v", d.name, prev),
+				})
+				continue
+			}
+			seen[d.name] = d.pos
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
 // isInit returns whether the given function declaration is a true init function.
 // Such a function must be called "init", not have a receiver, and have no arguments or return types.
 func isInit(f *ast.FuncDecl) bool { return isNiladic(f, "init") }
@@ -438,7 +670,11 @@ func readFile(baseDir, filename string) (file *ast.File, fset *token.FileSet, ha
 }
 
 // parseFile parses a single Go source file into a *File.
+// In daemon mode, unchanged files are not parsed again.
 func parseFile(baseDir, filename string) (*File, error) {
+	if f, ok := cachedFile(baseDir, filename); ok {
+		return f, nil
+	}
 	file, fset, hasMain, err := readFile(baseDir, filename)
 	if err != nil {
 		return nil, err
@@ -448,6 +684,7 @@ func parseFile(baseDir, filename string) (*File, error) {
 	// Determine whether the file has an init function at the same time.
 	var imports []string
 	hasInit := false
+	decls := topLevelDecls(fset, file)
 	for _, decl := range file.Decls {
 		if genDecl, ok := decl.(*ast.GenDecl); ok && genDecl.Tok == token.IMPORT {
 			for _, spec := range genDecl.Specs {
@@ -477,13 +714,16 @@ func parseFile(baseDir, filename string) (*File, error) {
 		return nil, ch.errors
 	}
 
-	return &File{
+	f := &File{
 		Name:        filename,
 		PackageName: file.Name.Name,
 		ImportPaths: imports,
 		HasInit:     hasInit,
 		HasMain:     hasMain,
-	}, nil
+		decls:       decls,
+	}
+	cacheFile(baseDir, filename, f)
+	return f, nil
 }
 
 var legalImportPath = regexp.MustCompile(`^[a-zA-Z0-9_\-./~+]+$`)
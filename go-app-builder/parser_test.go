@@ -0,0 +1,250 @@
+// Copyright 2015 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// writeApp writes files, keyed by slash-separated name, to a new temporary
+// directory, which the caller must remove. It also points --goroot at the
+// running toolchain and clears --gopath, restoring them when done is called.
+func writeApp(t *testing.T, files map[string]string) (dir string, names []string, done func()) {
+	dir, err := ioutil.TempDir("", "gab-parser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, src := range files {
+		full := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(full, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, filepath.FromSlash(name))
+	}
+	oldRoot, oldPath := *goRoot, *goPath
+	*goRoot, *goPath = runtime.GOROOT(), ""
+	return dir, names, func() {
+		*goRoot, *goPath = oldRoot, oldPath
+		os.RemoveAll(dir)
+	}
+}
+
+func TestCheckDuplicateDecls(t *testing.T) {
+	tests := []struct {
+		desc    string
+		files   map[string]string
+		wantErr string
+	}{
+		{
+			desc: "same name in two files",
+			files: map[string]string{
+				"foo/a.go": "package foo\n\nfunc F() {}\n",
+				"foo/b.go": "package foo\n\nvar F = 1\n",
+			},
+			wantErr: "b.go:3:5: F redeclared in this package; previous declaration at ",
+		},
+		{
+			desc: "same name in files with exclusive build tags",
+			files: map[string]string{
+				"foo/a.go": "// +build appengine\n\npackage foo\n\nfunc F() {}\n",
+				"foo/b.go": "// +build !appengine\n\npackage foo\n\nfunc F() {}\n",
+			},
+		},
+		{
+			desc: "methods and init functions",
+			files: map[string]string{
+				"foo/a.go": "package foo\n\ntype T int\n\nfunc (T) F() {}\n\nfunc init() {}\n",
+				"foo/b.go": "package foo\n\nfunc F() {}\n\nfunc init() {}\n",
+			},
+		},
+	}
+	for _, tt := range tests {
+		dir, names, done := writeApp(t, tt.files)
+		_, err := ParseFiles(dir, names)
+		done()
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s: unexpected error: %v", tt.desc, err)
+		case tt.wantErr != "" && err == nil:
+			t.Errorf("%s: no error, want %q", tt.desc, tt.wantErr)
+		case tt.wantErr != "" && !strings.Contains(err.Error(), tt.wantErr):
+			t.Errorf("%s: error %q, want it to contain %q", tt.desc, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCheckDupe(t *testing.T) {
+	// nosuchstd is treated as a standard package that cannot be located.
+	stdPackageCache["nosuchstd"] = true
+	defer delete(stdPackageCache, "nosuchstd")
+
+	tests := []struct {
+		desc      string
+		files     map[string]string
+		gopath    map[string]string // files in --gopath, if set
+		whitelist string
+		shadow    bool // --reject_gopath_dupes=false
+		wantErr   string
+		wantWarn  string
+		wantDupe  bool
+	}{
+		{
+			desc:    "standard package",
+			files:   map[string]string{"errors/errors.go": "package errors\n"},
+			wantErr: `same import path as the standard package in `,
+		},
+		{
+			desc:      "whitelisted standard package",
+			files:     map[string]string{"errors/errors.go": "package errors\n"},
+			whitelist: "errors",
+			wantDupe:  true,
+		},
+		{
+			desc:    "standard package that cannot be located",
+			files:   map[string]string{"nosuchstd/x.go": "package nosuchstd\n"},
+			wantErr: `same import path as a standard package, which could not be located`,
+		},
+		{
+			desc:    "$GOPATH package",
+			files:   map[string]string{"mylib/x.go": "package mylib\n"},
+			gopath:  map[string]string{"src/mylib/lib.go": "package mylib\n"},
+			wantErr: `same import path as the package in $GOPATH in `,
+		},
+		{
+			desc:      "whitelisted $GOPATH package",
+			files:     map[string]string{"mylib/x.go": "package mylib\n"},
+			gopath:    map[string]string{"src/mylib/lib.go": "package mylib\n"},
+			whitelist: "mylib",
+		},
+		{
+			desc:     "$GOPATH package with --reject_gopath_dupes=false",
+			files:    map[string]string{"mylib/x.go": "package mylib\n"},
+			gopath:   map[string]string{"src/mylib/lib.go": "package mylib\n"},
+			shadow:   true,
+			wantWarn: `warning: package "mylib" in `,
+		},
+		{
+			desc:   "unrelated $GOPATH package",
+			files:  map[string]string{"mylib/x.go": "package mylib\n"},
+			gopath: map[string]string{"src/otherlib/lib.go": "package otherlib\n"},
+		},
+	}
+	defer func(old string, oldReject bool) { *pkgDupes, *rejectDupes = old, oldReject }(*pkgDupes, *rejectDupes)
+	defer log.SetOutput(os.Stderr)
+	for _, tt := range tests {
+		var logged bytes.Buffer
+		log.SetOutput(&logged)
+		dir, names, done := writeApp(t, tt.files)
+		gopathDone := func() {}
+		if tt.gopath != nil {
+			var gopath string
+			gopath, _, gopathDone = writeApp(t, tt.gopath)
+			*goPath = gopath
+		}
+		*pkgDupes, *rejectDupes = tt.whitelist, !tt.shadow
+		app, err := ParseFiles(dir, names)
+		gopathDone()
+		done()
+		if tt.wantWarn == "" && logged.Len() > 0 {
+			t.Errorf("%s: unexpected log output %q", tt.desc, logged.String())
+		}
+		if w := logged.String(); tt.wantWarn != "" && (!strings.Contains(w, tt.wantWarn) || strings.Count(w, string(filepath.Separator)+"mylib") < 2) {
+			t.Errorf("%s: logged %q, want a warning containing %q that names both directories", tt.desc, w, tt.wantWarn)
+		}
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s: unexpected error: %v", tt.desc, err)
+			continue
+		case tt.wantErr != "" && err == nil:
+			t.Errorf("%s: no error, want %q", tt.desc, tt.wantErr)
+			continue
+		case tt.wantErr != "":
+			if !strings.Contains(err.Error(), tt.wantErr) || !strings.Contains(err.Error(), "--pkg_dupe_whitelist") {
+				t.Errorf("%s: error %q, want it to contain %q and suggest --pkg_dupe_whitelist", tt.desc, err, tt.wantErr)
+			}
+			continue
+		}
+		for _, p := range app.Packages {
+			if p.Dupe != tt.wantDupe {
+				t.Errorf("%s: package %q has Dupe = %v, want %v", tt.desc, p.ImportPath, p.Dupe, tt.wantDupe)
+			}
+		}
+	}
+}
+
+func TestExcludeRootPackages(t *testing.T) {
+	tests := []struct {
+		desc      string
+		files     map[string]string
+		exclude   string
+		wantRoots []string
+		wantErr   string
+	}{
+		{
+			desc: "optional package",
+			files: map[string]string{
+				"app/app.go":   "package app\n\nfunc init() {}\n",
+				"diag/diag.go": "package diag\n\nfunc init() {}\n",
+			},
+			exclude:   "diag",
+			wantRoots: []string{"app"},
+		},
+		{
+			desc: "package that is still imported",
+			files: map[string]string{
+				"app/app.go":   "package app\n\nimport \"diag\"\n\nfunc init() { diag.F() }\n",
+				"diag/diag.go": "package diag\n\nfunc init() {}\n\nfunc F() {}\n",
+			},
+			exclude: "diag",
+			wantErr: `excluded package "diag" is imported by "app"`,
+		},
+		{
+			desc: "package that is not in the app",
+			files: map[string]string{
+				"app/app.go": "package app\n\nfunc init() {}\n",
+			},
+			exclude: "diag",
+			wantErr: `excluded package "diag" is not part of the app`,
+		},
+	}
+	defer func(old string) { *excludePkgs = old }(*excludePkgs)
+	for _, tt := range tests {
+		dir, names, done := writeApp(t, tt.files)
+		*excludePkgs = tt.exclude
+		app, err := ParseFiles(dir, names)
+		done()
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: got error %v, want %q", tt.desc, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.desc, err)
+			continue
+		}
+		var roots []string
+		for _, p := range app.RootPackages {
+			roots = append(roots, p.ImportPath)
+		}
+		if !reflect.DeepEqual(roots, tt.wantRoots) {
+			t.Errorf("%s: got root packages %v, want %v", tt.desc, roots, tt.wantRoots)
+		}
+		if app.PackageIndex[tt.exclude] == nil {
+			t.Errorf("%s: excluded package %q was dropped from the app", tt.desc, tt.exclude)
+		}
+	}
+}
@@ -6,13 +6,23 @@ package main
 
 import (
 	"bytes"
+	"strings"
 	"text/template"
 )
 
 // MakeMain creates the synthetic main package for a Go App Engine app.
-func MakeMain(app *App) (string, error) {
+// If preMain is non-empty, it is a function reference such as
+// "myapp/framework.Setup" that main calls before serving.
+func MakeMain(app *App, preMain string) (string, error) {
+	data := struct {
+		*App
+		PreMainImport, PreMainFunc string
+	}{App: app}
+	if i := strings.LastIndex(preMain, "."); i >= 0 {
+		data.PreMainImport, data.PreMainFunc = preMain[:i], preMain[i+1:]
+	}
 	buf := new(bytes.Buffer)
-	if err := mainTemplate.Execute(buf, app); err != nil {
+	if err := mainTemplate.Execute(buf, data); err != nil {
 		return "", err
 	}
 	return buf.String(), nil
@@ -46,6 +56,9 @@ import (
 	"net/http"
 	"net/url"
 	{{end}}
+	{{with .PreMainImport}}
+	premain {{printf "%q" .}}
+	{{end}}
 
 	// Top-level app packages
 	{{range .RootPackages}}
@@ -54,6 +67,9 @@ import (
 )
 
 func main() {
+	{{with .PreMainFunc}}
+	premain.{{.}}()
+	{{end}}
 	{{if .InternalPkg}}
 	internal.Main()
 	{{else}}
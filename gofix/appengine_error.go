@@ -0,0 +1,65 @@
+// Copyright 2015 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"go/ast"
+	"strings"
+)
+
+var appengineErrorFix = fix{
+	"appengine_error",
+	"2011-11-02",
+	appengineError,
+	`Use error and errors.New instead of os.Error and os.NewError in App Engine apps.`,
+}
+
+func init() {
+	register(appengineErrorFix)
+}
+
+// importsAppengine reports whether f imports package appengine or any of its
+// subpackages.
+func importsAppengine(f *ast.File) bool {
+	for _, s := range f.Imports {
+		if p := importPath(s); p == "appengine" || strings.HasPrefix(p, "appengine/") {
+			return true
+		}
+	}
+	return false
+}
+
+func appengineError(f *ast.File) bool {
+	if !imports(f, "os") || !importsAppengine(f) {
+		return false
+	}
+
+	fixed, needErrors := false, false
+	walk(f, func(n interface{}) {
+		p, ok := n.(*ast.Expr)
+		if !ok {
+			return
+		}
+		if isPkgDot(*p, "os", "Error") {
+			*p = ast.NewIdent("error")
+			fixed = true
+			return
+		}
+		if call, ok := (*p).(*ast.CallExpr); ok && isPkgDot(call.Fun, "os", "NewError") {
+			call.Fun = &ast.SelectorExpr{
+				X:   ast.NewIdent("errors"),
+				Sel: ast.NewIdent("New"),
+			}
+			fixed, needErrors = true, true
+		}
+	})
+	if needErrors {
+		addImport(f, "errors")
+	}
+	if fixed && !usesImport(f, "os") {
+		deleteImport(f, "os")
+	}
+	return fixed
+}
@@ -0,0 +1,82 @@
+// Copyright 2015 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+func init() {
+	addTestCases(appengineErrorTests, appengineError)
+}
+
+var appengineErrorTests = []testCase{
+	{
+		Name: "appengine_error.0",
+		In: `package foo
+
+import (
+	"appengine/datastore"
+	"os"
+)
+
+func f(k *datastore.Key) os.Error {
+	var err os.Error
+	if k == nil {
+		err = os.NewError("nil key")
+	}
+	return err
+}
+`,
+		Out: `package foo
+
+import (
+	"appengine/datastore"
+	"errors"
+)
+
+func f(k *datastore.Key) error {
+	var err error
+	if k == nil {
+		err = errors.New("nil key")
+	}
+	return err
+}
+`,
+	},
+	{
+		Name: "appengine_error.1",
+		In: `package foo
+
+import (
+	"appengine/taskqueue"
+	"os"
+)
+
+func f() (string, os.Error) {
+	return os.Getenv("QUEUE"), nil
+}
+`,
+		Out: `package foo
+
+import (
+	"appengine/taskqueue"
+	"os"
+)
+
+func f() (string, error) {
+	return os.Getenv("QUEUE"), nil
+}
+`,
+	},
+	// Files that don't import an App Engine package are left alone.
+	{
+		Name: "appengine_error.2",
+		In: `package foo
+
+import "os"
+
+func f() os.Error {
+	return os.NewError("not an app")
+}
+`,
+	},
+}
@@ -0,0 +1,96 @@
+// Copyright 2015 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"go/ast"
+	"go/token"
+)
+
+var datastoreTimeFix = fix{
+	"datastore_time",
+	"2012-01-24",
+	datastoreTime,
+	`Use time.Time instead of datastore.Time, and time.Unix instead of
+datastore.SecondsToTime and conversions to datastore.Time.`,
+}
+
+func init() {
+	register(datastoreTimeFix)
+}
+
+func datastoreTime(f *ast.File) bool {
+	if !imports(f, "appengine/datastore") {
+		return false
+	}
+
+	fixed := false
+	// datastore.Time(x) -> time.Unix(0, int64(x)*1e3)
+	// This is done in a pass of its own, since the pass below rewrites
+	// datastore.Time before it visits the call that converts to it.
+	walk(f, func(n interface{}) {
+		p, ok := n.(*ast.Expr)
+		if !ok {
+			return
+		}
+		call, ok := (*p).(*ast.CallExpr)
+		if !ok || len(call.Args) != 1 || !isPkgDot(call.Fun, "datastore", "Time") {
+			return
+		}
+		usec := &ast.CallExpr{
+			Fun:  ast.NewIdent("int64"),
+			Args: call.Args,
+		}
+		*p = &ast.CallExpr{
+			Fun: &ast.SelectorExpr{
+				X:   ast.NewIdent("time"),
+				Sel: ast.NewIdent("Unix"),
+			},
+			Args: []ast.Expr{
+				&ast.BasicLit{Kind: token.INT, Value: "0"},
+				&ast.BinaryExpr{
+					X:  usec,
+					Op: token.MUL,
+					Y:  &ast.BasicLit{Kind: token.FLOAT, Value: "1e3"},
+				},
+			},
+		}
+		fixed = true
+	})
+	walk(f, func(n interface{}) {
+		p, ok := n.(*ast.Expr)
+		if !ok {
+			return
+		}
+		// datastore.Time -> time.Time
+		if isPkgDot(*p, "datastore", "Time") {
+			*p = &ast.SelectorExpr{
+				X:   ast.NewIdent("time"),
+				Sel: ast.NewIdent("Time"),
+			}
+			fixed = true
+			return
+		}
+		// datastore.SecondsToTime(x) -> time.Unix(x, 0)
+		call, ok := (*p).(*ast.CallExpr)
+		if !ok || len(call.Args) != 1 || !isPkgDot(call.Fun, "datastore", "SecondsToTime") {
+			return
+		}
+		call.Fun = &ast.SelectorExpr{
+			X:   ast.NewIdent("time"),
+			Sel: ast.NewIdent("Unix"),
+		}
+		call.Args = append(call.Args, &ast.BasicLit{Kind: token.INT, Value: "0"})
+		fixed = true
+	})
+	if !fixed {
+		return false
+	}
+	addImport(f, "time")
+	if !usesImport(f, "appengine/datastore") {
+		deleteImport(f, "appengine/datastore")
+	}
+	return true
+}
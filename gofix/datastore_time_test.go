@@ -0,0 +1,105 @@
+// Copyright 2015 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+func init() {
+	addTestCases(datastoreTimeTests, datastoreTime)
+}
+
+var datastoreTimeTests = []testCase{
+	{
+		Name: "datastore_time.0",
+		In: `package foo
+
+import (
+	"appengine"
+	"appengine/datastore"
+)
+
+type Greeting struct {
+	Author  string
+	Content string
+	Date    datastore.Time
+}
+
+func put(c appengine.Context, k *datastore.Key, secs int64) {
+	g := &Greeting{Date: datastore.SecondsToTime(secs)}
+	datastore.Put(c, k, g)
+}
+`,
+		Out: `package foo
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"time"
+)
+
+type Greeting struct {
+	Author  string
+	Content string
+	Date    time.Time
+}
+
+func put(c appengine.Context, k *datastore.Key, secs int64) {
+	g := &Greeting{Date: time.Unix(secs, 0)}
+	datastore.Put(c, k, g)
+}
+`,
+	},
+	{
+		Name: "datastore_time.1",
+		In: `package foo
+
+import (
+	"appengine/datastore"
+	"time"
+)
+
+var epoch = datastore.SecondsToTime(0)
+
+var start = time.Now()
+`,
+		Out: `package foo
+
+import "time"
+
+var epoch = time.Unix(0, 0)
+
+var start = time.Now()
+`,
+	},
+	{
+		Name: "datastore_time.2",
+		In: `package foo
+
+import "appengine/datastore"
+
+type Event struct {
+	At datastore.Time
+}
+
+func newEvent(usec int64) *Event {
+	return &Event{At: datastore.Time(usec)}
+}
+
+var zero = datastore.Time(0)
+`,
+		Out: `package foo
+
+import "time"
+
+type Event struct {
+	At time.Time
+}
+
+func newEvent(usec int64) *Event {
+	return &Event{At: time.Unix(0, int64(usec)*1e3)}
+}
+
+var zero = time.Unix(0, int64(0)*1e3)
+`,
+	},
+}